@@ -0,0 +1,550 @@
+package decrypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/mp4"
+)
+
+// piffSampleEncryption is the uuid of the PIFF box that predates senc.
+var piffSampleEncryption = []byte{0xa2, 0x39, 0x4f, 0x52, 0x5a, 0x9b, 0x4f, 0x14, 0xa2, 0x44, 0x6c, 0x42, 0x7c, 0x64, 0x8d, 0xf4}
+
+type cencTrack struct {
+	scheme     string
+	block      cipher.Block
+	ivSize     int
+	constantIV []byte
+	crypt      int
+	skip       int
+	sampleSize uint32
+}
+
+type subsample struct {
+	clear     int
+	protected int
+}
+
+type sampleInfo struct {
+	iv         []byte
+	subsamples []subsample
+}
+
+type sampleLocation struct {
+	offset int
+	size   int
+}
+
+// CENC decrypts fragmented MP4 segments protected with ISO/IEC 23001-7
+// common encryption, using the cenc, cbcs or cbc1 scheme. The keys are
+// indexed by the hex encoded KID.
+type CENC struct {
+	keys   map[string][]byte
+	l      sync.RWMutex
+	tracks map[uint32]*cencTrack
+}
+
+func NewCENC(keys map[string][]byte) *CENC {
+	return &CENC{
+		keys:   keys,
+		tracks: map[uint32]*cencTrack{},
+	}
+}
+
+// Init reads the encryption parameters of every track from an init segment.
+// It returns the init segment with the pssh and sinf boxes removed and the
+// encrypted sample entries renamed to their original format, which is what
+// a clear file would contain.
+func (c *CENC) Init(data []byte) ([]byte, error) {
+	boxes, err := mp4.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := mp4.Find(boxes, "moov")
+	if moov == nil {
+		return nil, fmt.Errorf("moov box not found in init segment")
+	}
+
+	sampleSizes := map[uint32]uint32{}
+	if mvex := moov.Find("mvex"); mvex != nil {
+		for _, trex := range mvex.FindAll("trex") {
+			if len(trex.Data) >= 20 {
+				sampleSizes[binary.BigEndian.Uint32(trex.Data[4:])] = binary.BigEndian.Uint32(trex.Data[16:])
+			}
+		}
+	}
+
+	for _, trak := range moov.FindAll("trak") {
+		tkhd := trak.Find("tkhd")
+		stsd := trak.Find("mdia", "minf", "stbl", "stsd")
+		if tkhd == nil || stsd == nil {
+			continue
+		}
+		trackID := tkhdTrackID(tkhd)
+
+		for _, entry := range stsd.Children {
+			sinf := entry.Find("sinf")
+			if sinf == nil {
+				continue
+			}
+
+			frma := sinf.Find("frma")
+			schm := sinf.Find("schm")
+			tenc := sinf.Find("schi", "tenc")
+			if frma == nil || len(frma.Data) < 4 || schm == nil || len(schm.Data) < 8 || tenc == nil {
+				return nil, fmt.Errorf("incomplete protection scheme information of track %d", trackID)
+			}
+
+			track, kid, err := c.parseTenc(tenc)
+			if err != nil {
+				return nil, fmt.Errorf("track %d: %w", trackID, err)
+			}
+			track.scheme = string(schm.Data[4:8])
+			track.sampleSize = sampleSizes[trackID]
+
+			switch track.scheme {
+			case "cenc", "cbcs", "cbc1":
+			default:
+				return nil, fmt.Errorf("track %d: unsupported protection scheme %s", trackID, track.scheme)
+			}
+
+			if track.block != nil {
+				c.l.Lock()
+				c.tracks[trackID] = track
+				c.l.Unlock()
+			} else if kid != "" {
+				return nil, fmt.Errorf("track %d: no key for KID %s", trackID, kid)
+			}
+
+			entry.Type = string(frma.Data[:4])
+			entry.Remove("sinf")
+		}
+	}
+
+	moov.Remove("pssh")
+
+	return mp4.Encode(boxes), nil
+}
+
+func tkhdTrackID(tkhd *mp4.Box) uint32 {
+	version, _ := tkhd.FullBox()
+	if version == 1 {
+		if len(tkhd.Data) >= 24 {
+			return binary.BigEndian.Uint32(tkhd.Data[20:])
+		}
+	} else if len(tkhd.Data) >= 16 {
+		return binary.BigEndian.Uint32(tkhd.Data[12:])
+	}
+	return 0
+}
+
+// parseTenc returns the default encryption parameters of a track and its
+// KID. The cipher is only set for protected tracks with a known key.
+func (c *CENC) parseTenc(tenc *mp4.Box) (*cencTrack, string, error) {
+	d := tenc.Data
+	if len(d) < 24 {
+		return nil, "", fmt.Errorf("tenc box too short")
+	}
+
+	track := &cencTrack{}
+	version, _ := tenc.FullBox()
+	if version > 0 {
+		track.crypt = int(d[5] >> 4)
+		track.skip = int(d[5] & 0x0f)
+	}
+
+	protected := d[6] != 0
+	track.ivSize = int(d[7])
+	kid := hex.EncodeToString(d[8:24])
+	if !protected {
+		return track, "", nil
+	}
+
+	if track.ivSize == 0 {
+		if len(d) < 25 || len(d) < 25+int(d[24]) {
+			return nil, "", fmt.Errorf("tenc box too short")
+		}
+		track.constantIV = append([]byte(nil), d[25:25+int(d[24])]...)
+	}
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return track, kid, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("key for KID %s: %w", kid, err)
+	}
+	track.block = block
+
+	return track, kid, nil
+}
+
+// Decrypt decrypts the samples of a media segment in place. The boxes that
+// describe the encryption are renamed to free, so that the segment can be
+// joined with the init segment returned by Init. The init segments of the
+// next map sections are passed to Init.
+func (c *CENC) Decrypt(data []byte) ([]byte, error) {
+	boxes, err := mp4.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if mp4.Find(boxes, "moov") != nil {
+		return c.Init(data)
+	}
+
+	for _, moof := range boxes {
+		if moof.Type != "moof" {
+			continue
+		}
+
+		for _, pssh := range moof.FindAll("pssh") {
+			mp4.Rename(data, pssh, "free")
+		}
+
+		for _, traf := range moof.FindAll("traf") {
+			err = c.decryptTraf(data, moof, traf)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return data, nil
+}
+
+func (c *CENC) decryptTraf(data []byte, moof, traf *mp4.Box) error {
+	tfhd := traf.Find("tfhd")
+	if tfhd == nil || len(tfhd.Data) < 8 {
+		return fmt.Errorf("tfhd box not found")
+	}
+
+	c.l.RLock()
+	track := c.tracks[binary.BigEndian.Uint32(tfhd.Data[4:])]
+	c.l.RUnlock()
+	if track == nil {
+		return nil
+	}
+
+	samples, base, err := sampleLocations(moof, traf, tfhd, track.sampleSize)
+	if err != nil {
+		return err
+	}
+
+	infos, err := c.sampleInfos(data, traf, track, base, len(samples))
+	if err != nil {
+		return err
+	}
+
+	for i, s := range samples {
+		if s.offset < 0 || s.offset+s.size > len(data) {
+			return fmt.Errorf("sample %d is out of the segment", i)
+		}
+		err = track.decryptSample(infos[i], data[s.offset:s.offset+s.size])
+		if err != nil {
+			return fmt.Errorf("sample %d: %w", i, err)
+		}
+	}
+
+	for _, b := range traf.Children {
+		switch b.Type {
+		case "senc", "saiz", "saio":
+			mp4.Rename(data, b, "free")
+		case "sbgp", "sgpd":
+			if len(b.Data) >= 8 && string(b.Data[4:8]) == "seig" {
+				mp4.Rename(data, b, "free")
+			}
+		case "uuid":
+			if bytes.HasPrefix(b.Data, piffSampleEncryption) {
+				mp4.Rename(data, b, "free")
+			}
+		}
+	}
+
+	return nil
+}
+
+// sampleLocations returns the position of every sample of a track fragment
+// in the segment, and the base data offset.
+func sampleLocations(moof, traf, tfhd *mp4.Box, defaultSize uint32) ([]sampleLocation, int, error) {
+	_, flags := tfhd.FullBox()
+	d := tfhd.Data
+	base := moof.Offset
+	p := 8
+	if flags&0x01 != 0 {
+		if len(d) < p+8 {
+			return nil, 0, fmt.Errorf("tfhd box too short")
+		}
+		base = int(binary.BigEndian.Uint64(d[p:]))
+		p += 8
+	}
+	if flags&0x02 != 0 {
+		p += 4
+	}
+	if flags&0x08 != 0 {
+		p += 4
+	}
+	if flags&0x10 != 0 {
+		if len(d) < p+4 {
+			return nil, 0, fmt.Errorf("tfhd box too short")
+		}
+		defaultSize = binary.BigEndian.Uint32(d[p:])
+	}
+
+	var samples []sampleLocation
+	next := base
+	for _, trun := range traf.FindAll("trun") {
+		_, flags := trun.FullBox()
+		t := trun.Data
+		if len(t) < 8 {
+			return nil, 0, fmt.Errorf("trun box too short")
+		}
+		count := int(binary.BigEndian.Uint32(t[4:]))
+		q := 8
+		if flags&0x01 != 0 {
+			if len(t) < q+4 {
+				return nil, 0, fmt.Errorf("trun box too short")
+			}
+			next = base + int(int32(binary.BigEndian.Uint32(t[q:])))
+			q += 4
+		}
+		if flags&0x04 != 0 {
+			q += 4
+		}
+
+		for i := 0; i < count; i++ {
+			if flags&0x100 != 0 {
+				q += 4
+			}
+			size := int(defaultSize)
+			if flags&0x200 != 0 {
+				if len(t) < q+4 {
+					return nil, 0, fmt.Errorf("trun box too short")
+				}
+				size = int(binary.BigEndian.Uint32(t[q:]))
+				q += 4
+			}
+			if flags&0x400 != 0 {
+				q += 4
+			}
+			if flags&0x800 != 0 {
+				q += 4
+			}
+			samples = append(samples, sampleLocation{offset: next, size: size})
+			next += size
+		}
+	}
+
+	return samples, base, nil
+}
+
+// sampleInfos reads the IV and subsample layout of every sample, from the
+// senc box or from the auxiliary information pointed to by saiz and saio.
+func (c *CENC) sampleInfos(data []byte, traf *mp4.Box, track *cencTrack, base int, count int) ([]sampleInfo, error) {
+	if senc := traf.Find("senc"); senc != nil {
+		return parseSenc(senc.Data, track.ivSize, count)
+	}
+
+	for _, b := range traf.FindAll("uuid") {
+		if bytes.HasPrefix(b.Data, piffSampleEncryption) {
+			d := b.Data[16:]
+			ivSize := track.ivSize
+			_, flags := (&mp4.Box{Data: d}).FullBox()
+			if flags&0x01 != 0 {
+				// algorithm id, iv size and kid override the defaults
+				if len(d) < 24 {
+					return nil, fmt.Errorf("piff sample encryption box too short")
+				}
+				ivSize = int(d[7])
+				d = append(d[:4:4], d[24:]...)
+			}
+			return parseSenc(d, ivSize, count)
+		}
+	}
+
+	saiz := traf.Find("saiz")
+	saio := traf.Find("saio")
+	if saiz == nil || saio == nil {
+		return nil, fmt.Errorf("sample encryption information not found")
+	}
+
+	_, flags := saiz.FullBox()
+	d := saiz.Data
+	p := 4
+	if flags&0x01 != 0 {
+		p += 8
+	}
+	if len(d) < p+5 {
+		return nil, fmt.Errorf("saiz box too short")
+	}
+	defaultSize := int(d[p])
+	n := int(binary.BigEndian.Uint32(d[p+1:]))
+	sizes := d[p+5:]
+	if defaultSize == 0 && len(sizes) < n {
+		return nil, fmt.Errorf("saiz box too short")
+	}
+
+	version, flags := saio.FullBox()
+	d = saio.Data
+	p = 4
+	if flags&0x01 != 0 {
+		p += 8
+	}
+	if len(d) < p+8 {
+		return nil, fmt.Errorf("saio box too short")
+	}
+	var offset int
+	if version == 0 {
+		offset = int(binary.BigEndian.Uint32(d[p+4:]))
+	} else {
+		if len(d) < p+12 {
+			return nil, fmt.Errorf("saio box too short")
+		}
+		offset = int(binary.BigEndian.Uint64(d[p+4:]))
+	}
+	offset += base
+
+	infos := make([]sampleInfo, count)
+	for i := 0; i < count && i < n; i++ {
+		size := defaultSize
+		if size == 0 {
+			size = int(sizes[i])
+		}
+		if offset < 0 || offset+size > len(data) || size < track.ivSize {
+			return nil, fmt.Errorf("auxiliary information of sample %d is out of the segment", i)
+		}
+		aux := data[offset : offset+size]
+		infos[i].iv = aux[:track.ivSize]
+		if size > track.ivSize {
+			subsamples, _, err := parseSubsamples(aux[track.ivSize:])
+			if err != nil {
+				return nil, err
+			}
+			infos[i].subsamples = subsamples
+		}
+		offset += size
+	}
+	return infos, nil
+}
+
+func parseSenc(d []byte, ivSize int, count int) ([]sampleInfo, error) {
+	if len(d) < 8 {
+		return nil, fmt.Errorf("senc box too short")
+	}
+	flags := binary.BigEndian.Uint32(d) & 0xffffff
+	n := int(binary.BigEndian.Uint32(d[4:]))
+	if n < count {
+		return nil, fmt.Errorf("senc box describes %d of %d samples", n, count)
+	}
+
+	infos := make([]sampleInfo, count)
+	d = d[8:]
+	for i := 0; i < count; i++ {
+		if len(d) < ivSize {
+			return nil, fmt.Errorf("senc box too short")
+		}
+		infos[i].iv = d[:ivSize]
+		d = d[ivSize:]
+
+		if flags&0x02 != 0 {
+			subsamples, used, err := parseSubsamples(d)
+			if err != nil {
+				return nil, err
+			}
+			infos[i].subsamples = subsamples
+			d = d[used:]
+		}
+	}
+	return infos, nil
+}
+
+func parseSubsamples(d []byte) ([]subsample, int, error) {
+	if len(d) < 2 {
+		return nil, 0, fmt.Errorf("subsample information too short")
+	}
+	n := int(binary.BigEndian.Uint16(d))
+	if len(d) < 2+n*6 {
+		return nil, 0, fmt.Errorf("subsample information too short")
+	}
+
+	subsamples := make([]subsample, n)
+	for i := range subsamples {
+		e := d[2+i*6:]
+		subsamples[i].clear = int(binary.BigEndian.Uint16(e))
+		subsamples[i].protected = int(binary.BigEndian.Uint32(e[2:]))
+	}
+	return subsamples, 2 + n*6, nil
+}
+
+func (t *cencTrack) decryptSample(info sampleInfo, sample []byte) error {
+	iv := info.iv
+	if len(iv) == 0 {
+		iv = t.constantIV
+	}
+	if len(iv) == 8 {
+		iv = append(iv[:8:8], make([]byte, 8)...)
+	}
+	if len(iv) != aes.BlockSize {
+		return fmt.Errorf("invalid iv size %d", len(iv))
+	}
+
+	subsamples := info.subsamples
+	if len(subsamples) == 0 {
+		subsamples = []subsample{{clear: 0, protected: len(sample)}}
+	}
+
+	var ctr cipher.Stream
+	var cbc cipher.BlockMode
+	switch t.scheme {
+	case "cenc":
+		ctr = cipher.NewCTR(t.block, iv)
+	case "cbc1":
+		cbc = cipher.NewCBCDecrypter(t.block, iv)
+	}
+
+	pos := 0
+	for _, s := range subsamples {
+		pos += s.clear
+		if pos+s.protected > len(sample) {
+			return fmt.Errorf("subsamples exceed the sample size")
+		}
+		data := sample[pos : pos+s.protected]
+		pos += s.protected
+
+		switch t.scheme {
+		case "cenc":
+			ctr.XORKeyStream(data, data)
+		case "cbc1":
+			data = data[:len(data)/aes.BlockSize*aes.BlockSize]
+			cbc.CryptBlocks(data, data)
+		case "cbcs":
+			// the iv is reset and the pattern restarts for every subsample
+			decryptPattern(t.block, iv, data, t.crypt, t.skip)
+		}
+	}
+	return nil
+}
+
+// decryptPattern decrypts crypt blocks and leaves skip blocks in the clear,
+// repeatedly. A trailing partial block is never encrypted.
+func decryptPattern(block cipher.Block, iv []byte, data []byte, crypt, skip int) {
+	if crypt == 0 {
+		crypt = 1
+		skip = 0
+	}
+
+	cbc := cipher.NewCBCDecrypter(block, iv)
+	for len(data) >= aes.BlockSize {
+		n := min(crypt*aes.BlockSize, len(data)/aes.BlockSize*aes.BlockSize)
+		cbc.CryptBlocks(data[:n], data[:n])
+		data = data[n:]
+		data = data[min(skip*aes.BlockSize, len(data)):]
+	}
+}
@@ -0,0 +1,230 @@
+package decrypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/mp4"
+)
+
+func box(typ string, data []byte, children ...*mp4.Box) *mp4.Box {
+	return &mp4.Box{Type: typ, Data: data, Children: children}
+}
+
+func u32s(v ...uint32) []byte {
+	var b []byte
+	for _, x := range v {
+		b = binary.BigEndian.AppendUint32(b, x)
+	}
+	return b
+}
+
+// cencInit returns an init segment with one protected video track.
+func cencInit(scheme string, tenc []byte) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	sinf := box("sinf", nil,
+		box("frma", []byte("avc1")),
+		box("schm", append(append(u32s(0), scheme...), u32s(0x10000)...)),
+		box("schi", nil, box("tenc", tenc)))
+	return mp4.Encode([]*mp4.Box{box("moov", nil,
+		box("trak", nil,
+			box("tkhd", tkhd),
+			box("mdia", nil, box("minf", nil, box("stbl", nil,
+				box("stsd", u32s(0, 1), box("encv", make([]byte, 78), box("avcC", []byte{1, 0x64, 0, 0x1f}), sinf)))))),
+		box("mvex", nil, box("trex", u32s(0, 1, 1, 0, 0))),
+		box("pssh", make([]byte, 32)),
+	)})
+}
+
+// encryptSample encrypts the protected ranges of a sample like decryptSample
+// decrypts them.
+func encryptSample(scheme string, block cipher.Block, iv []byte, crypt, skip int, sample []byte, subsamples []subsample) {
+	if len(iv) == 8 {
+		iv = append(iv[:8:8], make([]byte, 8)...)
+	}
+	ctr := cipher.NewCTR(block, iv)
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	pos := 0
+	for _, s := range subsamples {
+		pos += s.clear
+		data := sample[pos : pos+s.protected]
+		pos += s.protected
+		switch scheme {
+		case "cenc":
+			ctr.XORKeyStream(data, data)
+		case "cbc1":
+			data = data[:len(data)/aes.BlockSize*aes.BlockSize]
+			cbc.CryptBlocks(data, data)
+		case "cbcs":
+			cbc := cipher.NewCBCEncrypter(block, iv)
+			for len(data) >= aes.BlockSize {
+				n := min(crypt*aes.BlockSize, len(data)/aes.BlockSize*aes.BlockSize)
+				cbc.CryptBlocks(data[:n], data[:n])
+				data = data[n:]
+				data = data[min(skip*aes.BlockSize, len(data)):]
+			}
+		}
+	}
+}
+
+func TestCENC(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 16)
+	kid := bytes.Repeat([]byte{0xab}, 16)
+	block, _ := aes.NewCipher(key)
+
+	subsamples := [][]subsample{{{10, 224}, {6, 20}}, {{5, 65}}}
+	tests := []struct {
+		scheme string
+		// ivSize 0 uses the constant iv
+		ivSize      int
+		crypt, skip int
+		// aux is where the sample encryption information is: senc, or
+		// saiz and saio pointing to the start of mdat
+		aux string
+	}{
+		{"cenc", 8, 0, 0, "senc"},
+		{"cenc", 16, 0, 0, "saiz"},
+		{"cbc1", 16, 0, 0, "senc"},
+		{"cbcs", 0, 1, 9, "senc"},
+		{"cbcs", 16, 1, 9, "saiz"},
+	}
+	for _, tt := range tests {
+		tenc := []byte{0, 0, 0, 0, 0, 0, 1, byte(tt.ivSize)}
+		if tt.crypt > 0 {
+			tenc[0] = 1
+			tenc[5] = byte(tt.crypt<<4 | tt.skip)
+		}
+		tenc = append(tenc, kid...)
+		constantIV := bytes.Repeat([]byte{9}, 16)
+		if tt.ivSize == 0 {
+			tenc = append(append(tenc, 16), constantIV...)
+		}
+
+		c := NewCENC(map[string][]byte{hex.EncodeToString(kid): key})
+		init, err := c.Init(cencInit(tt.scheme, tenc))
+		if err != nil {
+			t.Fatalf("%s: Init: %v", tt.scheme, err)
+		}
+		boxes, err := mp4.Parse(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := mp4.Find(boxes, "moov", "trak", "mdia", "minf", "stbl", "stsd", "avc1")
+		if entry == nil || entry.Find("sinf") != nil || mp4.Find(boxes, "moov", "pssh") != nil {
+			t.Errorf("%s: init still protected", tt.scheme)
+		}
+
+		// the samples and their sample encryption information
+		var plain, encrypted, aux, senc []byte
+		var sizes []uint32
+		for i, subs := range subsamples {
+			size := 0
+			for _, s := range subs {
+				size += s.clear + s.protected
+			}
+			sample := counting(i*50, size)
+			iv := constantIV
+			if tt.ivSize > 0 {
+				iv = bytes.Repeat([]byte{byte(i + 1)}, tt.ivSize)
+			}
+			e := append([]byte(nil), sample...)
+			encryptSample(tt.scheme, block, iv, tt.crypt, tt.skip, e, subs)
+			plain = append(plain, sample...)
+			encrypted = append(encrypted, e...)
+			sizes = append(sizes, uint32(size))
+
+			info := append([]byte(nil), iv[:tt.ivSize]...)
+			info = binary.BigEndian.AppendUint16(info, uint16(len(subs)))
+			for _, s := range subs {
+				info = binary.BigEndian.AppendUint16(info, uint16(s.clear))
+				info = binary.BigEndian.AppendUint32(info, uint32(s.protected))
+			}
+			aux = append(aux, info...)
+			senc = append(senc, byte(len(info)))
+		}
+
+		trun := append(u32s(0x201, uint32(len(sizes)), 0), u32s(sizes...)...)
+		traf := box("traf", nil, box("tfhd", u32s(0x020000, 1)), box("trun", trun))
+		mdat := encrypted
+		if tt.aux == "senc" {
+			traf.Children = append(traf.Children, box("senc", append(u32s(2, uint32(len(sizes))), aux...)))
+		} else {
+			saiz := append(append(u32s(0), 0), u32s(uint32(len(sizes)))...)
+			traf.Children = append(traf.Children,
+				box("saiz", append(saiz, senc...)),
+				box("saio", u32s(0, 1, 0)))
+			mdat = append(append([]byte(nil), aux...), encrypted...)
+		}
+		moof := box("moof", nil, box("mfhd", u32s(0, 1)), traf)
+		// the data offset and the auxiliary information offset are
+		// relative to the moof box
+		start := moof.Size() + 8
+		binary.BigEndian.PutUint32(trun[8:], uint32(start+len(mdat)-len(encrypted)))
+		if tt.aux == "saiz" {
+			binary.BigEndian.PutUint32(traf.Children[3].Data[8:], uint32(start))
+		}
+		segment := mp4.Encode([]*mp4.Box{moof, box("mdat", mdat)})
+
+		data, err := c.Decrypt(segment)
+		if err != nil {
+			t.Fatalf("%s %s: Decrypt: %v", tt.scheme, tt.aux, err)
+		}
+		if got := data[len(data)-len(plain):]; !bytes.Equal(got, plain) {
+			t.Errorf("%s %s: samples decrypted to\n%x\nwant\n%x", tt.scheme, tt.aux, got, plain)
+		}
+		boxes, err = mp4.Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range mp4.Find(boxes, "moof", "traf").Children {
+			switch b.Type {
+			case "senc", "saiz", "saio":
+				t.Errorf("%s %s: %s box kept", tt.scheme, tt.aux, b.Type)
+			}
+		}
+	}
+}
+
+func TestParseSenc(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		count int
+		want  []sampleInfo
+		err   bool
+	}{
+		{"ivs", append(u32s(0, 2), 1, 1, 2, 2), 2, []sampleInfo{{iv: []byte{1, 1}}, {iv: []byte{2, 2}}}, false},
+		{"subsamples", append(u32s(2, 1), 1, 1, 0, 2, 0, 3, 0, 0, 0, 16, 0, 4, 0, 0, 0, 32), 1,
+			[]sampleInfo{{iv: []byte{1, 1}, subsamples: []subsample{{3, 16}, {4, 32}}}}, false},
+		{"fewer samples", append(u32s(0, 1), 1, 1), 2, nil, true},
+		{"short iv", append(u32s(0, 2), 1, 1, 2), 2, nil, true},
+		{"short subsamples", append(u32s(2, 1), 1, 1, 0, 2, 0, 3, 0, 0, 0, 16), 1, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSenc(tt.data, 2, tt.count)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d samples, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].iv, tt.want[i].iv) || len(got[i].subsamples) != len(tt.want[i].subsamples) {
+				t.Errorf("%s: sample %d is %+v, want %+v", tt.name, i, got[i], tt.want[i])
+				continue
+			}
+			for k, s := range got[i].subsamples {
+				if s != tt.want[i].subsamples[k] {
+					t.Errorf("%s: sample %d subsample %d is %+v, want %+v", tt.name, i, k, s, tt.want[i].subsamples[k])
+				}
+			}
+		}
+	}
+}
@@ -1,8 +1,20 @@
 package decrypter
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+var (
+	ErrLength      = errors.New("encrypted data length is not a multiple of the block size")
+	ErrPadding     = errors.New("invalid pkcs7 padding")
+	ErrKeyMismatch = errors.New("decrypted data is not a media segment")
 )
 
 func Decrypt(data, key, iv []byte) ([]byte, error) {
@@ -11,14 +23,183 @@ func Decrypt(data, key, iv []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrLength
+	}
+
 	cbc := cipher.NewCBCDecrypter(block, iv)
 	cbc.CryptBlocks(data, data)
 
-	return PKCS7UnPadding(data), nil
+	data, err = PKCS7UnPadding(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isMedia(data) {
+		return nil, ErrKeyMismatch
+	}
+	return data, nil
 }
 
-func PKCS7UnPadding(origData []byte) []byte {
+func PKCS7UnPadding(origData []byte) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, ErrPadding
+	}
 	unpadding := int(origData[length-1])
-	return origData[:(length - unpadding)]
+	if unpadding == 0 || unpadding > aes.BlockSize || unpadding > length {
+		return nil, ErrPadding
+	}
+	for _, b := range origData[length-unpadding:] {
+		if int(b) != unpadding {
+			return nil, ErrPadding
+		}
+	}
+	return origData[:(length - unpadding)], nil
+}
+
+// isMedia reports whether decrypted data starts like a segment: ts packets,
+// a fMP4 box, packed audio or the image header some websites add.
+func isMedia(data []byte) bool {
+	switch {
+	case len(data) == 0:
+		return true
+	case ts.HasImageHeader(data):
+		// before the sync byte, which is the G of GIF
+		return true
+	case data[0] == 0x47:
+		return len(data) <= ts.PacketLength || data[ts.PacketLength] == 0x47
+	case bytes.HasPrefix(data, []byte("ID3")), bytes.HasPrefix(data, []byte("WEBVTT")):
+		return true
+	case len(data) >= 2 && data[0] == 0xff && data[1]&0xf0 == 0xf0:
+		// ADTS
+		return true
+	case len(data) >= 2 && data[0] == 0x0b && data[1] == 0x77:
+		// AC-3
+		return true
+	}
+	return isBoxHeader(data)
+}
+
+// segmentBoxes are the boxes a fMP4 segment starts with.
+var segmentBoxes = map[string]bool{
+	"ftyp": true, "styp": true, "moov": true, "moof": true, "sidx": true,
+	"emsg": true, "prft": true, "free": true,
+}
+
+// isBoxHeader reports whether data starts with the header of a box. Four
+// printable bytes are not rare in random data, so the box must be one a
+// segment starts with, or have a size within data.
+func isBoxHeader(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	size := uint64(binary.BigEndian.Uint32(data))
+	header := uint64(8)
+	if size == 1 {
+		if len(data) < 16 {
+			return false
+		}
+		size = binary.BigEndian.Uint64(data[8:])
+		header = 16
+	}
+	if size != 0 && size < header {
+		return false
+	}
+	for _, c := range data[4:8] {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return segmentBoxes[string(data[4:8])] || size != 0 && size <= uint64(len(data))
+}
+
+// SequenceIV returns the IV to use when EXT-X-KEY has no IV attribute: the
+// media sequence number of the segment as a 128-bit big-endian integer.
+func SequenceIV(seqNo uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], seqNo)
+	return iv
+}
+
+// cbcReader decrypts an AES-128 segment while it is read. The last block is
+// held back until the end of the stream to remove the padding.
+type cbcReader struct {
+	r       io.Reader
+	cbc     cipher.BlockMode
+	buf     []byte
+	in      []byte
+	out     []byte
+	checked bool
+	eof     bool
+	err     error
+}
+
+// NewReader returns a reader decrypting r like Decrypt does.
+func NewReader(r io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cbcReader{
+		r:   r,
+		cbc: cipher.NewCBCDecrypter(block, iv),
+		buf: make([]byte, 32*1024),
+	}, nil
+}
+
+func (c *cbcReader) Read(p []byte) (int, error) {
+	// the start of the data is checked before anything is returned
+	for c.err == nil && !c.eof && (len(c.out) == 0 || !c.checked && len(c.out) <= ts.PacketLength) {
+		c.fill()
+	}
+
+	if !c.checked && (len(c.out) > ts.PacketLength || c.eof) && c.err == nil {
+		c.checked = true
+		if !isMedia(c.out) {
+			c.err = ErrKeyMismatch
+		}
+	}
+
+	if len(c.out) > 0 && c.checked {
+		n := copy(p, c.out)
+		c.out = c.out[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return 0, io.EOF
+}
+
+func (c *cbcReader) fill() {
+	n, err := c.r.Read(c.buf)
+	c.in = append(c.in, c.buf[:n]...)
+
+	// keep the last complete block, it may be the last one
+	end := len(c.in)/aes.BlockSize*aes.BlockSize - aes.BlockSize
+	if end > 0 {
+		c.cbc.CryptBlocks(c.in[:end], c.in[:end])
+		c.out = append(c.out, c.in[:end]...)
+		c.in = append(c.in[:0], c.in[end:]...)
+	}
+
+	if err == io.EOF {
+		c.eof = true
+		if len(c.in) != aes.BlockSize {
+			c.err = ErrLength
+			return
+		}
+		c.cbc.CryptBlocks(c.in, c.in)
+		last, err := PKCS7UnPadding(c.in)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.out = append(c.out, last...)
+		c.in = nil
+	} else if err != nil {
+		c.err = err
+	}
 }
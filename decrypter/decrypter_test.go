@@ -0,0 +1,141 @@
+package decrypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+func TestSequenceIV(t *testing.T) {
+	tests := []struct {
+		seq  uint64
+		want string
+	}{
+		{0, "00000000000000000000000000000000"},
+		{255, "000000000000000000000000000000ff"},
+		{256, "00000000000000000000000000000100"},
+		{1 << 32, "00000000000000000000000100000000"},
+		{1 << 63, "00000000000000008000000000000000"},
+	}
+	for _, tt := range tests {
+		got := SequenceIV(tt.seq)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("SequenceIV(%d) = %x, want %s", tt.seq, got, tt.want)
+		}
+	}
+}
+
+func TestSequenceIVLength(t *testing.T) {
+	if n := len(SequenceIV(1 << 40)); n != 16 {
+		t.Fatalf("len = %d, want 16", n)
+	}
+	if !bytes.Equal(SequenceIV(1<<64 - 1)[:8], make([]byte, 8)) {
+		t.Fatal("the upper 64 bits of the iv are not zero")
+	}
+}
+
+// encrypt pads data with PKCS7 and encrypts it like an AES-128 segment.
+func encrypt(t *testing.T, data, key, iv []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	out := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+// tsPackets returns n packets with the sync byte and nothing else.
+func tsPackets(n int) []byte {
+	data := make([]byte, n*ts.PacketLength)
+	for i := 0; i < n; i++ {
+		data[i*ts.PacketLength] = 0x47
+	}
+	return data
+}
+
+func TestDecryptImageHeader(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	iv := SequenceIV(42)
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00IEND\xaeB`\x82")},
+		{"jpg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")},
+	}
+	for _, tt := range tests {
+		plain := append(append([]byte(nil), tt.header...), tsPackets(3)...)
+
+		got, err := Decrypt(encrypt(t, plain, key, iv), key, iv)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: Decrypt = %d bytes, %v", tt.name, len(got), err)
+		}
+
+		r, err := NewReader(bytes.NewReader(encrypt(t, plain, key, iv)), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: NewReader = %d bytes, %v", tt.name, len(got), err)
+		}
+	}
+}
+
+func TestDecryptKeyMismatch(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	iv := SequenceIV(42)
+	data := encrypt(t, tsPackets(3), key, iv)
+
+	// the data decrypted with a wrong key is random, its padding is made
+	// valid so that the start of the data is checked
+	wrong := bytes.Repeat([]byte{8}, 16)
+	block, _ := aes.NewCipher(wrong)
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	plain[len(plain)-1] = 1
+	data = make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, plain)
+
+	_, err := Decrypt(append([]byte(nil), data...), wrong, iv)
+	if err != ErrKeyMismatch {
+		t.Fatalf("Decrypt error = %v, want ErrKeyMismatch", err)
+	}
+	r, _ := NewReader(bytes.NewReader(data), wrong, iv)
+	_, err = io.ReadAll(r)
+	if err != ErrKeyMismatch {
+		t.Fatalf("NewReader error = %v, want ErrKeyMismatch", err)
+	}
+}
+
+func TestIsBoxHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"styp", append([]byte("\x00\x00\x00\x18styp"), make([]byte, 8)...), true},
+		{"moof larger than the data", append([]byte("\x00\x00\x10\x00moof"), make([]byte, 8)...), true},
+		{"moof to the end", append([]byte("\x00\x00\x00\x00moof"), make([]byte, 8)...), true},
+		{"mdat with a large size beyond the data", append([]byte("\x00\x00\x00\x01mdat\x00\x00\x00\x01\x00\x00\x00\x00"), make([]byte, 8)...), false},
+		{"other box within the data", append([]byte("\x00\x00\x00\x10abcd"), make([]byte, 8)...), true},
+		{"other box beyond the data", append([]byte("\x7a\x3b\x11\x05abcd"), make([]byte, 8)...), false},
+		{"other box to the end", append([]byte("\x00\x00\x00\x00abcd"), make([]byte, 8)...), false},
+		{"size too small", append([]byte("\x00\x00\x00\x04moof"), make([]byte, 8)...), false},
+		{"binary type", append([]byte("\x00\x00\x00\x10mo\x00f"), make([]byte, 8)...), false},
+		{"short", []byte("\x00\x00\x00\x08moo"), false},
+	}
+	for _, tt := range tests {
+		if got := isBoxHeader(tt.data); got != tt.want {
+			t.Errorf("%s: isBoxHeader = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package decrypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+// clearStreamTypes maps the stream types of SAMPLE-AES encrypted elementary
+// streams to the ones of their decrypted form.
+var clearStreamTypes = map[byte]byte{
+	ts.StreamTypeSampleAESH264: ts.StreamTypeH264,
+	ts.StreamTypeSampleAESAAC:  ts.StreamTypeAAC,
+	ts.StreamTypeSampleAESAC3:  ts.StreamTypeAC3,
+	ts.StreamTypeSampleAESEAC3: ts.StreamTypeEAC3,
+}
+
+// ac3FrameSizes is the AC-3 frame size in 16-bit words indexed by
+// frmsizecod/2 and fscod (48kHz, 44.1kHz, 32kHz).
+var ac3FrameSizes = [19][3]int{
+	{64, 69, 96}, {80, 87, 120}, {96, 104, 144}, {112, 121, 168},
+	{128, 139, 192}, {160, 174, 240}, {192, 208, 288}, {224, 243, 336},
+	{256, 278, 384}, {320, 348, 480}, {384, 417, 576}, {448, 487, 672},
+	{512, 557, 768}, {640, 696, 960}, {768, 835, 1152}, {896, 975, 1344},
+	{1024, 1114, 1536}, {1152, 1253, 1728}, {1280, 1393, 1920},
+}
+
+type pesUnit struct {
+	pid     int
+	packets []int
+}
+
+// DecryptSampleAES decrypts a MPEG-TS segment encrypted with METHOD=SAMPLE-AES
+// as described in "MPEG-2 Stream Encryption Format for HTTP Live Streaming".
+// Encrypted elementary streams are recognized by their stream type in the
+// PMT, which is changed to the clear one. The PES packets of H.264 streams
+// are repacketized because their size changes when the emulation prevention
+// bytes are recomputed.
+func DecryptSampleAES(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data)%ts.PacketLength != 0 {
+		return nil, fmt.Errorf("segment size %d is not a multiple of the ts packet size", len(data))
+	}
+
+	var packets []ts.Packet
+	for i := 0; i < len(data); i += ts.PacketLength {
+		pkt := ts.Packet(data[i : i+ts.PacketLength])
+		if pkt[0] != 0x47 {
+			return nil, fmt.Errorf("invalid sync byte in packet %d", len(packets))
+		}
+		packets = append(packets, pkt)
+	}
+
+	pmtPIDs := map[int]bool{}
+	streamTypes := map[int]byte{}
+	current := map[int]*pesUnit{}
+	var units []*pesUnit
+
+	for i, pkt := range packets {
+		pid := pkt.PID()
+		switch {
+		case ts.IsPAT(pid) && pkt.PayloadUnitStart():
+			pids, err := ts.ParsePAT(pkt.Payload())
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range pids {
+				pmtPIDs[p] = true
+			}
+		case pmtPIDs[pid] && pkt.PayloadUnitStart():
+			streams, err := ts.ParsePMT(pkt.Payload())
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range streams {
+				if _, ok := clearStreamTypes[s.Type]; ok {
+					streamTypes[s.PID] = s.Type
+				}
+			}
+			err = ts.RemapStreamTypes(pkt.Payload(), clearStreamTypes)
+			if err != nil {
+				return nil, err
+			}
+		case streamTypes[pid] != 0 && pkt.HasPayload():
+			if pkt.PayloadUnitStart() {
+				if u := current[pid]; u != nil {
+					units = append(units, u)
+				}
+				current[pid] = &pesUnit{pid: pid, packets: []int{i}}
+			} else if u := current[pid]; u != nil {
+				u.packets = append(u.packets, i)
+			}
+		}
+	}
+
+	pids := make([]int, 0, len(current))
+	for pid := range current {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		units = append(units, current[pid])
+	}
+
+	if len(units) == 0 {
+		return data, nil
+	}
+
+	replaced := map[int][]ts.Packet{}
+	for _, u := range units {
+		var pes []byte
+		for _, idx := range u.packets {
+			pes = append(pes, packets[idx].Payload()...)
+		}
+
+		pes = decryptPES(pes, streamTypes[u.pid], block, iv)
+
+		for k, idx := range u.packets {
+			orig := packets[idx]
+			replaced[idx] = []ts.Packet{}
+			for len(pes) > 0 {
+				pkt, n := orig.NewPacket(orig.AdaptationField(), pes)
+				replaced[idx] = append(replaced[idx], pkt)
+				pes = pes[n:]
+				if k < len(u.packets)-1 {
+					break
+				}
+				// continuation packets carry no adaptation field and no
+				// payload unit start indicator
+				orig = ts.Packet(append([]byte{orig[0], orig[1] &^ 0x40, orig[2], orig[3]&0xcf | 0x10}, make([]byte, ts.PacketLength-4)...))
+			}
+		}
+	}
+
+	out := make([]byte, 0, len(data)+ts.PacketLength*4)
+	counters := map[int]byte{}
+	for i, pkt := range packets {
+		list, ok := replaced[i]
+		if !ok {
+			list = []ts.Packet{pkt}
+		}
+		for _, p := range list {
+			pid := p.PID()
+			if streamTypes[pid] != 0 {
+				cc, seen := counters[pid]
+				switch {
+				case !seen:
+					cc = p.ContinuityCounter()
+				case p.HasPayload():
+					cc = (cc + 1) & 0x0f
+				}
+				counters[pid] = cc
+				p.SetContinuityCounter(cc)
+			}
+			out = append(out, p...)
+		}
+	}
+
+	return out, nil
+}
+
+func decryptPES(pes []byte, streamType byte, block cipher.Block, iv []byte) []byte {
+	if len(pes) < 9 || !bytes.HasPrefix(pes, []byte{0, 0, 1}) {
+		return pes
+	}
+
+	headerLength := 9 + int(pes[8])
+	if headerLength > len(pes) {
+		return pes
+	}
+	es := pes[headerLength:]
+
+	switch streamType {
+	case ts.StreamTypeSampleAESH264:
+		es = decryptH264(es, block, iv)
+	case ts.StreamTypeSampleAESAAC:
+		decryptADTS(es, block, iv)
+	case ts.StreamTypeSampleAESAC3, ts.StreamTypeSampleAESEAC3:
+		decryptAC3(es, block, iv)
+	}
+
+	out := append(pes[:headerLength:headerLength], es...)
+	if binary.BigEndian.Uint16(out[4:6]) != 0 {
+		length := len(out) - 6
+		if length > 0xffff {
+			// allowed for video streams only, which is the only case
+			// where the size may grow
+			length = 0
+		}
+		binary.BigEndian.PutUint16(out[4:6], uint16(length))
+	}
+	return out
+}
+
+// decryptH264 decrypts the slice NAL units of an Annex B byte stream. In a
+// protected NAL unit the first 32 bytes are clear, followed by repetitions of
+// one encrypted block and up to 144 clear bytes, with the emulation
+// prevention bytes inserted after encryption.
+func decryptH264(es []byte, block cipher.Block, iv []byte) []byte {
+	var starts []int
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			starts = append(starts, i+3)
+			i += 2
+		}
+	}
+	if len(starts) == 0 {
+		return es
+	}
+
+	out := make([]byte, 0, len(es)+len(es)/64)
+	out = append(out, es[:starts[0]]...)
+	for i, start := range starts {
+		end := len(es)
+		if i+1 < len(starts) {
+			end = starts[i+1] - 3
+		}
+		nal := es[start:end]
+
+		// zero bytes before the next start code are not part of the NAL unit
+		n := len(nal)
+		for n > 0 && nal[n-1] == 0 {
+			n--
+		}
+		body, tail := nal[:n], nal[n:]
+
+		if len(body) > 0 {
+			nalType := body[0] & 0x1f
+			if nalType == 1 || nalType == 5 {
+				raw := unescapeNAL(body)
+				if len(raw) > 48 {
+					decryptNAL(raw, block, iv)
+					body = escapeNAL(raw)
+				}
+			}
+		}
+
+		out = append(out, body...)
+		out = append(out, tail...)
+		if i+1 < len(starts) {
+			out = append(out, 0, 0, 1)
+		}
+	}
+	return out
+}
+
+func decryptNAL(nal []byte, block cipher.Block, iv []byte) {
+	cbc := cipher.NewCBCDecrypter(block, iv)
+	data := nal[32:]
+	for len(data) > 0 {
+		if len(data) > aes.BlockSize {
+			cbc.CryptBlocks(data[:aes.BlockSize], data[:aes.BlockSize])
+			data = data[aes.BlockSize:]
+		}
+		data = data[min(144, len(data)):]
+	}
+}
+
+func unescapeNAL(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+func escapeNAL(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+	for _, b := range raw {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if zeros > 0 {
+		out = append(out, 3)
+	}
+	return out
+}
+
+// decryptADTS decrypts the AAC frames of an ADTS stream. After the header,
+// 16 bytes of every frame are clear, followed by as many encrypted blocks as
+// fit, and a clear remainder.
+func decryptADTS(es []byte, block cipher.Block, iv []byte) {
+	for i := 0; i+7 <= len(es); {
+		if es[i] != 0xff || es[i+1]&0xf0 != 0xf0 {
+			i++
+			continue
+		}
+
+		headerLength := 7
+		if es[i+1]&0x01 == 0 {
+			// crc present
+			headerLength = 9
+		}
+		frameLength := int(es[i+3]&0x03)<<11 | int(es[i+4])<<3 | int(es[i+5])>>5
+		if frameLength < headerLength || i+frameLength > len(es) {
+			return
+		}
+
+		decryptFrame(es[i+headerLength:i+frameLength], block, iv)
+		i += frameLength
+	}
+}
+
+// decryptAC3 decrypts AC-3 and E-AC-3 sync frames, of which the first 16
+// bytes are clear.
+func decryptAC3(es []byte, block cipher.Block, iv []byte) {
+	for i := 0; i+6 <= len(es); {
+		if es[i] != 0x0b || es[i+1] != 0x77 {
+			i++
+			continue
+		}
+
+		var frameLength int
+		bsid := es[i+5] >> 3
+		if bsid <= 10 {
+			fscod := int(es[i+4] >> 6)
+			frmsizecod := int(es[i+4] & 0x3f)
+			if fscod > 2 || frmsizecod/2 >= len(ac3FrameSizes) {
+				return
+			}
+			frameLength = ac3FrameSizes[frmsizecod/2][fscod] * 2
+			if fscod == 1 && frmsizecod%2 == 1 {
+				// 44.1kHz frames alternate between two sizes
+				frameLength += 2
+			}
+		} else {
+			frameLength = (int(es[i+2]&0x07)<<8 | int(es[i+3]) + 1) * 2
+		}
+		if i+frameLength > len(es) {
+			return
+		}
+
+		decryptFrame(es[i:i+frameLength], block, iv)
+		i += frameLength
+	}
+}
+
+func decryptFrame(frame []byte, block cipher.Block, iv []byte) {
+	if len(frame) <= 16 {
+		return
+	}
+	data := frame[16:]
+	data = data[:len(data)/aes.BlockSize*aes.BlockSize]
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+}
@@ -0,0 +1,189 @@
+package decrypter
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+// tsMuxer writes the packets of a segment, counting the continuity counters
+// of each PID.
+type tsMuxer struct {
+	bytes.Buffer
+	cc map[int]byte
+}
+
+// payload splits a payload in packets, the last one stuffed with the
+// adaptation field.
+func (m *tsMuxer) payload(pid int, p []byte) {
+	for start := true; start || len(p) > 0; start = false {
+		n := min(len(p), 184)
+		pkt := []byte{0x47, byte(pid >> 8), byte(pid), 0x10 | m.cc[pid]}
+		if start {
+			pkt[1] |= 0x40
+		}
+		m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+		if n < 184 {
+			af := []byte{byte(183 - n)}
+			if n < 183 {
+				af = append(af, 0)
+				af = append(af, bytes.Repeat([]byte{0xff}, 182-n)...)
+			}
+			pkt[3] |= 0x20
+			pkt = append(pkt, af...)
+		}
+		m.Write(append(pkt, p[:n]...))
+		p = p[n:]
+	}
+}
+
+func (m *tsMuxer) section(pid int, s []byte) {
+	binary.BigEndian.PutUint16(s[1:], 0xb000|uint16(len(s)+4-3))
+	s = binary.BigEndian.AppendUint32(s, ts.CRC32(s))
+	p := append([]byte{0}, s...)
+	m.payload(pid, append(p, bytes.Repeat([]byte{0xff}, 184-len(p))...))
+}
+
+// program writes the PAT and a PMT at PID 0x1000 listing the streams, pairs
+// of PID and stream type.
+func (m *tsMuxer) program(streams ...int) {
+	m.section(0, []byte{0, 0, 0, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	pmt := []byte{2, 0, 0, 0, 1, 0xc1, 0, 0, 0xe0 | byte(streams[0]>>8), byte(streams[0]), 0xf0, 0}
+	for i := 0; i < len(streams); i += 2 {
+		pmt = append(pmt, byte(streams[i+1]), 0xe0|byte(streams[i]>>8), byte(streams[i]), 0xf0, 0)
+	}
+	m.section(0x1000, pmt)
+}
+
+// pes writes a PES packet with a PTS, of unbounded length for video.
+func (m *tsMuxer) pes(pid int, streamID byte, pts int64, es []byte) {
+	length := 0
+	if streamID&0xf0 != 0xe0 {
+		length = 8 + len(es)
+	}
+	header := []byte{0, 0, 1, streamID, byte(length >> 8), byte(length), 0x80, 0x80, 5,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 1, byte(pts >> 7), byte(pts<<1) | 1}
+	m.payload(pid, append(header, es...))
+}
+
+// encryptNAL encrypts a NAL unit without its emulation prevention bytes:
+// 32 clear bytes, then one encrypted block and up to 144 clear bytes,
+// repeatedly, the last block staying clear.
+func encryptNAL(raw []byte, block cipher.Block, iv []byte) []byte {
+	out := append([]byte(nil), raw...)
+	cbc := cipher.NewCBCEncrypter(block, iv)
+	for data := out[32:]; len(data) > 0; {
+		if len(data) > aes.BlockSize {
+			cbc.CryptBlocks(data[:aes.BlockSize], data[:aes.BlockSize])
+			data = data[aes.BlockSize:]
+		}
+		data = data[min(144, len(data)):]
+	}
+	return out
+}
+
+// encryptADTS encrypts the frame after its header and 16 clear bytes, as
+// many whole blocks as fit.
+func encryptADTS(frame []byte, block cipher.Block, iv []byte) []byte {
+	out := append([]byte(nil), frame...)
+	if len(out) <= 7+16 {
+		return out
+	}
+	data := out[7+16:]
+	data = data[:len(data)/aes.BlockSize*aes.BlockSize]
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return out
+}
+
+// counting returns n bytes from start, none of them zero.
+func counting(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((start+i)%255 + 1)
+	}
+	return b
+}
+
+func adtsFrame(payload []byte) []byte {
+	length := 7 + len(payload)
+	return append([]byte{0xff, 0xf1, 0x50, 0x80 | byte(length>>11)&3, byte(length >> 3), byte(length&7)<<5 | 0x1f, 0xfc}, payload...)
+}
+
+func TestDecryptSampleAES(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 16)
+	iv := SequenceIV(7)
+	block, _ := aes.NewCipher(key)
+
+	sps := append([]byte{0x67, 0x64, 0, 0x1f}, counting(0, 60)...)
+	// 32 clear bytes, two patterns of 1:9 blocks and 10 clear bytes. The
+	// clear part holds a start code emulation, escaped in the stream.
+	idr := append([]byte{0x65}, counting(10, 32+160+160+10-1)...)
+	copy(idr[10:], []byte{0, 0, 1})
+	escaped := append(append(append([]byte(nil), idr[:12]...), 3), idr[12:]...)
+	// too short to be encrypted
+	short := append([]byte{0x41}, counting(20, 47)...)
+	slice := append([]byte{0x41}, counting(30, 32+16+5)...)
+
+	annexB := func(nals ...[]byte) []byte {
+		es := []byte{0, 0, 0, 1, 0x09, 0xf0}
+		for _, nal := range nals {
+			es = append(append(es, 0, 0, 0, 1), nal...)
+		}
+		return es
+	}
+	clearVideo := annexB(sps, escaped, short, slice)
+	encryptedVideo := annexB(sps, escapeNAL(encryptNAL(idr, block, iv)), short, escapeNAL(encryptNAL(slice, block, iv)))
+
+	// a frame with 4 clear bytes after the encrypted blocks, and one shorter
+	// than the clear bytes
+	frames := [][]byte{adtsFrame(counting(40, 100)), adtsFrame(counting(50, 12))}
+	var clearAudio, encryptedAudio []byte
+	for _, f := range frames {
+		clearAudio = append(clearAudio, f...)
+		encryptedAudio = append(encryptedAudio, encryptADTS(f, block, iv)...)
+	}
+	if bytes.Equal(clearVideo, encryptedVideo) || bytes.Equal(clearAudio, encryptedAudio) {
+		t.Fatal("nothing encrypted")
+	}
+
+	m := &tsMuxer{cc: map[int]byte{}}
+	m.program(0x100, int(ts.StreamTypeSampleAESH264), 0x101, int(ts.StreamTypeSampleAESAAC))
+	m.pes(0x100, 0xe0, 90000, encryptedVideo)
+	m.pes(0x101, 0xc0, 90000, encryptedAudio)
+
+	data, err := DecryptSampleAES(m.Bytes(), key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data)%ts.PacketLength != 0 {
+		t.Fatalf("%d bytes, not whole packets", len(data))
+	}
+
+	es := map[int][]byte{}
+	d := ts.NewDemuxer(func(pes *ts.PES) error {
+		es[pes.PID] = append(es[pes.PID], pes.Data...)
+		return nil
+	})
+	d.Write(data)
+	d.Flush()
+
+	want := map[int]byte{0x100: ts.StreamTypeH264, 0x101: ts.StreamTypeAAC}
+	for _, s := range d.Streams() {
+		if s.Type != want[s.PID] {
+			t.Errorf("stream %#x has type %#x, want %#x", s.PID, s.Type, want[s.PID])
+		}
+	}
+	if errs := d.Stats().ContinuityErrors; len(errs) > 0 {
+		t.Errorf("continuity errors %v", errs)
+	}
+	if !bytes.Equal(es[0x100], clearVideo) {
+		t.Errorf("video decrypted to\n%x\nwant\n%x", es[0x100], clearVideo)
+	}
+	if !bytes.Equal(es[0x101], clearAudio) {
+		t.Errorf("audio decrypted to\n%x\nwant\n%x", es[0x101], clearAudio)
+	}
+}
@@ -0,0 +1,264 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// AdBreak is a range of ad segments left out of the download.
+type AdBreak struct {
+	// Start is the offset of the break in the playlist.
+	Start    time.Duration
+	Duration time.Duration
+	Segments int
+	// Source is what the break was detected with: CUE-OUT, DATERANGE or
+	// HOST.
+	Source string
+}
+
+// adMark marks an ad segment.
+type adMark struct {
+	source string
+	offset time.Duration
+}
+
+// dateRange is the interval of an EXT-X-DATERANGE with SCTE35-OUT, end
+// being zero until the break is known to end.
+type dateRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// detectAds marks the ad segments of the playlist, from the EXT-X-CUE-OUT,
+// EXT-X-CUE-IN, EXT-X-SCTE35 and EXT-X-DATERANGE tags of its data, which the
+// parser does not keep, and with AdHosts from the discontinuity periods
+// served from another host than the rest.
+func (j *job) detectAds(data []byte, mpl *m3u8.MediaPlaylist) {
+	segments := mpl.GetAllSegments()
+	marks := make([]string, len(segments))
+
+	text := string(data)
+	// the duration of a break only ends it when the playlist has no
+	// EXT-X-CUE-IN
+	hasCueIn := strings.Contains(text, "#EXT-X-CUE-IN") || strings.Contains(text, "CUE-IN=YES")
+
+	var (
+		index     int
+		inBreak   bool
+		remaining float64
+		ranges    []*dateRange
+		open      = map[string]*dateRange{}
+		last      string
+	)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-CUE-OUT-CONT"):
+			inBreak = true
+		case strings.HasPrefix(line, "#EXT-X-CUE-OUT"):
+			inBreak, remaining = true, cueDuration(line)
+		case strings.HasPrefix(line, "#EXT-X-CUE-IN"):
+			inBreak = false
+		case strings.HasPrefix(line, "#EXT-X-SCTE35:"):
+			attrs := parseAttributes(line[len("#EXT-X-SCTE35:"):])
+			switch {
+			case attrs["CUE-OUT"] == "YES":
+				remaining, _ = strconv.ParseFloat(attrs["DURATION"], 64)
+				inBreak = true
+			case attrs["CUE-OUT"] == "CONT":
+				inBreak = true
+			case attrs["CUE-IN"] == "YES":
+				inBreak = false
+			}
+		case strings.HasPrefix(line, "#EXT-X-DATERANGE:"):
+			attrs := parseAttributes(line[len("#EXT-X-DATERANGE:"):])
+			start, err := time.Parse(time.RFC3339Nano, attrs["START-DATE"])
+			if err != nil {
+				continue
+			}
+			end := dateRangeEnd(attrs, start)
+			_, out := attrs["SCTE35-OUT"]
+			_, in := attrs["SCTE35-IN"]
+			r := open[attrs["ID"]]
+
+			switch {
+			case out && r == nil:
+				r = &dateRange{start: start, end: end}
+				ranges = append(ranges, r)
+				if end.IsZero() {
+					open[attrs["ID"]], last = r, attrs["ID"]
+				}
+			case r != nil && !end.IsZero():
+				// the same break, with its end
+				r.end = end
+				delete(open, attrs["ID"])
+			case in && open[last] != nil:
+				// the end of the last break, with another id
+				open[last].end = start
+				delete(open, last)
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			if index >= len(segments) {
+				continue
+			}
+			if inBreak {
+				marks[index] = "CUE-OUT"
+				if !hasCueIn && remaining > 0 {
+					remaining -= segments[index].Duration
+					if remaining < 0.001 {
+						inBreak = false
+					}
+				}
+			}
+			index++
+		}
+	}
+
+	if len(ranges) > 0 {
+		dates, err := programDateTimes(segments)
+		if err != nil {
+			j.logger.Println("[!] EXT-X-DATERANGE ad breaks ignored:", err)
+		}
+		for i := range dates {
+			mid := dates[i].Add(seconds(segments[i].Duration / 2))
+			for _, r := range ranges {
+				if marks[i] == "" && !mid.Before(r.start) && (r.end.IsZero() || mid.Before(r.end)) {
+					marks[i] = "DATERANGE"
+				}
+			}
+		}
+	}
+
+	if j.opts.AdHosts {
+		markHostChanges(segments, marks)
+	}
+
+	j.l.Lock()
+	defer j.l.Unlock()
+	if j.adMarks == nil {
+		j.adMarks = map[*m3u8.MediaSegment]adMark{}
+	}
+	var offset time.Duration
+	for i, segment := range segments {
+		if marks[i] != "" {
+			j.adMarks[segment] = adMark{source: marks[i], offset: offset}
+		}
+		offset += seconds(segment.Duration)
+	}
+}
+
+// cueDuration returns the duration of an EXT-X-CUE-OUT tag, written as
+// EXT-X-CUE-OUT:30 or EXT-X-CUE-OUT:DURATION=30, or 0 if it has none.
+func cueDuration(line string) float64 {
+	_, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return 0
+	}
+	if d, ok := parseAttributes(value)["DURATION"]; ok {
+		value = d
+	}
+	f, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return f
+}
+
+func dateRangeEnd(attrs map[string]string, start time.Time) time.Time {
+	if end, err := time.Parse(time.RFC3339Nano, attrs["END-DATE"]); err == nil {
+		return end
+	}
+	for _, name := range []string{"DURATION", "PLANNED-DURATION"} {
+		if f, err := strconv.ParseFloat(attrs[name], 64); err == nil {
+			return start.Add(seconds(f))
+		}
+	}
+	return time.Time{}
+}
+
+// markHostChanges marks the discontinuity periods whose segments are all
+// served from another host than the one serving most of the media.
+func markHostChanges(segments []*m3u8.MediaSegment, marks []string) {
+	hosts := make([]string, len(segments))
+	durations := map[string]float64{}
+	for i, segment := range segments {
+		if u, err := url.Parse(segment.URI); err == nil {
+			hosts[i] = u.Host
+		}
+		durations[hosts[i]] += segment.Duration
+	}
+
+	var main string
+	for host, d := range durations {
+		if d > durations[main] || d == durations[main] && host < main {
+			main = host
+		}
+	}
+
+	for start := 0; start < len(segments); {
+		end := start + 1
+		for end < len(segments) && !segments[end].Discontinuity {
+			end++
+		}
+
+		other := true
+		for i := start; i < end; i++ {
+			if hosts[i] == main {
+				other = false
+			}
+		}
+		if other && (start > 0 || end < len(segments)) {
+			for i := start; i < end; i++ {
+				if marks[i] == "" {
+					marks[i] = "HOST"
+				}
+			}
+		}
+		start = end
+	}
+}
+
+// skipAds returns the playlist without the ad segments, and records the ad
+// breaks. The segment following a break starts a new discontinuity period.
+func (j *job) skipAds(mpl *m3u8.MediaPlaylist) (*m3u8.MediaPlaylist, error) {
+	j.l.Lock()
+	marks := j.adMarks
+	j.l.Unlock()
+
+	segments := mpl.GetAllSegments()
+	var kept int
+	var current *AdBreak
+	for _, segment := range segments {
+		mark, ok := marks[segment]
+		if !ok {
+			if current != nil {
+				segment.Discontinuity = true
+				current = nil
+			}
+			kept++
+			continue
+		}
+		if current == nil {
+			j.ads = append(j.ads, AdBreak{Start: mark.offset, Source: mark.source})
+			current = &j.ads[len(j.ads)-1]
+		}
+		current.Duration += seconds(segment.Duration)
+		current.Segments++
+	}
+
+	if len(j.ads) == 0 {
+		return mpl, nil
+	}
+	if kept == 0 {
+		return nil, fmt.Errorf("all the segments are ads")
+	}
+
+	return subPlaylist(mpl, func(i int) bool {
+		_, ok := marks[segments[i]]
+		return !ok
+	})
+}
@@ -0,0 +1,87 @@
+package downloader
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectAds(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []AdBreak
+	}{
+		{"cue-out and cue-in", []string{
+			"#EXTINF:4,", "s0.ts",
+			"#EXT-X-CUE-OUT:8", "#EXTINF:4,", "a0.ts",
+			"#EXT-X-CUE-OUT-CONT:ElapsedTime=4,Duration=8", "#EXTINF:4,", "a1.ts",
+			"#EXT-X-CUE-IN", "#EXTINF:4,", "s1.ts",
+		}, []AdBreak{{Start: 4 * time.Second, Duration: 8 * time.Second, Segments: 2, Source: "CUE-OUT"}}},
+		{"cue-out duration", []string{
+			"#EXTINF:4,", "s0.ts",
+			"#EXT-X-CUE-OUT:DURATION=8", "#EXTINF:4,", "a0.ts",
+			"#EXTINF:4,", "a1.ts",
+			"#EXTINF:4,", "s1.ts",
+		}, []AdBreak{{Start: 4 * time.Second, Duration: 8 * time.Second, Segments: 2, Source: "CUE-OUT"}}},
+		// the duration only ends the break without EXT-X-CUE-IN
+		{"cue-in after the duration", []string{
+			"#EXT-X-CUE-OUT:4", "#EXTINF:4,", "a0.ts",
+			"#EXTINF:4,", "a1.ts",
+			"#EXT-X-CUE-IN", "#EXTINF:4,", "s0.ts",
+		}, []AdBreak{{Start: 0, Duration: 8 * time.Second, Segments: 2, Source: "CUE-OUT"}}},
+		{"scte35", []string{
+			"#EXTINF:4,", "s0.ts",
+			"#EXT-X-SCTE35:CUE=\"/DAlAAAAAAAAAP/wFAUAAAABf+/+AAAAAH4AKTLgAAEAAAAAAAA=\",CUE-OUT=YES,DURATION=4", "#EXTINF:4,", "a0.ts",
+			"#EXT-X-SCTE35:CUE-IN=YES", "#EXTINF:4,", "s1.ts",
+		}, []AdBreak{{Start: 4 * time.Second, Duration: 4 * time.Second, Segments: 1, Source: "CUE-OUT"}}},
+		{"daterange with duration", []string{
+			"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z",
+			"#EXTINF:4,", "s0.ts",
+			`#EXT-X-DATERANGE:ID="ad1",START-DATE="2024-01-01T00:00:04Z",DURATION=8,SCTE35-OUT=0xFC30`,
+			"#EXTINF:4,", "a0.ts", "#EXTINF:4,", "a1.ts", "#EXTINF:4,", "s1.ts",
+		}, []AdBreak{{Start: 4 * time.Second, Duration: 8 * time.Second, Segments: 2, Source: "DATERANGE"}}},
+		// the break ends with the SCTE35-IN of another id
+		{"daterange in", []string{
+			"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z",
+			"#EXTINF:4,", "s0.ts",
+			`#EXT-X-DATERANGE:ID="out",START-DATE="2024-01-01T00:00:04Z",SCTE35-OUT=0xFC30`,
+			"#EXTINF:4,", "a0.ts",
+			`#EXT-X-DATERANGE:ID="in",START-DATE="2024-01-01T00:00:08Z",SCTE35-IN=0xFC30`,
+			"#EXTINF:4,", "s1.ts", "#EXTINF:4,", "s2.ts",
+		}, []AdBreak{{Start: 4 * time.Second, Duration: 4 * time.Second, Segments: 1, Source: "DATERANGE"}}},
+		{"daterange without scte35", []string{
+			"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z",
+			"#EXTINF:4,", "s0.ts",
+			`#EXT-X-DATERANGE:ID="chapter",START-DATE="2024-01-01T00:00:04Z",DURATION=4`,
+			"#EXTINF:4,", "s1.ts",
+		}, nil},
+	}
+	for _, tt := range tests {
+		data := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n" + strings.Join(tt.lines, "\n") + "\n#EXT-X-ENDLIST\n"
+		d, err := New(Options{SkipAds: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := d.newJob(context.Background(), &counter{})
+		mpl, _, err := j.parseM3u8("http://example.com/index.m3u8", []byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		mpl, err = j.skipAds(mpl)
+		j.stopRequests()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(j.ads, tt.want) {
+			t.Errorf("%s: ads %+v, want %+v", tt.name, j.ads, tt.want)
+		}
+		for _, segment := range mpl.GetAllSegments() {
+			if strings.Contains(segment.URI, "/a") {
+				t.Errorf("%s: ad segment %s kept", tt.name, segment.URI)
+			}
+		}
+	}
+}
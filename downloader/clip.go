@@ -0,0 +1,272 @@
+package downloader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+)
+
+// Clip selects a part of the media. Only the segments covering it are
+// downloaded, so the out file starts and ends at segment boundaries, unless
+// Precise is set.
+type Clip struct {
+	// Start and End are offsets from the beginning of the playlist, End 0
+	// being the end of the playlist.
+	Start time.Duration
+	End   time.Duration
+	// StartTime and EndTime are wall clock times, located with the
+	// EXT-X-PROGRAM-DATE-TIME tags. They are used instead of Start and End
+	// when set.
+	StartTime time.Time
+	EndTime   time.Time
+	// FirstSegment and LastSegment are the numbers of the segments in the
+	// playlist, counting from 1, 0 meaning the first and last ones.
+	FirstSegment int
+	LastSegment  int
+	// Precise trims the out file at Start and End with ffmpeg, re-encoding
+	// the video. It requires MergeWithFFmpeg.
+	Precise bool
+}
+
+func (c *Clip) isSet() bool {
+	return c.Start > 0 || c.End > 0 || !c.StartTime.IsZero() || !c.EndTime.IsZero() ||
+		c.FirstSegment > 0 || c.LastSegment > 0
+}
+
+// ParseClipTime parses the start or the end of a clip, either an offset such
+// as 90, 1:30, 00:01:30.5 or 1m30s, or a wall clock time in the RFC 3339
+// format.
+func ParseClipTime(s string) (time.Duration, time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return 0, t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d, time.Time{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, time.Time{}, fmt.Errorf("invalid time %s", s)
+	}
+	var d time.Duration
+	for i, part := range parts {
+		var f float64
+		var err error
+		if i == len(parts)-1 {
+			f, err = strconv.ParseFloat(part, 64)
+		} else {
+			var n uint64
+			n, err = strconv.ParseUint(part, 10, 64)
+			f = float64(n)
+		}
+		if err != nil || f < 0 {
+			return 0, time.Time{}, fmt.Errorf("invalid time %s", s)
+		}
+		d = d*60 + seconds(f)
+	}
+	return d, time.Time{}, nil
+}
+
+// ParseSegmentRange parses a range of segment numbers such as 100-250, 100-
+// or -250.
+func ParseSegmentRange(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		to = from
+	}
+
+	var first, last int
+	var err error
+	if from != "" {
+		first, err = strconv.Atoi(from)
+		if err != nil || first < 1 {
+			return 0, 0, fmt.Errorf("invalid segment range %s", s)
+		}
+	}
+	if to != "" {
+		last, err = strconv.Atoi(to)
+		if err != nil || last < 1 || last < first {
+			return 0, 0, fmt.Errorf("invalid segment range %s", s)
+		}
+	}
+	return first, last, nil
+}
+
+// clipRange is the part of a playlist selected by a clip.
+type clipRange struct {
+	first, last int
+	// from and to are the offsets of the clip in the playlist
+	from, to time.Duration
+	// offset and end are the offsets of the first segment and of the end of
+	// the last one in the playlist
+	offset time.Duration
+	end    time.Duration
+}
+
+// locate returns the segments covering the clip.
+func (c *Clip) locate(segments []*m3u8.MediaSegment) (*clipRange, error) {
+	starts := make([]time.Duration, len(segments)+1)
+	for i, segment := range segments {
+		starts[i+1] = starts[i] + seconds(segment.Duration)
+	}
+	total := starts[len(segments)]
+
+	r := &clipRange{first: 0, last: len(segments) - 1, from: c.Start, to: c.End}
+
+	if !c.StartTime.IsZero() || !c.EndTime.IsZero() {
+		dates, err := programDateTimes(segments)
+		if err != nil {
+			return nil, err
+		}
+		if !c.StartTime.IsZero() {
+			r.from = dateOffset(dates, starts, c.StartTime)
+		}
+		if !c.EndTime.IsZero() {
+			r.to = dateOffset(dates, starts, c.EndTime)
+			if r.to == 0 {
+				return nil, fmt.Errorf("end time %s is before the playlist", c.EndTime.Format(time.RFC3339))
+			}
+		}
+	}
+
+	if c.FirstSegment > 0 {
+		if c.FirstSegment > len(segments) {
+			return nil, fmt.Errorf("segment %d not found, the playlist has %d segments", c.FirstSegment, len(segments))
+		}
+		r.first = c.FirstSegment - 1
+	}
+	if c.LastSegment > 0 && c.LastSegment < len(segments) {
+		r.last = c.LastSegment - 1
+	}
+
+	if r.from >= total {
+		return nil, fmt.Errorf("start %s is after the end of the playlist, %s", r.from, total)
+	}
+	if r.to > 0 && r.to <= r.from {
+		return nil, fmt.Errorf("end %s is not after start %s", r.to, r.from)
+	}
+
+	for r.first < r.last && starts[r.first+1] <= r.from {
+		r.first++
+	}
+	for r.to > 0 && r.last > r.first && starts[r.last] >= r.to {
+		r.last--
+	}
+	if starts[r.first+1] <= r.from || r.to > 0 && starts[r.first] >= r.to {
+		return nil, fmt.Errorf("no segment in the clip")
+	}
+
+	r.offset, r.end = starts[r.first], starts[r.last+1]
+	if r.from < r.offset {
+		r.from = r.offset
+	}
+	if r.to == 0 || r.to > r.end {
+		r.to = r.end
+	}
+	return r, nil
+}
+
+// programDateTimes returns the date and time of every segment, following
+// the last EXT-X-PROGRAM-DATE-TIME before it, or the first one for the
+// segments before it.
+func programDateTimes(segments []*m3u8.MediaSegment) ([]time.Time, error) {
+	dates := make([]time.Time, len(segments))
+	first := -1
+	for i, segment := range segments {
+		switch {
+		case !segment.ProgramDateTime.IsZero():
+			dates[i] = segment.ProgramDateTime
+			if first < 0 {
+				first = i
+			}
+		case i > 0 && !dates[i-1].IsZero():
+			dates[i] = dates[i-1].Add(seconds(segments[i-1].Duration))
+		}
+	}
+	if first < 0 {
+		return nil, fmt.Errorf("playlist has no EXT-X-PROGRAM-DATE-TIME")
+	}
+	for i := first - 1; i >= 0; i-- {
+		dates[i] = dates[i+1].Add(-seconds(segments[i].Duration))
+	}
+	return dates, nil
+}
+
+// dateOffset returns the offset in the playlist of the date and time t, in
+// the last segment starting before it.
+func dateOffset(dates []time.Time, starts []time.Duration, t time.Time) time.Duration {
+	for i := len(dates) - 1; i >= 0; i-- {
+		if !dates[i].After(t) {
+			return starts[i] + t.Sub(dates[i])
+		}
+	}
+	return 0
+}
+
+// clip returns a playlist of the segments covering the clip.
+func (j *job) clip(mpl *m3u8.MediaPlaylist) (*m3u8.MediaPlaylist, error) {
+	segments := mpl.GetAllSegments()
+	r, err := j.opts.Clip.locate(segments)
+	if err != nil {
+		return nil, err
+	}
+	j.clipped = r
+
+	return subPlaylist(mpl, func(i int) bool {
+		return i >= r.first && i <= r.last
+	})
+}
+
+// subPlaylist returns a playlist of the segments kept, with their sequence
+// numbers, and the init segment in effect at the first of them.
+func subPlaylist(mpl *m3u8.MediaPlaylist, keep func(i int) bool) (*m3u8.MediaPlaylist, error) {
+	segments := mpl.GetAllSegments()
+	var kept []*m3u8.MediaSegment
+	m := mpl.Map
+	for i, segment := range segments {
+		if len(kept) == 0 && segment.Map != nil {
+			m = segment.Map
+		}
+		if keep(i) {
+			kept = append(kept, segment)
+		}
+	}
+
+	sub, err := m3u8.NewMediaPlaylist(0, uint(len(kept)))
+	if err != nil {
+		return nil, err
+	}
+	sub.TargetDuration = mpl.TargetDuration
+	sub.Closed = mpl.Closed
+	sub.MediaType = mpl.MediaType
+	sub.Key = mpl.Key
+	sub.Map = m
+	if len(kept) > 0 {
+		sub.SeqNo = kept[0].SeqId
+	}
+
+	for _, segment := range kept {
+		// the sequence numbers are used as iv and to find the segment in the
+		// backup playlists, AppendSegment renumbers them
+		seq := segment.SeqId
+		err = sub.AppendSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		segment.SeqId = seq
+	}
+	return sub, nil
+}
+
+// trim cuts the out file at the edges of the clip.
+func (j *job) trim(outFile string) error {
+	r := j.clipped
+	if r.from == r.offset && r.to == r.end {
+		return nil
+	}
+	return joiner.Trim(j.opts.FFmpeg, outFile, r.from-r.offset, r.to-r.from)
+}
@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseClipTime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		d    time.Duration
+		date time.Time
+		err  bool
+	}{
+		{"90", 90 * time.Second, time.Time{}, false},
+		{"90.25", 90*time.Second + 250*time.Millisecond, time.Time{}, false},
+		{"1:30", 90 * time.Second, time.Time{}, false},
+		{"01:02:03.456", time.Hour + 2*time.Minute + 3456*time.Millisecond, time.Time{}, false},
+		{"1m30s", 90 * time.Second, time.Time{}, false},
+		{"2024-01-01T12:30:00Z", 0, date, false},
+		{"1:2:3:4", 0, time.Time{}, true},
+		{"-5", 0, time.Time{}, true},
+		{"1:-30", 0, time.Time{}, true},
+		{"1.5:30", 0, time.Time{}, true},
+		{"abc", 0, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		d, date, err := ParseClipTime(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseClipTime(%q) error %v", tt.in, err)
+			continue
+		}
+		if d != tt.d || !date.Equal(tt.date) {
+			t.Errorf("ParseClipTime(%q) = %s, %s, want %s, %s", tt.in, d, date, tt.d, tt.date)
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	// 4 segments of 4 seconds, then a discontinuity and 2 of 6 seconds
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:4.0,
+s10.ts
+#EXTINF:4.0,
+s11.ts
+#EXTINF:4.0,
+s12.ts
+#EXTINF:4.0,
+s13.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:6.0,
+s14.ts
+#EXTINF:6.0,
+s15.ts
+#EXT-X-ENDLIST
+`
+	tests := []struct {
+		name          string
+		clip          Clip
+		first, last   uint64
+		discontinuity bool
+		from, to      time.Duration
+		err           bool
+	}{
+		{"start", Clip{Start: 5 * time.Second}, 11, 15, true, 5 * time.Second, 28 * time.Second, false},
+		{"end", Clip{End: 9 * time.Second}, 10, 12, false, 0, 9 * time.Second, false},
+		{"segment boundaries", Clip{Start: 4 * time.Second, End: 12 * time.Second}, 11, 12, false, 4 * time.Second, 12 * time.Second, false},
+		{"across the discontinuity", Clip{Start: 14 * time.Second, End: 20 * time.Second}, 13, 14, true, 14 * time.Second, 20 * time.Second, false},
+		{"after the discontinuity", Clip{Start: 23 * time.Second}, 15, 15, false, 23 * time.Second, 28 * time.Second, false},
+		{"segments", Clip{FirstSegment: 2, LastSegment: 3}, 11, 12, false, 4 * time.Second, 12 * time.Second, false},
+		{"end before start", Clip{Start: 10 * time.Second, End: 5 * time.Second}, 0, 0, false, 0, 0, true},
+		{"end at start", Clip{Start: 10 * time.Second, End: 10 * time.Second}, 0, 0, false, 0, 0, true},
+		{"start after the end", Clip{Start: 28 * time.Second}, 0, 0, false, 0, 0, true},
+		{"segment after the end", Clip{FirstSegment: 7}, 0, 0, false, 0, 0, true},
+		{"no date", Clip{StartTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}, 0, 0, false, 0, 0, true},
+	}
+	for _, tt := range tests {
+		d, err := New(Options{Clip: tt.clip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := d.newJob(context.Background(), &counter{})
+		mpl, _, err := j.parseM3u8("http://example.com/index.m3u8", []byte(playlist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mpl, err = j.clip(mpl)
+		j.stopRequests()
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		segments := mpl.GetAllSegments()
+		first, last := segments[0].SeqId, segments[len(segments)-1].SeqId
+		if first != tt.first || last != tt.last {
+			t.Errorf("%s: segments %d-%d, want %d-%d", tt.name, first, last, tt.first, tt.last)
+		}
+		var discontinuity bool
+		for _, segment := range segments[1:] {
+			discontinuity = discontinuity || segment.Discontinuity
+		}
+		if discontinuity != tt.discontinuity {
+			t.Errorf("%s: discontinuity %v, want %v", tt.name, discontinuity, tt.discontinuity)
+		}
+		if j.clipped.from != tt.from || j.clipped.to != tt.to {
+			t.Errorf("%s: clip %s-%s, want %s-%s", tt.name, j.clipped.from, j.clipped.to, tt.from, tt.to)
+		}
+		if j.clipped.from < j.clipped.offset || j.clipped.to > j.clipped.end {
+			t.Errorf("%s: clip %s-%s out of the segments %s-%s", tt.name, j.clipped.from, j.clipped.to, j.clipped.offset, j.clipped.end)
+		}
+	}
+}
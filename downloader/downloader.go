@@ -0,0 +1,861 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/hackpool"
+	"github.com/greyh4t/m3u8-Downloader-Go/decrypter"
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/journal"
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+)
+
+type Options struct {
+	// OutFile is the file the media is saved to. If empty, the name is
+	// derived from the playlist url.
+	OutFile     string
+	Connections int
+	Retry       int
+	Headers     map[string]string
+	// Playlist is used instead of downloading the playlist, the url given
+	// to Download is then only used to resolve relative uris.
+	Playlist []byte
+	// DesiredResolution selects the variant of a master playlist of that
+	// resolution, or the closest one, like Selector.Resolution.
+	DesiredResolution string
+	Selector          VariantSelector
+	// PickVariant is called to choose among the variants selected, when
+	// there are several of them. They are sorted by preference.
+	PickVariant func(variants []*m3u8.Variant) (*m3u8.Variant, error)
+	// NoFix disables the removal of the image header some websites put in
+	// front of the ts segments.
+	NoFix bool
+	// MaxMemory is the number of bytes of downloaded segments held in
+	// memory, the others are written to temporary files. The segments read
+	// whole to be decrypted with SAMPLE-AES or CENC, or to be checked with
+	// Verify, count too. 0 uses DefaultMaxMemory, -1 writes every segment to
+	// a temporary file.
+	MaxMemory int64
+	// Resume continues an interrupted download, using a journal next to the
+	// out file.
+	Resume bool
+	// Live records a playlist without EXT-X-ENDLIST until it ends, the
+	// context is canceled, MaxDuration of media is recorded or the playlist
+	// can not be reloaded Retry times in a row.
+	Live        bool
+	MaxDuration time.Duration
+	// Clip selects the part of the media to download. The renditions are
+	// clipped at the same offsets as the variant.
+	Clip Clip
+	// SkipAds leaves out the ad breaks marked by EXT-X-CUE-OUT and
+	// EXT-X-CUE-IN, EXT-X-SCTE35 or EXT-X-DATERANGE with SCTE35-OUT, and
+	// with AdHosts the discontinuity periods served from another host than
+	// the rest of the media. They are listed in Result.Ads.
+	SkipAds bool
+	AdHosts bool
+	// Verify checks every segment downloaded: the alignment and continuity
+	// counters of the MPEG-TS packets, the duration given by the timestamps
+	// against #EXTINF and the continuity of the timestamps from one segment
+	// to the next, or the boxes of the fMP4 segments. The segments failing
+	// the checks are downloaded again, up to 2 times, and the results are
+	// in Result.Health.
+	Verify bool
+	// Key is used for every segment instead of downloading the key.
+	Key []byte
+	// KeyMap holds keys by key uri, relative uris are resolved against the
+	// playlist url.
+	KeyMap map[string][]byte
+	// KeyCommand is run by the shell to get the keys, see README.MD.
+	KeyCommand string
+	// CENCKeys holds the keys of fMP4 segments encrypted with common
+	// encryption, by hex encoded KID.
+	CENCKeys map[string][]byte
+	// AudioLang selects the audio renditions of the variant by language,
+	// "all" selects all of them. AudioName selects one by name. If neither
+	// is set, the default audio rendition is downloaded.
+	AudioLang []string
+	AudioName string
+	// SubtitleLang selects the subtitle renditions by language, all of them
+	// are downloaded if it is empty, none if NoSubtitles is set.
+	SubtitleLang []string
+	NoSubtitles  bool
+	// SubtitleFormat is the format of the subtitle files, vtt or srt. The
+	// cues of the segments are merged on the time line of the variant.
+	SubtitleFormat string
+	// MergeWithFFmpeg also muxes the renditions into the out file, instead
+	// of saving them next to it.
+	MergeWithFFmpeg bool
+	FFmpeg          string
+	// SplitPeriods saves every discontinuity period to its own file instead
+	// of concatenating them, as their timestamps are not continuous. When
+	// merging with ffmpeg, the timestamps are rebased instead. It can not be
+	// used with Resume.
+	SplitPeriods bool
+	// Format remuxes the MPEG-TS segments to an MP4 file without ffmpeg,
+	// "mp4" with the sample tables before the media data and "fmp4" with a
+	// fragment per segment. The fMP4 segments of a playlist with EXT-X-MAP
+	// are joined into a fragmented MP4 file with either format, with the
+	// sample entries of all the init segments, continuous decode times and
+	// an mfra index. The renditions are saved as they are. It can not be
+	// used with MergeWithFFmpeg, Resume, SplitPeriods or Joiner.
+	Format string
+	// Client is the http client used for all requests. If nil, a client
+	// with a timeout of 60 seconds is used.
+	Client *http.Client
+	// Rules replace the rules checking the responses of the kinds of
+	// resources, see zhttp.DefaultRules. A response refused by its rule is
+	// downloaded again, and from the backup playlists for the segments.
+	Rules map[zhttp.Kind]zhttp.Rule
+	// Joiner receives the segments instead of the joiner selected by
+	// MergeWithFFmpeg. It can not be used with Resume.
+	Joiner joiner.Joiner
+	// Progress is called with the number of segments saved and the number
+	// of segments to download, from one goroutine at a time.
+	Progress func(done, total int)
+	Logger   *log.Logger
+}
+
+type Result struct {
+	OutFile string
+	// Periods are the files of the discontinuity periods, the first one
+	// being OutFile, when they are split.
+	Periods []string
+	// Segments is the number of segments in the out file, including the
+	// ones of a resumed download.
+	Segments   int
+	Downloaded int
+	Duration   time.Duration
+	// Ads are the ad breaks left out, with SkipAds.
+	Ads []AdBreak
+	// Health holds the checks of the segments downloaded, with Verify.
+	Health []SegmentHealth
+	// Tracks are the renditions saved next to the out file.
+	Tracks []Track
+}
+
+// ErrResumable is wrapped in the error of a download whose journal is kept,
+// so that it can be continued with Resume.
+var ErrResumable = errors.New("the download can be resumed")
+
+// Track is an audio or subtitle rendition of the variant.
+type Track struct {
+	Type     string
+	Language string
+	Name     string
+	OutFile  string
+	Periods  []string
+	Health   []SegmentHealth
+}
+
+type Downloader struct {
+	opts   Options
+	http   *zhttp.Zhttp
+	logger *log.Logger
+}
+
+// DefaultMaxMemory is the MaxMemory used when it is 0.
+const DefaultMaxMemory = 256 << 20
+
+func New(opts Options) (*Downloader, error) {
+	if opts.Connections <= 0 {
+		opts.Connections = 16
+	}
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = DefaultMaxMemory
+	}
+	if opts.Retry <= 0 {
+		opts.Retry = 1
+	}
+	if opts.FFmpeg == "" {
+		opts.FFmpeg = "ffmpeg"
+	}
+	if opts.Selector.Resolution == "" {
+		opts.Selector.Resolution = opts.DesiredResolution
+	}
+	if opts.SubtitleFormat == "" {
+		opts.SubtitleFormat = "vtt"
+	}
+	if opts.SubtitleFormat != "vtt" && opts.SubtitleFormat != "srt" {
+		return nil, fmt.Errorf("unsupported subtitle format %s", opts.SubtitleFormat)
+	}
+	if opts.Joiner != nil && opts.Resume {
+		return nil, fmt.Errorf("resume can not be used with a custom joiner")
+	}
+	if opts.Live && opts.Resume {
+		return nil, fmt.Errorf("live can not be used with resume")
+	}
+	if opts.Live && opts.Clip.isSet() {
+		return nil, fmt.Errorf("live can not be clipped")
+	}
+	if opts.SplitPeriods && (opts.MergeWithFFmpeg || opts.Resume || opts.Joiner != nil) {
+		return nil, fmt.Errorf("split periods can not be used with ffmpeg, resume or a custom joiner")
+	}
+	if opts.Clip.Precise && !opts.MergeWithFFmpeg {
+		return nil, fmt.Errorf("precise clipping requires merging with ffmpeg")
+	}
+	if opts.Format != "" && opts.Format != "mp4" && opts.Format != "fmp4" {
+		return nil, fmt.Errorf("unsupported format %s", opts.Format)
+	}
+	if opts.Format != "" && (opts.MergeWithFFmpeg || opts.Resume || opts.SplitPeriods || opts.Joiner != nil) {
+		return nil, fmt.Errorf("format %s can not be used with ffmpeg, resume, split periods or a custom joiner", opts.Format)
+	}
+	if opts.SkipAds && (opts.Live || opts.Clip.Precise) {
+		return nil, fmt.Errorf("ads can not be skipped when recording live or clipping precisely")
+	}
+
+	d := &Downloader{
+		opts:   opts,
+		logger: opts.Logger,
+	}
+	if d.logger == nil {
+		d.logger = log.New(io.Discard, "", 0)
+	}
+
+	if opts.Client != nil {
+		d.http = zhttp.NewWithClient(opts.Client)
+	} else {
+		var err error
+		d.http, err = zhttp.New(time.Second*60, "", false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for kind, rule := range opts.Rules {
+		d.http.SetRule(kind, rule)
+	}
+
+	return d, nil
+}
+
+// job holds the state of one download.
+type job struct {
+	*Downloader
+	ctx context.Context
+	// reqCtx is the context of the requests. It is only canceled
+	// drainTimeout after ctx, so that the segments being downloaded, or
+	// queued when recording a live stream, are saved. stopRequests
+	// releases it.
+	reqCtx       context.Context
+	stopRequests func()
+	joiner       joiner.Joiner
+	journal      *journal.Journal
+	spool        *joiner.Spool
+	cenc         *decrypter.CENC
+	// initSegment is the init segment stripped of its protection boxes,
+	// downloaded ahead of the media segments when CENC is used
+	initSegment  []byte
+	cencMap      *m3u8.Map
+	keyCache     map[string][]byte
+	keyCacheLock sync.Mutex
+	// renditions are the audio and subtitle renditions of the selected
+	// variant
+	renditions []*m3u8.Alternative
+	// renditionBackups are the uris of the same renditions in the backup
+	// variants
+	renditionBackups map[*m3u8.Alternative][]string
+	// alternates are the uris of playlists redundant with the one given to
+	// run, backups holds the ones after the playlist that was loaded
+	alternates []string
+	backups    []*backup
+	// active is the backup the last failed segment was downloaded from
+	active *backup
+	// clipped is the part of the playlist selected by the Clip option
+	clipped *clipRange
+	// adMarks are the ad segments of the playlists loaded, with SkipAds
+	adMarks map[*m3u8.MediaSegment]adMark
+	ads     []AdBreak
+	// health holds the checks of the segments by block id, with Verify,
+	// fmp4 is set when the segments are fMP4
+	health map[int]*SegmentHealth
+	fmp4   bool
+	// periods holds the discontinuity period of the blocks, see
+	// joiner.PeriodFunc
+	periods map[int]int
+	warned  bool
+	// remux is set when the MPEG-TS segments are remuxed to the Format, the
+	// fMP4 segments are joined into a fragmented MP4 file otherwise
+	remux bool
+	// track is set when downloading a rendition, it names the out file
+	// after the one of the variant
+	track     string
+	trackType string
+	counter   *counter
+	// start is measured for the subtitle renditions of the variant, which
+	// they have as variantStart
+	start        *videoStart
+	variantStart *videoStart
+
+	l        sync.Mutex
+	err      error
+	done     int
+	total    int
+	duration time.Duration
+}
+
+// Download saves the media of the playlist at url. With a master playlist,
+// the variant is selected by Selector.
+//
+// When ctx is canceled, no more segments are scheduled and the segments
+// being downloaded are given drainTimeout to finish. The segments saved so
+// far are kept with a journal, so that the download can be resumed. When
+// recording a live stream, canceling ctx stops the recording and the
+// segments already queued are saved normally, within drainTimeout too.
+func (d *Downloader) Download(ctx context.Context, url string) (Result, error) {
+	return d.newJob(ctx, &counter{fn: d.opts.Progress}).run(url)
+}
+
+// drainTimeout is how long the segments being downloaded when the download
+// is canceled have to finish.
+const drainTimeout = 30 * time.Second
+
+func (d *Downloader) newJob(ctx context.Context, c *counter) *job {
+	reqCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(drainTimeout, cancel)
+	})
+
+	return &job{
+		Downloader: d,
+		ctx:        ctx,
+		reqCtx:     reqCtx,
+		stopRequests: func() {
+			stop()
+			cancel()
+		},
+		keyCache: map[string][]byte{},
+		periods:  map[int]int{},
+		health:   map[int]*SegmentHealth{},
+		counter:  c,
+	}
+}
+
+func (j *job) run(url string) (Result, error) {
+	defer j.stopRequests()
+
+	var mpl *m3u8.MediaPlaylist
+	var mediaURL string
+	var err error
+	if len(j.alternates) > 0 {
+		mpl, mediaURL, err = j.parseRedundant(append([]string{url}, j.alternates...))
+	} else {
+		mpl, mediaURL, err = j.parseM3u8(url, j.opts.Playlist)
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("parse m3u8 file error: %w", err)
+	}
+
+	if mpl.Count() == 0 && !j.opts.Live {
+		return Result{}, nil
+	}
+
+	if j.opts.Clip.isSet() {
+		mpl, err = j.clip(mpl)
+		if err != nil {
+			return Result{}, fmt.Errorf("clip error: %w", err)
+		}
+	}
+
+	if j.opts.SkipAds {
+		mpl, err = j.skipAds(mpl)
+		if err != nil {
+			return Result{}, fmt.Errorf("skip ads error: %w", err)
+		}
+	}
+
+	var first string
+	if mpl.Count() > 0 {
+		first = mpl.GetAllSegments()[0].URI
+	}
+
+	outFile := j.opts.OutFile
+	switch {
+	case j.trackType == "SUBTITLES":
+		outFile = trackFile(outFile, j.track, "."+j.opts.SubtitleFormat)
+	case j.track != "":
+		outFile = trackFile(outFile, j.track, trackExt(first))
+	case outFile == "":
+		outFile = filename(url, first)
+		if j.opts.Format != "" {
+			outFile = strings.TrimSuffix(outFile, filepath.Ext(outFile)) + ".mp4"
+		}
+	}
+
+	// the segments of a playlist with EXT-X-MAP are MP4 already
+	j.fmp4 = hasMap(mpl)
+	j.remux = j.opts.Format != "" && !j.fmp4
+
+	alts, err := j.selectRenditions()
+	if err != nil {
+		return Result{}, err
+	}
+
+	j.loadKeyMap(mediaURL)
+
+	if j.opts.CENCKeys != nil {
+		err = j.setupCENC(mpl.Map)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	// the journal is always written, so that an interrupted download can be
+	// resumed. Subtitles are merged at the end and downloaded again.
+	if j.opts.Joiner == nil && !j.opts.Live && !j.opts.SplitPeriods && j.opts.Format == "" && j.trackType != "SUBTITLES" {
+		j.journal, err = j.openJournal(outFile, mpl)
+		if err != nil {
+			return Result{}, fmt.Errorf("open journal error: %w", err)
+		}
+	}
+
+	j.spool = joiner.NewSpool("", max(j.opts.MaxMemory, 0))
+	defer j.spool.Close()
+
+	j.joiner, err = j.newJoiner(outFile)
+	if err != nil {
+		if j.journal != nil && j.opts.Resume {
+			j.journal.Close()
+		} else if j.journal != nil {
+			j.journal.Remove()
+		}
+		return Result{}, err
+	}
+
+	var resumed int
+	if j.journal != nil {
+		resumed = len(j.journal.Entries())
+		if resumed > 0 {
+			j.logger.Println("[+] Resuming,", resumed, "segments already downloaded")
+		}
+	}
+
+	if hasSubtitles(alts) {
+		j.start = j.measureStart()
+	}
+	tracks := j.startTracks(alts, outFile)
+
+	if j.opts.Live {
+		j.startLive(mediaURL, mpl)
+	} else {
+		j.startDownload(mpl)
+	}
+	if j.start != nil {
+		// the first segment was not saved
+		j.start.set(0, false)
+	}
+
+	if err := j.ctx.Err(); err != nil && !j.opts.Live {
+		if fj, ok := j.joiner.(*joiner.FFmepgJoiner); ok && j.journal != nil {
+			err := fj.Keep()
+			if err != nil {
+				j.logger.Println("[!] Keep the downloaded segments error:", err)
+			}
+		}
+		err = j.abort(fmt.Errorf("download interrupted, %d segments saved: %w", resumed+j.done, err))
+		tracks.wait()
+		return Result{}, err
+	}
+	if j.err != nil {
+		err := j.abort(j.err)
+		tracks.cancel()
+		tracks.wait()
+		return Result{}, err
+	}
+
+	// the variant is kept for a resumed download until the renditions are
+	// saved too
+	saved, err := tracks.wait()
+	if err != nil {
+		return Result{}, j.abort(err)
+	}
+
+	err = j.joiner.Merge()
+	if err != nil {
+		return Result{}, fmt.Errorf("save to %s error: %w", outFile, err)
+	}
+
+	if j.journal != nil {
+		j.journal.Remove()
+	}
+
+	if j.clipped != nil && j.opts.Clip.Precise && j.opts.Joiner == nil && j.trackType != "SUBTITLES" {
+		err = j.trim(outFile)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	saved, err = j.muxTracks(outFile, saved)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var periods []string
+	if mj, ok := j.joiner.(*joiner.MemoryJoiner); ok && j.opts.SplitPeriods {
+		periods = mj.Files()
+	}
+
+	return Result{
+		OutFile:    outFile,
+		Periods:    periods,
+		Segments:   resumed + j.done,
+		Downloaded: j.done,
+		Duration:   j.duration,
+		Ads:        j.ads,
+		Health:     j.healthReport(),
+		Tracks:     saved,
+	}, nil
+}
+
+// abort stops the joiner and keeps the journal for a resumed download. The
+// error of the download is returned, with ErrResumable when the journal is
+// kept.
+func (j *job) abort(err error) error {
+	j.joiner.Abort()
+	if j.journal == nil {
+		return err
+	}
+	j.journal.Close()
+	return fmt.Errorf("%w, %w", err, ErrResumable)
+}
+
+// fail records the first error of the download, which stops it.
+func (j *job) fail(err error) {
+	j.l.Lock()
+	if j.err == nil {
+		j.err = err
+	}
+	j.l.Unlock()
+}
+
+func (j *job) failed() bool {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.err != nil
+}
+
+// progress adds to the number of segments saved and to download.
+func (j *job) progress(done, total int) {
+	j.l.Lock()
+	j.done += done
+	j.total += total
+	j.l.Unlock()
+	j.counter.add(done, total)
+}
+
+// counter sums the progress of the variant and of its renditions.
+type counter struct {
+	l     sync.Mutex
+	done  int
+	total int
+	fn    func(done, total int)
+}
+
+func (c *counter) add(done, total int) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.done += done
+	c.total += total
+	if c.fn != nil {
+		c.fn(c.done, c.total)
+	}
+}
+
+// pushMap queues the download of the init segment used from the segment of
+// sequence number seq, unless it was already downloaded by setupCENC.
+func (j *job) pushMap(pool *hackpool.HackPool, m *m3u8.Map, id int, seq uint64) {
+	if j.initSegment != nil && sameMap(m, j.cencMap) {
+		j.callback(id, "", nil, nil)(bytes.NewReader(j.initSegment))
+		return
+	}
+	pool.Push(m.URI, m.Offset, m.Limit, j.callback(id, "", nil, nil), mapSeq(seq), j.segmentKind("", nil))
+}
+
+// mapSeq is the negative sequence number of the init segment used from the
+// segment of sequence number seq, to find it in the backup playlists.
+func mapSeq(seq uint64) int64 {
+	return -1 - int64(seq)
+}
+
+func sameMap(a, b *m3u8.Map) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.URI == b.URI && a.Offset == b.Offset && a.Limit == b.Limit
+}
+
+// mapChanged reports whether the segment uses another init segment than the
+// one before, which is downloaded as a block of its own.
+func mapChanged(segment *m3u8.MediaSegment, last *m3u8.Map) bool {
+	return segment.Map != nil && segment.Map.URI != "" && !sameMap(segment.Map, last)
+}
+
+// hasMap reports whether the segments are fMP4, with an init segment.
+func hasMap(mpl *m3u8.MediaPlaylist) bool {
+	if mpl.Map != nil && mpl.Map.URI != "" {
+		return true
+	}
+	for _, segment := range mpl.GetAllSegments() {
+		if segment.Map != nil && segment.Map.URI != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *job) startDownload(mpl *m3u8.MediaPlaylist) {
+	segments := mpl.GetAllSegments()
+
+	// the init segments are blocks before the first segment using them
+	ids := make([]int, len(segments))
+	id, period := 0, 0
+	var last *m3u8.Map
+	for i, segment := range segments {
+		if i > 0 && segment.Discontinuity {
+			period++
+			j.discontinuity()
+		}
+		if mapChanged(segment, last) {
+			j.setPeriod(id, -1)
+			id++
+		}
+		last = segment.Map
+		ids[i] = id
+		j.setPeriod(id, period)
+		id++
+	}
+
+	count := 0
+	for i := 0; i < id; i++ {
+		if !j.finished(i) {
+			count++
+		}
+	}
+	if count == 0 {
+		return
+	}
+
+	j.progress(0, count)
+
+	pool := hackpool.New(j.opts.Connections, j.download)
+
+	go func() {
+		defer pool.CloseQueue()
+
+		var last *m3u8.Map
+		for i, segment := range segments {
+			if j.failed() || j.ctx.Err() != nil {
+				return
+			}
+			if mapChanged(segment, last) && !j.finished(ids[i]-1) {
+				j.pushMap(pool, segment.Map, ids[i]-1, segment.SeqId)
+			}
+			last = segment.Map
+			if j.finished(ids[i]) {
+				continue
+			}
+			key, iv, err := j.segmentKey(segment)
+			if err != nil {
+				j.fail(err)
+				return
+			}
+			j.l.Lock()
+			j.duration += time.Duration(segment.Duration * float64(time.Second))
+			j.l.Unlock()
+			j.watch(ids[i], segment)
+			method := keyMethod(segment.Key)
+			pool.Push(segment.URI, segment.Offset, segment.Limit, j.callback(ids[i], method, key, iv), int64(segment.SeqId), j.segmentKind(method, key))
+		}
+	}()
+
+	pool.Run()
+}
+
+// finished reports whether the segment was saved by a previous run.
+func (j *job) finished(id int) bool {
+	return j.journal != nil && j.journal.Done(id)
+}
+
+// callback returns the function processing the body of a segment. Errors
+// of the connection are returned to retry the download, the others stop
+// the download.
+func (j *job) callback(id int, method string, key, iv []byte) func(io.Reader) error {
+	return func(r io.Reader) error {
+		if j.failed() {
+			return nil
+		}
+
+		r, release, err := j.decrypt(method, r, key, iv)
+		if errors.As(err, new(*zhttp.ReadError)) {
+			return err
+		}
+		if err != nil {
+			j.fail(fmt.Errorf("decrypt segment %d error: %w", id, err))
+			return nil
+		}
+		defer release()
+
+		c := j.check(id)
+		if c != nil {
+			defer c.release()
+			r = io.TeeReader(r, c)
+		}
+
+		block, err := j.spool.Write(r)
+		switch {
+		case errors.As(err, new(*zhttp.ReadError)):
+			return err
+		case errors.Is(err, decrypter.ErrPadding) || errors.Is(err, decrypter.ErrKeyMismatch):
+			j.fail(fmt.Errorf("key mismatch on segment %d: %w", id, err))
+			return nil
+		case errors.Is(err, decrypter.ErrLength):
+			j.fail(fmt.Errorf("decrypt segment %d error: %w", id, err))
+			return nil
+		case err != nil:
+			j.fail(fmt.Errorf("write file error: %w", err))
+			return nil
+		case block.Size() == 0:
+			j.fail(fmt.Errorf("segment %d is empty", id))
+			return nil
+		}
+
+		if c != nil && j.verified(id, c) {
+			block.Release()
+			return errRefetch
+		}
+
+		err = j.joiner.Add(id, block)
+		if err != nil {
+			j.fail(fmt.Errorf("write file error: %w", err))
+			return nil
+		}
+		if id == 0 && c != nil && j.start != nil {
+			var h SegmentHealth
+			c.result(&h)
+			j.start.set(h.first, h.timed)
+		}
+
+		j.progress(1, 0)
+		return nil
+	}
+}
+
+// decrypt returns a reader of the decrypted segment, without the image header
+// some websites put in front of it. SAMPLE-AES and CENC only encrypt the
+// media samples, so they need the whole segment, and for SAMPLE-AES the
+// header has to be removed first to find the ts packets. The whole segments
+// count against MaxMemory until release is called.
+func (j *job) decrypt(method string, r io.Reader, key, iv []byte) (io.Reader, func(), error) {
+	if j.cenc != nil || key != nil && method == "SAMPLE-AES" {
+		data, release, err := j.spool.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if j.cenc != nil {
+			data, err = j.cenc.Decrypt(data)
+		} else {
+			if !j.opts.NoFix {
+				data = ts.TryFix(data)
+			}
+			data, err = decrypter.DecryptSampleAES(data, key, iv)
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		return bytes.NewReader(data), release, nil
+	}
+
+	if key != nil {
+		var err error
+		r, err = decrypter.NewReader(r, key, iv)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !j.opts.NoFix {
+		r = ts.NewFixReader(r)
+	}
+	return r, func() {}, nil
+}
+
+func (j *job) download(args ...interface{}) {
+	url := args[0].(string)
+	offset := args[1].(int64)
+	limit := args[2].(int64)
+	fn := args[3].(func(io.Reader) error)
+	seq := args[4].(int64)
+	kind := args[5].(zhttp.Kind)
+
+	// once ctx is canceled, only the segments being downloaded are finished,
+	// and the queued ones too when recording a live stream
+	if j.failed() || j.reqCtx.Err() != nil || !j.opts.Live && j.ctx.Err() != nil {
+		return
+	}
+
+	// the segments failing the checks are downloaded again apart from the
+	// retries of the requests, verified limits how many times
+	err := j.fetch(kind, url, offset, limit, seq, fn)
+	for errors.Is(err, errRefetch) && j.reqCtx.Err() == nil {
+		err = j.fetch(kind, url, offset, limit, seq, fn)
+	}
+	if err != nil && j.reqCtx.Err() == nil {
+		j.fail(fmt.Errorf("download %s error: %w", url, err))
+	}
+}
+
+func (j *job) get(kind zhttp.Kind, url string) ([]byte, error) {
+	return j.getRange(kind, url, 0, 0)
+}
+
+func (j *job) getRange(kind zhttp.Kind, url string, offset, limit int64) ([]byte, error) {
+	statusCode, data, err := j.http.GetRange(j.reqCtx, kind, url, j.opts.Headers, j.opts.Retry, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if statusCode/100 != 2 || len(data) == 0 {
+		return nil, fmt.Errorf("http status code: %d", statusCode)
+	}
+
+	return data, nil
+}
+
+// segmentKind is the kind of a segment decrypted with method and key, for the
+// rules checking the responses. The segments encrypted whole are random bytes
+// until they are decrypted.
+func (j *job) segmentKind(method string, key []byte) zhttp.Kind {
+	switch {
+	case j.trackType == "SUBTITLES":
+		return zhttp.Subtitle
+	case key != nil && method != "SAMPLE-AES":
+		return zhttp.Encrypted
+	}
+	return zhttp.Segment
+}
+
+func (j *job) getStream(kind zhttp.Kind, url string, offset, limit int64, fn func(io.Reader) error) error {
+	statusCode, err := j.http.GetRangeFunc(j.reqCtx, kind, url, j.opts.Headers, j.opts.Retry, offset, limit, fn)
+	if err != nil {
+		return err
+	}
+
+	if statusCode/100 != 2 {
+		return fmt.Errorf("http status code: %d", statusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+)
+
+// redundant reports whether two variants are the same stream served from
+// different hosts or content steering pathways. The group ids of their
+// renditions differ between pathways, so the renditions are compared.
+func redundant(mpl *m3u8.MasterPlaylist, a, b *m3u8.Variant) bool {
+	if a.URI == b.URI || a.Iframe != b.Iframe ||
+		a.Bandwidth != b.Bandwidth || a.AverageBandwidth != b.AverageBandwidth ||
+		a.Codecs != b.Codecs || a.Resolution != b.Resolution ||
+		a.FrameRate != b.FrameRate || a.VideoRange != b.VideoRange ||
+		a.HDCPLevel != b.HDCPLevel || a.Name != b.Name {
+		return false
+	}
+
+	ra, rb := renditions(mpl, a), renditions(mpl, b)
+	if len(ra) != len(rb) {
+		return false
+	}
+	for i := range ra {
+		if !sameRendition(ra[i], rb[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRendition(a, b *m3u8.Alternative) bool {
+	return a.Type == b.Type && a.Language == b.Language && a.Name == b.Name
+}
+
+// distinct returns the variants except the I-frame ones and the backups of
+// another variant.
+func distinct(mpl *m3u8.MasterPlaylist) []*m3u8.Variant {
+	var list []*m3u8.Variant
+	for _, v := range mpl.Variants {
+		if v.Iframe {
+			continue
+		}
+		dup := false
+		for _, prev := range list {
+			if redundant(mpl, prev, v) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// backupVariants returns the variants redundant with variant, in the order of
+// the playlist.
+func backupVariants(mpl *m3u8.MasterPlaylist, variant *m3u8.Variant) []*m3u8.Variant {
+	var list []*m3u8.Variant
+	for _, v := range mpl.Variants {
+		if v != variant && redundant(mpl, variant, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// backupRenditions returns the uris of the renditions of the backup variants
+// that are the same as alt.
+func backupRenditions(mpl *m3u8.MasterPlaylist, backups []*m3u8.Variant, alt *m3u8.Alternative) []string {
+	var list []string
+	for _, v := range backups {
+		for _, b := range renditions(mpl, v) {
+			if b.URI != "" && b.URI != alt.URI && sameRendition(alt, b) {
+				list = append(list, b.URI)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// parseRedundant loads the first of the redundant media playlists that can
+// be loaded, the next ones are kept as backups.
+func (j *job) parseRedundant(uris []string) (*m3u8.MediaPlaylist, string, error) {
+	var firstErr error
+	for i, uri := range uris {
+		mpl, mediaURL, err := j.parseM3u8(uri, nil)
+		if err == nil {
+			if i > 0 {
+				j.logger.Println("[!] Load playlist", uris[0], "failed, using backup", uri)
+			}
+			j.backups = nil
+			for _, b := range uris[i+1:] {
+				j.backups = append(j.backups, &backup{url: b})
+			}
+			return mpl, mediaURL, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if j.reqCtx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", firstErr
+}
+
+// backup is a media playlist redundant with the one being downloaded. It is
+// loaded when a segment first fails, and reloaded when a live playlist does
+// not have the segment yet. Its segments are found by sequence number, the
+// ads and the clip only apply to the primary playlist.
+type backup struct {
+	url  string
+	l    sync.Mutex
+	mpl  *m3u8.MediaPlaylist
+	seqs map[uint64]*m3u8.MediaSegment
+}
+
+// segment returns the segment of sequence number seq, or the init segment
+// as a segment when seq is -1.
+func (b *backup) segment(j *job, seq int64) (*m3u8.MediaSegment, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.mpl == nil || b.find(seq) == nil && !b.mpl.Closed {
+		mpl, err := j.loadMedia(b.url)
+		if err != nil {
+			return nil, err
+		}
+		b.mpl = mpl
+		b.seqs = map[uint64]*m3u8.MediaSegment{}
+		for _, segment := range mpl.GetAllSegments() {
+			b.seqs[segment.SeqId] = segment
+		}
+	}
+
+	segment := b.find(seq)
+	if segment == nil {
+		return nil, fmt.Errorf("segment %d not found in %s", seq, b.url)
+	}
+	return segment, nil
+}
+
+func (b *backup) find(seq int64) *m3u8.MediaSegment {
+	if seq < 0 {
+		// the init segment used from the segment -1-seq, see mapSeq
+		m := b.mpl.Map
+		if segment := b.find(-1 - seq); segment != nil && segment.Map != nil {
+			m = segment.Map
+		}
+		if m == nil || m.URI == "" {
+			return nil
+		}
+		return &m3u8.MediaSegment{URI: m.URI, Offset: m.Offset, Limit: m.Limit}
+	}
+	return b.seqs[uint64(seq)]
+}
+
+// loadMedia loads a backup media playlist as it is served.
+func (j *job) loadMedia(url string) (*m3u8.MediaPlaylist, error) {
+	data, err := j.get(zhttp.Playlist, url)
+	if err != nil {
+		return nil, err
+	}
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(normalizeByteRanges(data)), true)
+	if err != nil {
+		return nil, err
+	}
+	if listType != m3u8.MEDIA {
+		return nil, fmt.Errorf("%s is not a media playlist", url)
+	}
+	mpl := playlist.(*m3u8.MediaPlaylist)
+	err = resolveMedia(url, mpl)
+	if err != nil {
+		return nil, err
+	}
+	return mpl, nil
+}
+
+// fetch downloads the segment of sequence number seq, or an init segment
+// when seq is negative, from the backup playlists when it fails on the primary
+// one. Once a backup served a segment, it is tried first for the next ones.
+// The segments of redundant playlists are the same, so they are decrypted
+// with the key of the primary one.
+func (j *job) fetch(kind zhttp.Kind, url string, offset, limit int64, seq int64, fn func(io.Reader) error) error {
+	if len(j.backups) == 0 {
+		return j.getStream(kind, url, offset, limit, fn)
+	}
+
+	j.l.Lock()
+	active := j.active
+	j.l.Unlock()
+
+	var err error
+	if active == nil {
+		err = j.getStream(kind, url, offset, limit, fn)
+		if err == nil || j.reqCtx.Err() != nil {
+			return err
+		}
+	}
+
+	order := []*backup{}
+	if active != nil {
+		order = append(order, active)
+	}
+	for _, b := range j.backups {
+		if b != active {
+			order = append(order, b)
+		}
+	}
+
+	for _, b := range order {
+		segment, berr := b.segment(j, seq)
+		if berr == nil {
+			berr = j.getStream(kind, segment.URI, segment.Offset, segment.Limit, fn)
+		}
+		if berr == nil {
+			j.l.Lock()
+			if j.active != b {
+				j.active = b
+				j.logger.Println("[!] Segment failed, switching to backup playlist", b.url)
+			}
+			j.l.Unlock()
+			return nil
+		}
+		if err == nil {
+			err = berr
+		}
+		if j.reqCtx.Err() != nil {
+			return err
+		}
+	}
+
+	if active != nil {
+		return j.getStream(kind, url, offset, limit, fn)
+	}
+	return err
+}
+
+// segmentKey returns the key and iv of the segment, from the same segment of
+// a backup playlist when the key can not be downloaded.
+func (j *job) segmentKey(segment *m3u8.MediaSegment) ([]byte, []byte, error) {
+	key, iv, err := j.getKey(segment.SeqId, segment.Key)
+	if err == nil || len(j.backups) == 0 {
+		return key, iv, err
+	}
+
+	for _, b := range j.backups {
+		if j.reqCtx.Err() != nil {
+			break
+		}
+		s, berr := b.segment(j, int64(segment.SeqId))
+		if berr != nil {
+			continue
+		}
+		key, iv, berr := j.getKey(s.SeqId, s.Key)
+		if berr == nil {
+			return key, iv, nil
+		}
+	}
+	return nil, nil, err
+}
+
+// reload loads a live playlist again, or one of its backups when it fails.
+func (j *job) reload(mediaURL string) (*m3u8.MediaPlaylist, error) {
+	mpl, _, err := j.parseM3u8(mediaURL, nil)
+	if err == nil {
+		return mpl, nil
+	}
+
+	for _, b := range j.backups {
+		if j.reqCtx.Err() != nil {
+			break
+		}
+		mpl, _, berr := j.parseM3u8(b.url, nil)
+		if berr == nil {
+			return mpl, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,51 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestBackupSegment finds the segments of a backup playlist with ads by
+// sequence number, without marking its ads.
+func TestBackupSegment(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:4.0,
+s100.ts
+#EXT-X-CUE-OUT:4
+#EXTINF:4.0,
+ad.ts
+#EXT-X-CUE-IN
+#EXTINF:4.0,
+s102.ts
+#EXT-X-ENDLIST
+`))
+	}))
+	defer srv.Close()
+
+	d, err := New(Options{SkipAds: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := d.newJob(context.Background(), &counter{})
+	defer j.stopRequests()
+	b := &backup{url: srv.URL + "/backup/index.m3u8"}
+
+	segment, err := b.segment(j, 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := srv.URL + "/backup/s102.ts"; segment.URI != want {
+		t.Errorf("segment 102 is %s, want %s", segment.URI, want)
+	}
+	if len(j.adMarks) != 0 {
+		t.Errorf("%d ad segments marked from the backup", len(j.adMarks))
+	}
+	if _, err = b.segment(j, 103); err == nil {
+		t.Error("segment 103 found after the end of the backup")
+	}
+}
@@ -0,0 +1,388 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+)
+
+// Inspection describes a master or a media playlist.
+type Inspection struct {
+	Type   string      `json:"type"`
+	URL    string      `json:"url"`
+	Master *MasterInfo `json:"master,omitempty"`
+	Media  *MediaInfo  `json:"media,omitempty"`
+}
+
+type MasterInfo struct {
+	Version             int             `json:"version"`
+	IndependentSegments bool            `json:"independent_segments"`
+	Variants            []VariantInfo   `json:"variants"`
+	IFramePlaylists     []VariantInfo   `json:"iframe_playlists"`
+	Renditions          []RenditionInfo `json:"renditions"`
+	SessionKeys         []KeyInfo       `json:"session_keys"`
+	SessionData         []SessionData   `json:"session_data"`
+}
+
+type VariantInfo struct {
+	URI              string  `json:"uri"`
+	Bandwidth        uint32  `json:"bandwidth"`
+	AverageBandwidth uint32  `json:"average_bandwidth,omitempty"`
+	Codecs           string  `json:"codecs,omitempty"`
+	Resolution       string  `json:"resolution,omitempty"`
+	FrameRate        float64 `json:"frame_rate,omitempty"`
+	VideoRange       string  `json:"video_range,omitempty"`
+	HDCPLevel        string  `json:"hdcp_level,omitempty"`
+	Audio            string  `json:"audio,omitempty"`
+	Video            string  `json:"video,omitempty"`
+	Subtitles        string  `json:"subtitles,omitempty"`
+	ClosedCaptions   string  `json:"closed_captions,omitempty"`
+}
+
+type RenditionInfo struct {
+	Type            string `json:"type"`
+	GroupID         string `json:"group_id"`
+	Language        string `json:"language,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Default         bool   `json:"default"`
+	Autoselect      bool   `json:"autoselect"`
+	Forced          bool   `json:"forced"`
+	Characteristics string `json:"characteristics,omitempty"`
+	URI             string `json:"uri,omitempty"`
+}
+
+type KeyInfo struct {
+	Method            string `json:"method"`
+	URI               string `json:"uri,omitempty"`
+	IV                string `json:"iv,omitempty"`
+	KeyFormat         string `json:"keyformat,omitempty"`
+	KeyFormatVersions string `json:"keyformatversions,omitempty"`
+}
+
+type SessionData struct {
+	DataID   string `json:"data_id"`
+	Value    string `json:"value,omitempty"`
+	URI      string `json:"uri,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+type MediaInfo struct {
+	Version               int     `json:"version"`
+	PlaylistType          string  `json:"playlist_type,omitempty"`
+	Ended                 bool    `json:"ended"`
+	IFramesOnly           bool    `json:"iframes_only"`
+	TargetDuration        float64 `json:"target_duration"`
+	MediaSequence         uint64  `json:"media_sequence"`
+	DiscontinuitySequence uint64  `json:"discontinuity_sequence"`
+	SegmentCount          int     `json:"segment_count"`
+	// TotalDuration is in seconds.
+	TotalDuration float64   `json:"total_duration"`
+	KeyMethods    []string  `json:"key_methods"`
+	Keys          []KeyInfo `json:"keys"`
+	// ByteRanges is the number of segments that are byte ranges.
+	ByteRanges int `json:"byte_ranges"`
+	// Discontinuities are the indexes of the segments following an
+	// EXT-X-DISCONTINUITY.
+	Discontinuities []int             `json:"discontinuities"`
+	Maps            []MapInfo         `json:"maps"`
+	ProgramDateTime *DateTimeInterval `json:"program_date_time,omitempty"`
+}
+
+// MapInfo is a media initialization section, used by the segments from
+// FirstSegment to the next one.
+type MapInfo struct {
+	URI          string `json:"uri"`
+	Offset       int64  `json:"offset,omitempty"`
+	Length       int64  `json:"length,omitempty"`
+	FirstSegment int    `json:"first_segment"`
+}
+
+type DateTimeInterval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Inspect describes the playlist at url without downloading the media.
+func (d *Downloader) Inspect(ctx context.Context, url string) (*Inspection, error) {
+	j := d.newJob(ctx, &counter{})
+	defer j.stopRequests()
+
+	data := d.opts.Playlist
+	if data == nil {
+		var err error
+		data, err = j.get(zhttp.Playlist, url)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(normalizeByteRanges(data)), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if listType == m3u8.MASTER {
+		info, err := inspectMaster(playlist.(*m3u8.MasterPlaylist), data, url)
+		if err != nil {
+			return nil, err
+		}
+		return &Inspection{Type: "master", URL: url, Master: info}, nil
+	}
+
+	// parsed again to resolve the uris and carry the keys forward
+	mpl, _, err := j.parseM3u8(url, data)
+	if err != nil {
+		return nil, err
+	}
+	info, err := inspectMedia(mpl, url)
+	if err != nil {
+		return nil, err
+	}
+	return &Inspection{Type: "media", URL: url, Media: info}, nil
+}
+
+func inspectMaster(mpl *m3u8.MasterPlaylist, data []byte, base string) (*MasterInfo, error) {
+	info := &MasterInfo{
+		Version:             int(mpl.Version()),
+		IndependentSegments: mpl.IndependentSegments(),
+		Variants:            []VariantInfo{},
+		IFramePlaylists:     []VariantInfo{},
+		Renditions:          []RenditionInfo{},
+		SessionKeys:         []KeyInfo{},
+		SessionData:         []SessionData{},
+	}
+
+	resolve := func(uri string) (string, error) {
+		if uri == "" {
+			return "", nil
+		}
+		u, err := formatURI(base, uri)
+		if err != nil {
+			return "", fmt.Errorf("format uri failed: %w", err)
+		}
+		return u, nil
+	}
+
+	seen := map[*m3u8.Alternative]bool{}
+	for _, v := range mpl.Variants {
+		uri, err := resolve(v.URI)
+		if err != nil {
+			return nil, err
+		}
+		vi := VariantInfo{
+			URI:              uri,
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Codecs:           v.Codecs,
+			Resolution:       v.Resolution,
+			FrameRate:        v.FrameRate,
+			VideoRange:       v.VideoRange,
+			HDCPLevel:        v.HDCPLevel,
+			Audio:            v.Audio,
+			Video:            v.Video,
+			Subtitles:        v.Subtitles,
+			ClosedCaptions:   v.Captions,
+		}
+		if v.Iframe {
+			info.IFramePlaylists = append(info.IFramePlaylists, vi)
+		} else {
+			info.Variants = append(info.Variants, vi)
+		}
+
+		for _, alt := range v.Alternatives {
+			if alt == nil || seen[alt] {
+				continue
+			}
+			seen[alt] = true
+
+			uri, err := resolve(alt.URI)
+			if err != nil {
+				return nil, err
+			}
+			info.Renditions = append(info.Renditions, RenditionInfo{
+				Type:            alt.Type,
+				GroupID:         alt.GroupId,
+				Language:        alt.Language,
+				Name:            alt.Name,
+				Default:         alt.Default,
+				Autoselect:      strings.EqualFold(alt.Autoselect, "YES"),
+				Forced:          strings.EqualFold(alt.Forced, "YES"),
+				Characteristics: alt.Characteristics,
+				URI:             uri,
+			})
+		}
+	}
+
+	// the parser does not keep the session tags
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-SESSION-KEY:"):
+			attrs := parseAttributes(line[len("#EXT-X-SESSION-KEY:"):])
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			info.SessionKeys = append(info.SessionKeys, KeyInfo{
+				Method:            attrs["METHOD"],
+				URI:               uri,
+				IV:                attrs["IV"],
+				KeyFormat:         attrs["KEYFORMAT"],
+				KeyFormatVersions: attrs["KEYFORMATVERSIONS"],
+			})
+		case strings.HasPrefix(line, "#EXT-X-SESSION-DATA:"):
+			attrs := parseAttributes(line[len("#EXT-X-SESSION-DATA:"):])
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			info.SessionData = append(info.SessionData, SessionData{
+				DataID:   attrs["DATA-ID"],
+				Value:    attrs["VALUE"],
+				URI:      uri,
+				Language: attrs["LANGUAGE"],
+			})
+		}
+	}
+
+	return info, nil
+}
+
+func inspectMedia(mpl *m3u8.MediaPlaylist, base string) (*MediaInfo, error) {
+	info := &MediaInfo{
+		Version:               int(mpl.Version()),
+		Ended:                 mpl.Closed,
+		IFramesOnly:           mpl.Iframe,
+		TargetDuration:        mpl.TargetDuration,
+		MediaSequence:         mpl.SeqNo,
+		DiscontinuitySequence: mpl.DiscontinuitySeq,
+		KeyMethods:            []string{},
+		Keys:                  []KeyInfo{},
+		Discontinuities:       []int{},
+		Maps:                  []MapInfo{},
+	}
+	switch mpl.MediaType {
+	case m3u8.EVENT:
+		info.PlaylistType = "EVENT"
+	case m3u8.VOD:
+		info.PlaylistType = "VOD"
+	}
+
+	segments := mpl.GetAllSegments()
+	info.SegmentCount = len(segments)
+
+	var (
+		lastKey  *m3u8.Key
+		lastMap  *m3u8.Map
+		methods  = map[string]bool{}
+		keys     = map[KeyInfo]bool{}
+		elapsed  float64
+		firstPDT time.Time
+		lastPDT  time.Time
+		pdtAt    float64
+	)
+	for i, segment := range segments {
+		if segment.Discontinuity {
+			info.Discontinuities = append(info.Discontinuities, i)
+		}
+		if segment.Limit > 0 {
+			info.ByteRanges++
+		}
+
+		m := segment.Map
+		if i == 0 && m == nil {
+			m = mpl.Map
+		}
+		// the segments after an EXT-X-MAP carry it, see resolveMedia
+		if m != nil && m.URI != "" && !sameMap(m, lastMap) {
+			lastMap = m
+			uri, err := formatURI(base, m.URI)
+			if err != nil {
+				return nil, fmt.Errorf("format uri failed: %w", err)
+			}
+			info.Maps = append(info.Maps, MapInfo{URI: uri, Offset: m.Offset, Length: m.Limit, FirstSegment: i})
+		}
+
+		if k := segment.Key; k != nil && k != lastKey {
+			lastKey = k
+			method := k.Method
+			if method == "" {
+				method = "NONE"
+			}
+			if !methods[method] {
+				methods[method] = true
+				info.KeyMethods = append(info.KeyMethods, method)
+			}
+			ki := KeyInfo{
+				Method:            method,
+				URI:               k.URI,
+				IV:                k.IV,
+				KeyFormat:         k.Keyformat,
+				KeyFormatVersions: k.Keyformatversions,
+			}
+			if method != "NONE" && !keys[ki] {
+				keys[ki] = true
+				info.Keys = append(info.Keys, ki)
+			}
+		}
+
+		if !segment.ProgramDateTime.IsZero() {
+			if firstPDT.IsZero() {
+				firstPDT = segment.ProgramDateTime.Add(-seconds(elapsed))
+			}
+			lastPDT = segment.ProgramDateTime
+			pdtAt = elapsed
+		}
+
+		elapsed += segment.Duration
+	}
+	info.TotalDuration = elapsed
+
+	if !firstPDT.IsZero() {
+		info.ProgramDateTime = &DateTimeInterval{
+			Start: firstPDT,
+			End:   lastPDT.Add(seconds(elapsed - pdtAt)),
+		}
+	}
+
+	return info, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// parseAttributes parses the attribute list of a tag. The quotes of quoted
+// strings are removed.
+func parseAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		name = strings.TrimSpace(name)
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		attrs[name] = strings.TrimSpace(value)
+		s = rest
+	}
+	return attrs
+}
@@ -0,0 +1,59 @@
+package downloader
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestInspectMaps(t *testing.T) {
+	tests := []struct {
+		playlist string
+		want     []MapInfo
+	}{
+		{`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+s0.m4s
+#EXTINF:4.0,
+s1.m4s
+#EXTINF:4.0,
+s2.m4s
+#EXT-X-ENDLIST
+`, []MapInfo{{URI: "http://example.com/v/init.mp4", FirstSegment: 0}}},
+		{`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+s0.m4s
+#EXTINF:4.0,
+s1.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init2.mp4",BYTERANGE="720@0"
+#EXTINF:4.0,
+s2.m4s
+#EXTINF:4.0,
+s3.m4s
+#EXT-X-ENDLIST
+`, []MapInfo{
+			{URI: "http://example.com/v/init.mp4", FirstSegment: 0},
+			{URI: "http://example.com/v/init2.mp4", Length: 720, FirstSegment: 2},
+		}},
+	}
+	for i, tt := range tests {
+		d, err := New(Options{Playlist: []byte(tt.playlist)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inspection, err := d.Inspect(context.Background(), "http://example.com/v/index.m3u8")
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := inspection.Media.Maps; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: maps = %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/decrypter"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+)
+
+// ParseKey accepts a key as 32 hex digits, optionally prefixed with 0x.
+func ParseKey(s []byte) ([]byte, error) {
+	s = bytes.TrimSpace(s)
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	key := make([]byte, hex.DecodedLen(len(s)))
+	_, err := hex.Decode(key, s)
+	if err != nil || len(key) != 16 {
+		return nil, fmt.Errorf("invalid key %s, must be 32 hex digits", s)
+	}
+	return key, nil
+}
+
+// DecodeKey accepts a key as 16 bytes or as hex.
+func DecodeKey(data []byte) ([]byte, error) {
+	if len(data) == 16 {
+		return data, nil
+	}
+
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("key must be 16 bytes or 32 hex digits")
+	}
+	return key, nil
+}
+
+// setupCENC downloads the init segment, which holds the encryption
+// parameters of the tracks needed to decrypt the media segments.
+func (j *job) setupCENC(m *m3u8.Map) error {
+	if m == nil || m.URI == "" {
+		return fmt.Errorf("CENC keys can only be used with fMP4 segments, the playlist has no EXT-X-MAP")
+	}
+
+	data, err := j.getRange(zhttp.Segment, m.URI, m.Offset, m.Limit)
+	if err != nil {
+		return fmt.Errorf("download init segment error: %w", err)
+	}
+
+	j.cenc = decrypter.NewCENC(j.opts.CENCKeys)
+	j.initSegment, err = j.cenc.Init(data)
+	if err != nil {
+		return fmt.Errorf("parse init segment error: %w", err)
+	}
+	j.cencMap = m
+	return nil
+}
+
+func (j *job) getKey(seqNo uint64, key *m3u8.Key) ([]byte, []byte, error) {
+	if key == nil || key.Method == "NONE" || (key.Method == "" && key.URI == "") {
+		return nil, nil, nil
+	}
+
+	switch key.Method {
+	case "", "AES-128", "SAMPLE-AES":
+	case "SAMPLE-AES-CTR":
+		if j.cenc == nil {
+			return nil, nil, fmt.Errorf("encryption method %s requires CENC keys", key.Method)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption method %s", key.Method)
+	}
+
+	// fMP4 samples are decrypted with the CENC keys, the uri usually points
+	// to a DRM license server
+	if j.cenc != nil && strings.HasPrefix(key.Method, "SAMPLE-AES") {
+		return nil, nil, nil
+	}
+
+	if key.URI == "" && j.opts.Key == nil {
+		return nil, nil, fmt.Errorf("missing key uri for encryption method %s", key.Method)
+	}
+
+	k, err := j.fetchKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("download key from %s error: %w", key.URI, err)
+	}
+
+	var iv []byte
+	if key.IV != "" {
+		iv, err = parseIV(key.IV)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode iv error: %w", err)
+		}
+	} else {
+		iv = decrypter.SequenceIV(seqNo)
+	}
+	return k, iv, nil
+}
+
+func keyMethod(key *m3u8.Key) string {
+	if key == nil {
+		return ""
+	}
+	return key.Method
+}
+
+func parseIV(s string) ([]byte, error) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	if len(s) > 32 {
+		return nil, fmt.Errorf("iv %s is longer than 128 bits", s)
+	}
+
+	iv, err := hex.DecodeString(strings.Repeat("0", 32-len(s)) + s)
+	if err != nil {
+		return nil, err
+	}
+	return iv, nil
+}
+
+func (j *job) fetchKey(k *m3u8.Key) ([]byte, error) {
+	j.keyCacheLock.Lock()
+	defer j.keyCacheLock.Unlock()
+
+	key := j.keyCache[k.URI]
+	if key != nil {
+		return key, nil
+	}
+
+	if j.opts.Key != nil {
+		return j.opts.Key, nil
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(k.URI, "data:"):
+		key, err = decodeDataURI(k.URI)
+		if err == nil && len(key) != 16 {
+			err = fmt.Errorf("key of %d bytes in data uri, must be 16", len(key))
+		}
+	case j.opts.KeyCommand != "":
+		key, err = j.runKeyCommand(k)
+	default:
+		key, err = j.get(zhttp.Key, k.URI)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j.keyCache[k.URI] = key
+
+	return key, nil
+}
+
+// runKeyCommand gets a key from the key command, run by the shell with the
+// attributes of the EXT-X-KEY tag in its environment.
+func (j *job) runKeyCommand(k *m3u8.Key) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(j.ctx, "cmd", "/C", j.opts.KeyCommand)
+	} else {
+		cmd = exec.CommandContext(j.ctx, "sh", "-c", j.opts.KeyCommand)
+	}
+	cmd.Env = append(os.Environ(),
+		"M3U8_KEY_URI="+k.URI,
+		"M3U8_KEY_METHOD="+k.Method,
+		"M3U8_KEY_FORMAT="+k.Keyformat,
+	)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("key command error: %w", err)
+	}
+
+	key, err := DecodeKey(out)
+	if err != nil {
+		return nil, fmt.Errorf("key command output: %w", err)
+	}
+	return key, nil
+}
+
+// loadKeyMap puts the keys of the key map in the key cache, under the uris
+// they have once resolved against the playlist url.
+func (j *job) loadKeyMap(base string) {
+	j.keyCacheLock.Lock()
+	defer j.keyCacheLock.Unlock()
+
+	for uri, key := range j.opts.KeyMap {
+		u, err := formatURI(base, uri)
+		if err != nil {
+			u = uri
+		}
+		j.keyCache[u] = key
+	}
+}
+
+// decodeDataURI returns the content of a RFC 2397 data uri.
+func decodeDataURI(uri string) ([]byte, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok {
+		return nil, fmt.Errorf("invalid data uri")
+	}
+
+	if strings.HasSuffix(header, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	s, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,136 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/decrypter"
+)
+
+func TestParseIV(t *testing.T) {
+	tests := []struct {
+		iv   string
+		want string
+		err  bool
+	}{
+		{"0x000102030405060708090a0b0c0d0e0f", "000102030405060708090a0b0c0d0e0f", false},
+		{"0X000102030405060708090A0B0C0D0E0F", "000102030405060708090a0b0c0d0e0f", false},
+		{"000102030405060708090a0b0c0d0e0f", "000102030405060708090a0b0c0d0e0f", false},
+		// short ivs are padded on the left
+		{"0x1", "00000000000000000000000000000001", false},
+		{"0x0102030405060708090a0b0c0d0e0f1011", "", true},
+		{"0xzz", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseIV(tt.iv)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseIV(%s) = %x, want an error", tt.iv, got)
+			}
+			continue
+		}
+		if err != nil || hex.EncodeToString(got) != tt.want {
+			t.Errorf("parseIV(%s) = %x, %v, want %s", tt.iv, got, err, tt.want)
+		}
+	}
+}
+
+func dataKey(key []byte) string {
+	return "data:text/plain;base64," + base64.StdEncoding.EncodeToString(key)
+}
+
+// TestKeyRotation parses a playlist whose key changes after two segments,
+// the second key with an explicit IV.
+func TestKeyRotation(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	playlist := fmt.Sprintf(`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:4294967295
+#EXT-X-KEY:METHOD=AES-128,URI="%s"
+#EXTINF:4.0,
+s0.ts
+#EXTINF:4.0,
+s1.ts
+#EXT-X-KEY:METHOD=AES-128,URI="%s",IV=0x0000000000000000000000000000abcd
+#EXTINF:4.0,
+s2.ts
+#EXTINF:4.0,
+s3.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4.0,
+s4.ts
+#EXT-X-ENDLIST
+`, dataKey(key1), dataKey(key2))
+
+	d, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := d.newJob(context.Background(), &counter{})
+	mpl, _, err := j.parseM3u8("http://example.com/index.m3u8", []byte(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ivs := []string{
+		hex.EncodeToString(decrypter.SequenceIV(4294967295)),
+		hex.EncodeToString(decrypter.SequenceIV(4294967296)),
+		"0000000000000000000000000000abcd",
+		"0000000000000000000000000000abcd",
+	}
+	keys := [][]byte{key1, key1, key2, key2, nil}
+	if n := len(mpl.GetAllSegments()); n != len(keys) {
+		t.Fatalf("%d segments, want %d", n, len(keys))
+	}
+	for i, segment := range mpl.GetAllSegments() {
+		if segment.SeqId != mpl.SeqNo+uint64(i) {
+			t.Fatalf("segment %d has sequence %d, want %d", i, segment.SeqId, mpl.SeqNo+uint64(i))
+		}
+		key, iv, err := j.getKey(segment.SeqId, segment.Key)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		if !bytes.Equal(key, keys[i]) {
+			t.Errorf("segment %d has key %x, want %x", i, key, keys[i])
+		}
+		if i < len(ivs) && hex.EncodeToString(iv) != ivs[i] {
+			t.Errorf("segment %d has iv %x, want %s", i, iv, ivs[i])
+		}
+		if i == len(ivs) && iv != nil {
+			t.Errorf("segment %d after METHOD=NONE has iv %x", i, iv)
+		}
+	}
+}
+
+func TestDataURIKey(t *testing.T) {
+	tests := []struct {
+		uri string
+		err bool
+	}{
+		{dataKey(bytes.Repeat([]byte{1}, 16)), false},
+		{"data:application/octet-stream,%01%02%03%04%05%06%07%08%09%0a%0b%0c%0d%0e%0f%10", false},
+		{dataKey(bytes.Repeat([]byte{1}, 15)), true},
+		{dataKey(bytes.Repeat([]byte{1}, 32)), true},
+		{"data:text/plain," + hex.EncodeToString(bytes.Repeat([]byte{1}, 16)), true},
+		{"data:text/plain;base64,AQID!", true},
+	}
+	for _, tt := range tests {
+		d, err := New(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j := d.newJob(context.Background(), &counter{})
+		key, _, err := j.getKey(0, &m3u8.Key{Method: "AES-128", URI: tt.uri})
+		j.stopRequests()
+		if (err != nil) != tt.err {
+			t.Errorf("%s: key %x, error %v", tt.uri, key, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/hackpool"
+)
+
+// startLive records a playlist without EXT-X-ENDLIST by reloading it and
+// queueing the segments that were not seen before, until the playlist ends,
+// MaxDuration is reached or the context is canceled.
+func (j *job) startLive(mediaURL string, mpl *m3u8.MediaPlaylist) {
+	j.progress(0, 0)
+
+	pool := hackpool.New(j.opts.Connections, j.download)
+
+	go func() {
+		defer pool.CloseQueue()
+
+		var (
+			id       int
+			period   int
+			nextSeq  uint64
+			started  bool
+			recorded time.Duration
+			last     *m3u8.Map
+			// failures counts the reloads failing in a row
+			failures int
+		)
+
+		for {
+			added := 0
+			for _, segment := range mpl.GetAllSegments() {
+				if started && segment.SeqId < nextSeq {
+					continue
+				}
+				if started && segment.SeqId > nextSeq {
+					j.logger.Println("[!]", segment.SeqId-nextSeq, "segments expired before they could be downloaded")
+				}
+
+				key, iv, err := j.segmentKey(segment)
+				if err != nil {
+					j.fail(err)
+					return
+				}
+
+				if started && segment.Discontinuity {
+					period++
+					j.discontinuity()
+				}
+				if mapChanged(segment, last) {
+					j.setPeriod(id, -1)
+					j.progress(0, 1)
+					j.pushMap(pool, segment.Map, id, segment.SeqId)
+					id++
+				}
+				last = segment.Map
+				j.setPeriod(id, period)
+				j.watch(id, segment)
+
+				j.progress(0, 1)
+				method := keyMethod(segment.Key)
+				pool.Push(segment.URI, segment.Offset, segment.Limit, j.callback(id, method, key, iv), int64(segment.SeqId), j.segmentKind(method, key))
+				id++
+				added++
+
+				started = true
+				nextSeq = segment.SeqId + 1
+				recorded += time.Duration(segment.Duration * float64(time.Second))
+				j.l.Lock()
+				j.duration = recorded
+				j.l.Unlock()
+				if j.opts.MaxDuration > 0 && recorded >= j.opts.MaxDuration {
+					return
+				}
+			}
+
+			if mpl.Closed || j.failed() {
+				return
+			}
+
+			// RFC 8216 6.3.4: wait one target duration after the playlist
+			// changed, half of it when it did not
+			wait := time.Duration(mpl.TargetDuration * float64(time.Second))
+			if wait <= 0 {
+				wait = time.Second * 2
+			}
+			if added == 0 {
+				wait /= 2
+			}
+
+			select {
+			case <-j.ctx.Done():
+				j.logger.Println("[!] Interrupted, waiting for the queued segments")
+				return
+			case <-time.After(wait):
+			}
+
+			newMpl, err := j.reload(mediaURL)
+			if err != nil {
+				// a playlist that expired or went offline ends the
+				// recording like EXT-X-ENDLIST, with the segments queued
+				failures++
+				if failures >= j.opts.Retry {
+					j.logger.Printf("[!] Reload playlist failed %d times in a row, stopping the recording: %v", failures, err)
+					return
+				}
+				j.logger.Println("[!] Reload playlist failed:", err)
+				continue
+			}
+			failures = 0
+			mpl = newMpl
+		}
+	}()
+
+	pool.Run()
+}
@@ -0,0 +1,25 @@
+package downloader
+
+func (j *job) setPeriod(id int, period int) {
+	j.l.Lock()
+	j.periods[id] = period
+	j.l.Unlock()
+}
+
+// period returns the discontinuity period of a block, see joiner.PeriodFunc.
+func (j *job) period(id int) int {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.periods[id]
+}
+
+// discontinuity warns once that the periods are concatenated as they are.
+func (j *job) discontinuity() {
+	j.l.Lock()
+	defer j.l.Unlock()
+	if j.warned || j.opts.MergeWithFFmpeg || j.opts.SplitPeriods || j.opts.Format != "" || j.opts.Joiner != nil {
+		return
+	}
+	j.warned = true
+	j.logger.Println("[!] The playlist has discontinuities, the timestamps of the out file jump at them")
+}
@@ -0,0 +1,280 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+)
+
+func formatURI(base string, uri string) (string, error) {
+	if strings.HasPrefix(uri, "http") || strings.HasPrefix(uri, "data:") {
+		return uri, nil
+	}
+
+	if base == "" {
+		return "", fmt.Errorf("base url must be set")
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	u, err = u.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+func filename(u string, u1 string) string {
+	obj, _ := url.Parse(u)
+	_, filename := filepath.Split(obj.Path)
+	if filename == "" {
+		filename = "index_" + time.Now().Format("20060102150405")
+	}
+	ext := filepath.Ext(filename)
+	lowerExt := strings.ToLower(ext)
+	if lowerExt == ".ts" || lowerExt == ".mp4" {
+		return filename
+	}
+	filename = strings.TrimSuffix(filename, ext)
+
+	o1, _ := url.Parse(u1)
+	_, f1 := filepath.Split(o1.Path)
+	ext = filepath.Ext(f1)
+	if ext == ".m4s" {
+		ext = ".mp4"
+	}
+
+	return filename + ext
+}
+
+var mapByteRange = regexp.MustCompile(`(BYTERANGE="?)(\d+)("|,|$)`)
+
+// normalizeByteRanges makes every byte range offset in a media playlist
+// explicit. A EXT-X-BYTERANGE without offset continues right after the range
+// of the previous segment when it is of the same resource, and starts at 0
+// otherwise, and a EXT-X-MAP range without offset starts at 0, none of
+// which the playlist parser knows about.
+func normalizeByteRanges(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	var next int64
+	var last string
+	// pending is the EXT-X-BYTERANGE line of the next segment
+	pending := -1
+	var limit, offset int64
+	var explicit bool
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			params := strings.SplitN(line[17:], "@", 2)
+			n, err := strconv.ParseInt(params[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			limit, explicit = n, len(params) == 2
+			if explicit {
+				offset, err = strconv.ParseInt(params[1], 10, 64)
+				if err != nil {
+					continue
+				}
+			}
+			pending = i
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			lines[i] = mapByteRange.ReplaceAllString(line, "${1}${2}@0${3}")
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if pending < 0 {
+				next = 0
+			} else {
+				if !explicit && line != last {
+					next = 0
+				}
+				if !explicit {
+					offset = next
+				}
+				lines[pending] = fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d", limit, offset)
+				next = offset + limit
+			}
+			last, pending = line, -1
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// parseM3u8 returns the media playlist and the url it was loaded from, which
+// differs from m3u8URL when a variant of a master playlist was selected.
+func (j *job) parseM3u8(m3u8URL string, data []byte) (*m3u8.MediaPlaylist, string, error) {
+	if data != nil {
+		playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(normalizeByteRanges(data)), true)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if listType == m3u8.MEDIA {
+			mpl := playlist.(*m3u8.MediaPlaylist)
+			err = resolveMedia(m3u8URL, mpl)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if j.opts.SkipAds {
+				j.detectAds(data, mpl)
+			}
+
+			return mpl, m3u8URL, nil
+			// Master Playlist
+		} else {
+			mpl := playlist.(*m3u8.MasterPlaylist)
+			variant, err := j.selectVariant(mpl)
+			if err != nil {
+				return nil, "", err
+			}
+
+			// the same variant on other hosts is used when this one fails
+			backups := backupVariants(mpl, variant)
+			var uris []string
+			for _, v := range append([]*m3u8.Variant{variant}, backups...) {
+				u, err := formatURI(m3u8URL, v.URI)
+				if err != nil {
+					return nil, "", fmt.Errorf("format uri failed: %w", err)
+				}
+				uris = append(uris, u)
+			}
+
+			resolved := map[*m3u8.Alternative]bool{}
+			for _, v := range append([]*m3u8.Variant{variant}, backups...) {
+				for _, alt := range renditions(mpl, v) {
+					if alt.URI == "" || resolved[alt] {
+						continue
+					}
+					resolved[alt] = true
+					alt.URI, err = formatURI(m3u8URL, alt.URI)
+					if err != nil {
+						return nil, "", fmt.Errorf("format uri failed: %w", err)
+					}
+				}
+			}
+
+			j.renditions = renditions(mpl, variant)
+			j.renditionBackups = map[*m3u8.Alternative][]string{}
+			for _, alt := range j.renditions {
+				j.renditionBackups[alt] = backupRenditions(mpl, backups, alt)
+			}
+
+			return j.parseRedundant(uris)
+		}
+	}
+
+	data, err := j.get(zhttp.Playlist, m3u8URL)
+	if err != nil {
+		return nil, "", err
+	}
+	return j.parseM3u8(m3u8URL, data)
+}
+
+// resolveMedia makes the uris of a media playlist absolute, and sets the key
+// and the init segment of every segment.
+func resolveMedia(m3u8URL string, mpl *m3u8.MediaPlaylist) error {
+	if mpl.Map != nil && mpl.Map.URI != "" {
+		uri, err := formatURI(m3u8URL, mpl.Map.URI)
+		if err != nil {
+			return fmt.Errorf("format uri failed: %w", err)
+		}
+		mpl.Map.URI = uri
+	}
+
+	if mpl.Key != nil && mpl.Key.URI != "" {
+		uri, err := formatURI(m3u8URL, mpl.Key.URI)
+		if err != nil {
+			return fmt.Errorf("format uri failed: %w", err)
+		}
+		mpl.Key.URI = uri
+	}
+
+	// EXT-X-KEY and EXT-X-MAP apply to every following segment until the next
+	// one, but the parser only attaches them to the first of them
+	key := mpl.Key
+	var m *m3u8.Map
+	for _, segment := range mpl.GetAllSegments() {
+		uri, err := formatURI(m3u8URL, segment.URI)
+		if err != nil {
+			return fmt.Errorf("format uri failed: %w", err)
+		}
+		segment.URI = uri
+
+		if segment.Key != nil {
+			key = segment.Key
+		} else {
+			segment.Key = key
+		}
+
+		if segment.Key != nil && segment.Key.URI != "" {
+			uri, err := formatURI(m3u8URL, segment.Key.URI)
+			if err != nil {
+				return fmt.Errorf("format uri failed: %w", err)
+			}
+			segment.Key.URI = uri
+		}
+
+		if segment.Map != nil {
+			m = segment.Map
+			if m.URI != "" {
+				uri, err := formatURI(m3u8URL, m.URI)
+				if err != nil {
+					return fmt.Errorf("format uri failed: %w", err)
+				}
+				m.URI = uri
+			}
+		} else {
+			segment.Map = m
+		}
+	}
+	return nil
+}
+
+// Variants returns the variants of the master playlist at url, except the
+// I-frame ones and the backups of another variant, with their audio and
+// subtitle renditions.
+func (d *Downloader) Variants(ctx context.Context, url string) ([]*m3u8.Variant, error) {
+	data := d.opts.Playlist
+	if data == nil {
+		j := &job{Downloader: d, ctx: ctx, reqCtx: ctx}
+		var err error
+		data, err = j.get(zhttp.Playlist, url)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(data), true)
+	if err != nil {
+		return nil, err
+	}
+
+	if listType == m3u8.MEDIA {
+		return nil, fmt.Errorf("resource is not a playlist")
+	}
+
+	mpl := playlist.(*m3u8.MasterPlaylist)
+	list := distinct(mpl)
+	alts := make([][]*m3u8.Alternative, len(list))
+	for i, v := range list {
+		alts[i] = renditions(mpl, v)
+	}
+	for i, v := range list {
+		v.Alternatives = alts[i]
+	}
+	return list, nil
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeByteRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"implicit after explicit",
+			[]string{"#EXT-X-BYTERANGE:100@50", "a.ts", "#EXT-X-BYTERANGE:200", "a.ts", "#EXT-X-BYTERANGE:300", "a.ts"},
+			[]string{"#EXT-X-BYTERANGE:100@50", "a.ts", "#EXT-X-BYTERANGE:200@150", "a.ts", "#EXT-X-BYTERANGE:300@350", "a.ts"}},
+		{"first implicit",
+			[]string{"#EXT-X-BYTERANGE:100", "a.ts", "#EXT-X-BYTERANGE:100", "a.ts"},
+			[]string{"#EXT-X-BYTERANGE:100@0", "a.ts", "#EXT-X-BYTERANGE:100@100", "a.ts"}},
+		{"new uri",
+			[]string{"#EXT-X-BYTERANGE:100@500", "a.ts", "#EXT-X-BYTERANGE:100", "b.ts", "#EXT-X-BYTERANGE:100", "b.ts"},
+			[]string{"#EXT-X-BYTERANGE:100@500", "a.ts", "#EXT-X-BYTERANGE:100@0", "b.ts", "#EXT-X-BYTERANGE:100@100", "b.ts"}},
+		{"whole segment between ranges",
+			[]string{"#EXT-X-BYTERANGE:100@500", "a.ts", "a.ts", "#EXT-X-BYTERANGE:100", "a.ts"},
+			[]string{"#EXT-X-BYTERANGE:100@500", "a.ts", "a.ts", "#EXT-X-BYTERANGE:100@0", "a.ts"}},
+		{"tags between range and uri",
+			[]string{"#EXT-X-BYTERANGE:100@0", "a.ts", "#EXTINF:4.0,", "#EXT-X-BYTERANGE:100", "#EXT-X-DISCONTINUITY", "a.ts"},
+			[]string{"#EXT-X-BYTERANGE:100@0", "a.ts", "#EXTINF:4.0,", "#EXT-X-BYTERANGE:100@100", "#EXT-X-DISCONTINUITY", "a.ts"}},
+		{"map without offset",
+			[]string{`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720"`, "#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=720", `#EXT-X-MAP:BYTERANGE="720",URI="init.mp4"`},
+			[]string{`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`, "#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=720@0", `#EXT-X-MAP:BYTERANGE="720@0",URI="init.mp4"`}},
+		{"map with offset",
+			[]string{`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@100"`},
+			[]string{`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@100"`}},
+	}
+	for _, tt := range tests {
+		got := string(normalizeByteRanges([]byte(strings.Join(tt.in, "\n"))))
+		if want := strings.Join(tt.want, "\n"); got != want {
+			t.Errorf("%s:\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/webvtt"
+)
+
+// renditions returns the audio and subtitle renditions of the groups of the
+// variant. The parser attaches the EXT-X-MEDIA tags written before an
+// EXT-X-I-FRAME-STREAM-INF to that I-frame variant only, so the renditions
+// of all the variants are searched.
+func renditions(mpl *m3u8.MasterPlaylist, variant *m3u8.Variant) []*m3u8.Alternative {
+	seen := map[*m3u8.Alternative]bool{}
+	var list []*m3u8.Alternative
+	for _, v := range mpl.Variants {
+		for _, alt := range v.Alternatives {
+			if alt == nil || seen[alt] {
+				continue
+			}
+			seen[alt] = true
+
+			if alt.Type == "AUDIO" && variant.Audio != "" && alt.GroupId == variant.Audio ||
+				alt.Type == "SUBTITLES" && variant.Subtitles != "" && alt.GroupId == variant.Subtitles {
+				list = append(list, alt)
+			}
+		}
+	}
+	return list
+}
+
+// selectRenditions returns the renditions to download with the variant.
+// Renditions without uri are carried by the variant itself.
+func (j *job) selectRenditions() ([]*m3u8.Alternative, error) {
+	var audio, subtitles []*m3u8.Alternative
+	for _, alt := range j.renditions {
+		if alt.Type == "AUDIO" {
+			audio = append(audio, alt)
+		} else {
+			subtitles = append(subtitles, alt)
+		}
+	}
+
+	list, err := selectAudio(audio, j.opts.AudioLang, j.opts.AudioName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !j.opts.NoSubtitles {
+		for _, alt := range subtitles {
+			if len(j.opts.SubtitleLang) == 0 || matchAnyLanguage(alt.Language, j.opts.SubtitleLang) {
+				list = append(list, alt)
+			}
+		}
+	}
+
+	var selected []*m3u8.Alternative
+	for _, alt := range list {
+		if alt.URI != "" {
+			selected = append(selected, alt)
+		}
+	}
+	return selected, nil
+}
+
+func selectAudio(audio []*m3u8.Alternative, langs []string, name string) ([]*m3u8.Alternative, error) {
+	if len(audio) == 0 {
+		return nil, nil
+	}
+
+	var list []*m3u8.Alternative
+	add := func(alt *m3u8.Alternative) {
+		for _, a := range list {
+			if a == alt {
+				return
+			}
+		}
+		list = append(list, alt)
+	}
+
+	for _, lang := range langs {
+		if strings.EqualFold(lang, "all") {
+			return audio, nil
+		}
+
+		var found bool
+		for _, alt := range audio {
+			if matchLanguage(alt.Language, lang) {
+				add(alt)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("audio language %s not found", lang)
+		}
+	}
+
+	if name != "" {
+		var found bool
+		for _, alt := range audio {
+			if strings.EqualFold(alt.Name, name) {
+				add(alt)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("audio name %s not found", name)
+		}
+	}
+
+	if len(list) > 0 {
+		return list, nil
+	}
+
+	for _, alt := range audio {
+		if alt.Default {
+			return []*m3u8.Alternative{alt}, nil
+		}
+	}
+	return audio[:1], nil
+}
+
+// matchLanguage reports whether the language tag is lang or a subtag of it,
+// so that "en" matches "en-US".
+func matchLanguage(tag string, lang string) bool {
+	tag, lang = strings.ToLower(tag), strings.ToLower(lang)
+	return tag == lang || strings.HasPrefix(tag, lang+"-")
+}
+
+func matchAnyLanguage(tag string, langs []string) bool {
+	for _, lang := range langs {
+		if matchLanguage(tag, lang) {
+			return true
+		}
+	}
+	return false
+}
+
+var unsafeChars = regexp.MustCompile(`[^\w-]+`)
+
+// trackName names a rendition in the name of its file.
+func trackName(alt *m3u8.Alternative) string {
+	name := alt.Language
+	if name == "" {
+		name = alt.Name
+	}
+	name = strings.Trim(unsafeChars.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = strings.ToLower(alt.Type)
+	}
+	return name
+}
+
+// trackFile names the file of a rendition after the out file of the variant.
+func trackFile(outFile string, name string, ext string) string {
+	return strings.TrimSuffix(outFile, filepath.Ext(outFile)) + "." + name + ext
+}
+
+// trackExt returns the extension of the file of an audio rendition, from its
+// segments.
+func trackExt(first string) string {
+	ext := ".ts"
+	obj, err := url.Parse(first)
+	if err == nil && path.Ext(obj.Path) != "" {
+		ext = strings.ToLower(path.Ext(obj.Path))
+	}
+	if ext == ".m4s" {
+		ext = ".m4a"
+	}
+	return ext
+}
+
+// trackGroup is the download of the renditions of a variant.
+type trackGroup struct {
+	tracks  []Track
+	names   []string
+	results []Result
+	errs    []error
+	wg      sync.WaitGroup
+	stop    context.CancelFunc
+}
+
+// videoStart is the presentation time of the start of the variant, which
+// the cues of its subtitle renditions are timed from. It is measured on the
+// first segment, when it is MPEG-TS and downloaded by this run.
+type videoStart struct {
+	once sync.Once
+	done chan struct{}
+	pts  int64
+	ok   bool
+	// offset is where the out file starts in the playlist, skip how much
+	// of the first segment is trimmed
+	offset time.Duration
+	skip   time.Duration
+}
+
+func newVideoStart(offset, skip time.Duration) *videoStart {
+	return &videoStart{done: make(chan struct{}), offset: offset, skip: skip}
+}
+
+// set records the start, ok being false when it is not known. Only the
+// first call counts.
+func (s *videoStart) set(pts int64, ok bool) {
+	s.once.Do(func() {
+		s.pts, s.ok = pts, ok
+		close(s.done)
+	})
+}
+
+// pending reports whether the start is still to be measured.
+func (s *videoStart) pending() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait returns the start once it is set, or not ok when ctx is done first.
+func (s *videoStart) wait(ctx context.Context) (int64, bool) {
+	select {
+	case <-s.done:
+		return s.pts, s.ok
+	case <-ctx.Done():
+		return 0, false
+	}
+}
+
+// measureStart returns the start of the variant to measure for its subtitle
+// renditions. It is not measured on fMP4 segments, nor when the first
+// segment was saved by a previous run.
+func (j *job) measureStart() *videoStart {
+	var offset, skip time.Duration
+	if j.clipped != nil {
+		offset = j.clipped.offset
+		if j.opts.Clip.Precise && j.opts.Joiner == nil {
+			skip = j.clipped.from - j.clipped.offset
+		}
+	}
+	s := newVideoStart(offset, skip)
+	if j.fmp4 || j.finished(0) {
+		s.set(0, false)
+	}
+	return s
+}
+
+func hasSubtitles(alts []*m3u8.Alternative) bool {
+	for _, alt := range alts {
+		if alt.Type == "SUBTITLES" {
+			return true
+		}
+	}
+	return false
+}
+
+// timeline times the cues of a subtitle rendition on the time line of the
+// out file of the variant.
+func (j *job) timeline(m *webvtt.Merger) {
+	s := j.variantStart
+	m.SetStart(s.offset + s.skip)
+	if pts, ok := s.wait(j.ctx); ok {
+		m.SetBase(pts + int64(s.skip)*tsClock/int64(time.Second))
+	}
+}
+
+// startTracks downloads the renditions in parallel with the variant, one
+// job each, sharing the progress of the variant.
+func (j *job) startTracks(alts []*m3u8.Alternative, outFile string) *trackGroup {
+	ctx, stop := context.WithCancel(j.ctx)
+	g := &trackGroup{
+		tracks:  make([]Track, len(alts)),
+		names:   make([]string, len(alts)),
+		results: make([]Result, len(alts)),
+		errs:    make([]error, len(alts)),
+		stop:    stop,
+	}
+
+	names := map[string]int{}
+	for i, alt := range alts {
+		// the extension differs between audio and subtitles
+		name := trackName(alt)
+		names[alt.Type+name]++
+		if n := names[alt.Type+name]; n > 1 {
+			name += "_" + strconv.Itoa(n)
+		}
+
+		opts := j.opts
+		opts.OutFile = outFile
+		opts.Playlist = nil
+		opts.Joiner = nil
+		opts.MergeWithFFmpeg = false
+		opts.Format = ""
+		if j.clipped != nil {
+			opts.Clip = Clip{Start: j.clipped.from, End: j.clipped.to, Precise: j.opts.Clip.Precise}
+		}
+
+		d := &Downloader{opts: opts, http: j.http, logger: j.logger}
+		sub := d.newJob(ctx, j.counter)
+		sub.track = name
+		sub.trackType = alt.Type
+		sub.alternates = j.renditionBackups[alt]
+		sub.variantStart = j.start
+
+		g.tracks[i] = Track{Type: alt.Type, Language: alt.Language, Name: alt.Name}
+		g.names[i] = name
+		g.wg.Add(1)
+		go func(i int, uri string) {
+			defer g.wg.Done()
+			g.results[i], g.errs[i] = sub.run(uri)
+			if g.errs[i] != nil {
+				stop()
+			}
+		}(i, alt.URI)
+	}
+	return g
+}
+
+func (g *trackGroup) cancel() {
+	g.stop()
+}
+
+// wait returns the saved renditions, or the first error of their downloads.
+func (g *trackGroup) wait() ([]Track, error) {
+	g.wg.Wait()
+	g.stop()
+
+	for i, err := range g.errs {
+		if err != nil {
+			return nil, fmt.Errorf("download %s rendition %s error: %w", strings.ToLower(g.tracks[i].Type), g.names[i], err)
+		}
+	}
+
+	var tracks []Track
+	for i, t := range g.tracks {
+		if g.results[i].OutFile == "" {
+			continue
+		}
+		t.OutFile = g.results[i].OutFile
+		t.Periods = g.results[i].Periods
+		t.Health = g.results[i].Health
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
+
+// muxTracks muxes the renditions into the out file when merging with
+// ffmpeg, and returns the ones left next to it. Subtitles can not be muxed
+// into MPEG-TS.
+func (j *job) muxTracks(outFile string, tracks []Track) ([]Track, error) {
+	if !j.opts.MergeWithFFmpeg || len(tracks) == 0 {
+		return tracks, nil
+	}
+
+	var subtitleCodec string
+	muxSubtitles := true
+	switch strings.ToLower(filepath.Ext(outFile)) {
+	case ".mp4", ".m4v", ".mov":
+		subtitleCodec = "mov_text"
+	case ".mkv":
+	default:
+		muxSubtitles = false
+	}
+
+	var files []string
+	var left []Track
+	for _, t := range tracks {
+		if t.Type == "SUBTITLES" && !muxSubtitles {
+			left = append(left, t)
+			continue
+		}
+		files = append(files, t.OutFile)
+	}
+	if len(files) == 0 {
+		return left, nil
+	}
+
+	err := joiner.Mux(j.opts.FFmpeg, outFile, files, subtitleCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return left, nil
+}
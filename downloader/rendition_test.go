@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSubtitleTimeline times the cues of a subtitle rendition from the start
+// of the video, which starts 2 seconds after the MPEGTS time of the
+// subtitles.
+func TestSubtitleTimeline(t *testing.T) {
+	files := map[string]string{
+		"/master.m3u8": `#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="subs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,SUBTITLES="subs"
+video.m3u8
+`,
+		"/video.m3u8": "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\nv0.ts\n#EXTINF:4.0,\nv1.ts\n#EXTINF:4.0,\nv2.ts\n#EXT-X-ENDLIST\n",
+		"/subs.m3u8":  "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\ns0.vtt\n#EXTINF:4.0,\ns1.vtt\n#EXTINF:4.0,\ns2.vtt\n#EXT-X-ENDLIST\n",
+	}
+	for i, text := range []string{"one", "two", "three"} {
+		files[fmt.Sprintf("/v%d.ts", i)] = string(videoSegment(int64(900000+(2+4*i)*90000), 36000, 10).Bytes())
+		files[fmt.Sprintf("/s%d.vtt", i)] = fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:%02d.000 --> 00:00:%02d.000\n%s\n", 3+3*i, 4+3*i, text)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch filepath.Ext(r.URL.Path) {
+		case ".ts":
+			w.Header().Set("Content-Type", "video/mp2t")
+		case ".vtt":
+			w.Header().Set("Content-Type", "text/vtt")
+		default:
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		}
+		w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		clip Clip
+		want string
+	}{
+		{"whole", Clip{}, "00:00:01.000 --> 00:00:02.000\none\n\n00:00:04.000 --> 00:00:05.000\ntwo\n\n00:00:07.000 --> 00:00:08.000\nthree\n\n"},
+		// the out file starts with the second segment
+		{"clipped", Clip{Start: 5 * time.Second}, "00:00:00.000 --> 00:00:01.000\ntwo\n\n00:00:03.000 --> 00:00:04.000\nthree\n\n"},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "out.ts")
+		d, err := New(Options{OutFile: out, Clip: tt.clip, SubtitleFormat: "vtt", Connections: 2, Retry: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := d.Download(context.Background(), srv.URL+"/master.m3u8")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(result.Tracks) != 1 {
+			t.Fatalf("%s: %d tracks", tt.name, len(result.Tracks))
+		}
+		data, err := os.ReadFile(result.Tracks[0].OutFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimPrefix(string(data), "WEBVTT\n\n"); got != tt.want {
+			t.Errorf("%s: cues\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
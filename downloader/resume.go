@@ -0,0 +1,169 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/journal"
+)
+
+// fingerprint identifies the segment list of a playlist. Query strings are
+// ignored because they often carry short-lived tokens.
+func fingerprint(mpl *m3u8.MediaPlaylist) string {
+	h := sha256.New()
+	var last *m3u8.Map
+	for _, segment := range mpl.GetAllSegments() {
+		if mapChanged(segment, last) {
+			fmt.Fprintf(h, "map %s %d@%d\n", stripQuery(segment.Map.URI), segment.Map.Limit, segment.Map.Offset)
+		}
+		last = segment.Map
+		fmt.Fprintf(h, "%s %d@%d %f\n", stripQuery(segment.URI), segment.Limit, segment.Offset, segment.Duration)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func stripQuery(u string) string {
+	obj, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	obj.RawQuery = ""
+	obj.Fragment = ""
+	return obj.String()
+}
+
+func (j *job) openJournal(outFile string, mpl *m3u8.MediaPlaylist) (*journal.Journal, error) {
+	path := outFile + ".journal"
+	fp := fingerprint(mpl)
+
+	if !j.opts.Resume {
+		return journal.Create(path, fp)
+	}
+
+	jn, err := journal.Open(path, fp)
+	if errors.Is(err, journal.ErrMismatch) {
+		j.logger.Println("[!] Playlist has changed since the journal was written, restarting")
+		return journal.Create(path, fp)
+	}
+	return jn, err
+}
+
+func (j *job) newJoiner(outFile string) (joiner.Joiner, error) {
+	if j.opts.Joiner != nil {
+		return j.opts.Joiner, nil
+	}
+
+	if j.trackType == "SUBTITLES" {
+		sj, err := joiner.NewSubtitle(outFile, j.opts.SubtitleFormat)
+		if err != nil {
+			return nil, err
+		}
+		if j.variantStart != nil {
+			sj.SetTimeline(j.timeline)
+		}
+		return sj, nil
+	}
+
+	if j.remux {
+		mj, err := joiner.NewMP4(outFile, j.opts.Format == "fmp4")
+		if err != nil {
+			return nil, err
+		}
+		mj.SetPeriods(j.period)
+		return mj, nil
+	}
+
+	if j.opts.Format != "" {
+		fj, err := joiner.NewFMP4(outFile)
+		if err != nil {
+			return nil, err
+		}
+		fj.SetPeriods(j.period)
+		return fj, nil
+	}
+
+	if j.opts.MergeWithFFmpeg {
+		// the blocks go to a temporary directory, moved to the one of the
+		// out file when the download is interrupted, unless it is resumed
+		if !j.opts.Resume {
+			fj, err := joiner.NewFFmepg(j.opts.FFmpeg, outFile)
+			if err != nil {
+				return nil, err
+			}
+			if j.journal != nil {
+				fj.SetCommit(j.journal.Add)
+			}
+			fj.SetPeriods(j.period)
+			return fj, nil
+		}
+
+		sizes := map[int]int64{}
+		for _, e := range j.journal.Entries() {
+			sizes[e.ID] = e.Size
+		}
+
+		fj, err := joiner.ResumeFFmepg(j.opts.FFmpeg, outFile, sizes)
+		if err != nil {
+			return nil, err
+		}
+
+		err = j.journal.Retain(func(e journal.Entry) bool {
+			return fj.Has(e.ID)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		fj.SetCommit(j.journal.Add)
+		fj.SetPeriods(j.period)
+		return fj, nil
+	}
+
+	if j.journal == nil {
+		mj, err := joiner.NewMem(outFile)
+		if err != nil {
+			return nil, err
+		}
+		if j.opts.SplitPeriods {
+			mj.SetPeriods(j.period)
+		}
+		return mj, nil
+	}
+
+	var size int64
+	info, err := os.Stat(outFile)
+	if err == nil {
+		size = info.Size()
+	}
+
+	// only the contiguous prefix that is really on disk can be kept
+	index, offset := 0, int64(0)
+	for _, e := range j.journal.Entries() {
+		if e.ID != index || e.Offset != offset || offset+e.Size > size {
+			break
+		}
+		index++
+		offset += e.Size
+	}
+
+	err = j.journal.Retain(func(e journal.Entry) bool {
+		return e.ID < index
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mj, err := joiner.ResumeMem(outFile, index, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	mj.SetCommit(j.journal.Add)
+	return mj, nil
+}
@@ -0,0 +1,57 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestResumable returns ErrResumable from an interrupted download only when
+// its journal is kept.
+func TestResumable(t *testing.T) {
+	playlist := []byte(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+http://127.0.0.1:1/s0.ts
+#EXTINF:4.0,
+http://127.0.0.1:1/s1.ts
+#EXT-X-ENDLIST
+`)
+	tests := []struct {
+		name      string
+		opts      Options
+		resumable bool
+	}{
+		{"ts", Options{}, true},
+		{"format", Options{Format: "mp4"}, false},
+		{"split periods", Options{SplitPeriods: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := tt.opts
+			opts.Playlist = playlist
+			opts.OutFile = filepath.Join(dir, "out.ts")
+			d, err := New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err = d.Download(ctx, "http://example.com/index.m3u8")
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("error %v, want an interrupted download", err)
+			}
+			if errors.Is(err, ErrResumable) != tt.resumable {
+				t.Errorf("error %q, resumable %v", err, tt.resumable)
+			}
+			_, err = os.Stat(opts.OutFile + ".journal")
+			if exists := err == nil; exists != tt.resumable {
+				t.Errorf("journal exists %v, want %v", exists, tt.resumable)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// VariantSelector selects the variant of a master playlist. The variants out
+// of the limits are left out, unless none is within them, in which case the
+// closest one is selected.
+type VariantSelector struct {
+	// Resolution prefers the variant of that resolution, or the closest one.
+	Resolution   string
+	MinHeight    int
+	MaxHeight    int
+	MinBandwidth int64
+	MaxBandwidth int64
+	MinFrameRate float64
+	MaxFrameRate float64
+	// Codecs are the preferred video codecs, the first one first. Example:
+	// hvc1, avc1, av01.
+	Codecs []string
+	// VideoRanges are the accepted VIDEO-RANGE values, SDR, PQ or HLG.
+	VideoRanges []string
+}
+
+// ParseSelector parses a selection expression of comma separated conditions
+// on the height, bandwidth, fps, codec, range and resolution of the
+// variants. Example: height<=1080,bandwidth<5M,codec=hvc1|avc1,range=PQ
+func ParseSelector(expr string) (VariantSelector, error) {
+	var s VariantSelector
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		i := strings.IndexAny(term, "<>=~")
+		if i <= 0 {
+			return s, fmt.Errorf("invalid condition %q", term)
+		}
+		key := strings.ToLower(strings.TrimSpace(term[:i]))
+		op := term[i : i+1]
+		value := term[i+1:]
+		if value != "" && value[0] == '=' && op != "=" {
+			op += "="
+			value = value[1:]
+		}
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "height", "h":
+			var n int
+			n, err = strconv.Atoi(value)
+			if err == nil {
+				err = narrow(&s.MinHeight, &s.MaxHeight, op, n)
+			}
+		case "bandwidth", "bw":
+			var n int64
+			n, err = ParseBandwidth(value)
+			if err == nil {
+				err = narrow(&s.MinBandwidth, &s.MaxBandwidth, op, n)
+			}
+		case "fps", "frame-rate", "framerate":
+			var f float64
+			f, err = strconv.ParseFloat(value, 64)
+			if err == nil {
+				// the strict limits are the closest frame rates, like narrow
+				// does for the integers
+				switch op {
+				case "<":
+					s.MaxFrameRate = math.Nextafter(f, 0)
+				case "<=":
+					s.MaxFrameRate = f
+				case ">":
+					s.MinFrameRate = math.Nextafter(f, math.Inf(1))
+				case ">=":
+					s.MinFrameRate = f
+				default:
+					s.MinFrameRate, s.MaxFrameRate = f, f
+				}
+				if op[0] != '>' && f <= 0 {
+					err = errNoVariant
+				}
+			}
+		case "codec", "codecs":
+			s.Codecs = append(s.Codecs, strings.Split(value, "|")...)
+		case "range", "video-range":
+			s.VideoRanges = append(s.VideoRanges, strings.Split(strings.ToUpper(value), "|")...)
+		case "resolution", "res":
+			s.Resolution = value
+			w, h := parseResolution(value)
+			if w == 0 || h == 0 {
+				err = fmt.Errorf("invalid resolution %s", value)
+			} else if op != "=" && op != "~" {
+				err = narrow(&s.MinHeight, &s.MaxHeight, op, int(h))
+			}
+		default:
+			return s, fmt.Errorf("unknown variant attribute %s", key)
+		}
+		if err != nil {
+			return s, fmt.Errorf("invalid condition %q: %w", term, err)
+		}
+	}
+	return s, nil
+}
+
+var errNoVariant = errors.New("no variant can match")
+
+// narrow applies the condition to the limits, 0 meaning no limit.
+func narrow[T int | int64](min, max *T, op string, n T) error {
+	lo, hi := n, n
+	switch op {
+	case "<":
+		lo, hi = 0, n-1
+	case "<=":
+		lo = 0
+	case ">":
+		lo, hi = n+1, 0
+	case ">=":
+		hi = 0
+	}
+	// an upper limit of 0 or less would read as no limit
+	if op[0] != '>' && hi <= 0 {
+		return errNoVariant
+	}
+
+	if lo > *min {
+		*min = lo
+	}
+	if hi != 0 && (*max == 0 || hi < *max) {
+		*max = hi
+	}
+	return nil
+}
+
+// ParseBandwidth parses a number of bits per second, with an optional k, M or
+// G suffix.
+func ParseBandwidth(s string) (int64, error) {
+	mult := 1.0
+	switch strings.ToUpper(s[max(len(s)-1, 0):]) {
+	case "K":
+		mult = 1e3
+	case "M":
+		mult = 1e6
+	case "G":
+		mult = 1e9
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %s", s)
+	}
+	return int64(f * mult), nil
+}
+
+// codecFamily groups the sample entry names of the same video codec.
+func codecFamily(codec string) string {
+	codec = strings.ToLower(strings.TrimSpace(codec))
+	if i := strings.IndexByte(codec, '.'); i >= 0 {
+		codec = codec[:i]
+	}
+	switch codec {
+	case "avc1", "avc3", "avc", "h264":
+		return "avc"
+	case "hvc1", "hev1", "hevc", "h265":
+		return "hevc"
+	case "dvh1", "dvhe", "dolby-vision", "dv":
+		return "dv"
+	case "av01", "av1":
+		return "av1"
+	case "vp09", "vp9":
+		return "vp9"
+	}
+	return codec
+}
+
+// codecRank returns the index of the first preferred codec the variant has,
+// or the number of preferred codecs if it has none of them.
+func codecRank(v *m3u8.Variant, codecs []string) int {
+	var families []string
+	for _, c := range strings.Split(v.Codecs, ",") {
+		families = append(families, codecFamily(c))
+	}
+	for i, codec := range codecs {
+		for _, family := range families {
+			if family == codecFamily(codec) {
+				return i
+			}
+		}
+	}
+	return len(codecs)
+}
+
+func videoRange(v *m3u8.Variant) string {
+	if v.VideoRange == "" {
+		return "SDR"
+	}
+	return strings.ToUpper(v.VideoRange)
+}
+
+// distance measures how far the variant is from the limits of the selector,
+// 0 if it is within them.
+func (s *VariantSelector) distance(v *m3u8.Variant) float64 {
+	var d float64
+	out := func(value, min, max float64) {
+		if min > 0 && value < min {
+			d += (min - value) / min
+		}
+		if max > 0 && value > max {
+			d += (value - max) / max
+		}
+	}
+
+	_, height := parseResolution(v.Resolution)
+	if height > 0 {
+		out(float64(height), float64(s.MinHeight), float64(s.MaxHeight))
+	}
+	out(float64(v.Bandwidth), float64(s.MinBandwidth), float64(s.MaxBandwidth))
+	if v.FrameRate > 0 {
+		out(v.FrameRate, s.MinFrameRate, s.MaxFrameRate)
+	}
+
+	if len(s.VideoRanges) > 0 {
+		found := false
+		for _, r := range s.VideoRanges {
+			if r == videoRange(v) {
+				found = true
+			}
+		}
+		if !found {
+			d++
+		}
+	}
+	return d
+}
+
+// resolutionDistance is how far the resolution of the variant is from the
+// preferred one, in pixels of width and height.
+func (s *VariantSelector) resolutionDistance(v *m3u8.Variant) float64 {
+	if s.Resolution == "" {
+		return 0
+	}
+	w, h := parseResolution(s.Resolution)
+	vw, vh := parseResolution(v.Resolution)
+	if vw == 0 || vh == 0 {
+		return math.Inf(1)
+	}
+	return math.Abs(float64(w)-float64(vw)) + math.Abs(float64(h)-float64(vh))
+}
+
+// sort orders the variants from the most to the least preferred: by
+// distance to the limits, preferred codec, distance to the preferred
+// resolution, then by resolution and bandwidth.
+func (s *VariantSelector) sort(variants []*m3u8.Variant) {
+	sort.SliceStable(variants, func(i, j int) bool {
+		vi, vj := variants[i], variants[j]
+
+		if di, dj := s.distance(vi), s.distance(vj); di != dj {
+			return di < dj
+		}
+		if ri, rj := codecRank(vi, s.Codecs), codecRank(vj, s.Codecs); ri != rj {
+			return ri < rj
+		}
+		if di, dj := s.resolutionDistance(vi), s.resolutionDistance(vj); di != dj {
+			return di < dj
+		}
+
+		if vi.Resolution != "" && vj.Resolution != "" {
+			widthi, heighti := parseResolution(vi.Resolution)
+			widthj, heightj := parseResolution(vj.Resolution)
+			if widthi*heighti != widthj*heightj {
+				return widthi*heighti > widthj*heightj
+			}
+		}
+		return vi.Bandwidth > vj.Bandwidth
+	})
+}
+
+// selectVariant returns the variant to download among the distinct variants
+// of the playlist. When the PickVariant option is set, it picks one of the
+// variants within the limits.
+func (j *job) selectVariant(mpl *m3u8.MasterPlaylist) (*m3u8.Variant, error) {
+	list := distinct(mpl)
+	if len(list) == 0 {
+		return nil, fmt.Errorf("variants not found")
+	}
+
+	s := &j.opts.Selector
+	s.sort(list)
+
+	// the variants within the limits, or all of them if none is
+	candidates := list
+	for i, v := range list {
+		if s.distance(v) > 0 {
+			if i > 0 {
+				candidates = list[:i]
+			}
+			break
+		}
+	}
+
+	if j.opts.PickVariant != nil && len(candidates) > 1 {
+		return j.opts.PickVariant(candidates)
+	}
+
+	if s.distance(list[0]) > 0 {
+		j.logger.Println("[!] No variant matches the selection, using the closest one")
+	} else if s.Resolution != "" && s.resolutionDistance(list[0]) > 0 {
+		j.logger.Println("[!] Resolution", s.Resolution, "not found, using the closest one")
+	}
+	return list[0], nil
+}
+
+func parseResolution(resolution string) (uint64, uint64) {
+	arr := strings.Split(resolution, "x")
+	if len(arr) != 2 {
+		return 0, 0
+	}
+	width, err := strconv.ParseUint(arr[0], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	height, err := strconv.ParseUint(arr[1], 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	return width, height
+}
@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestSelectorFrameRate(t *testing.T) {
+	tests := []struct {
+		expr string
+		fps  float64
+		want bool
+	}{
+		{"fps<30", 30, false},
+		{"fps<30", 29.97, true},
+		{"fps<=30", 30, true},
+		{"fps>30", 30, false},
+		{"fps>30", 50, true},
+		{"fps>=30", 30, true},
+		{"fps=25", 25, true},
+		{"fps=25", 30, false},
+	}
+	for _, tt := range tests {
+		s, err := ParseSelector(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseSelector(%s): %v", tt.expr, err)
+		}
+		v := &m3u8.Variant{VariantParams: m3u8.VariantParams{FrameRate: tt.fps, Bandwidth: 1000000}}
+		if got := s.distance(v) == 0; got != tt.want {
+			t.Errorf("%s with %v fps: within the limits = %v, want %v", tt.expr, tt.fps, got, tt.want)
+		}
+	}
+}
+
+func TestSelectorEmptyRange(t *testing.T) {
+	for _, expr := range []string{"bw<1", "bandwidth<=0", "height<1", "h=0", "fps<0", "fps<=0", "fps=0", "res<1x1"} {
+		if _, err := ParseSelector(expr); !errors.Is(err, errNoVariant) {
+			t.Errorf("ParseSelector(%s) = %v, want %v", expr, err, errNoVariant)
+		}
+	}
+	for _, expr := range []string{"bw<2", "height<2", "fps<0.5", "fps>0", "bw>=0"} {
+		if _, err := ParseSelector(expr); err != nil {
+			t.Errorf("ParseSelector(%s): %v", expr, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/mp4"
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+// SegmentHealth is the result of the checks of a segment, with Verify.
+type SegmentHealth struct {
+	Sequence uint64
+	URI      string
+	// Duration is the one of #EXTINF, Measured the one of the timestamps of
+	// the segment, 0 when it could not be measured.
+	Duration time.Duration
+	Measured time.Duration
+	// Refetched is the number of times the segment was downloaded again.
+	Refetched int
+	// Problems are the checks that failed, on the last download.
+	Problems []string
+
+	id            int
+	discontinuity bool
+	// first is the first timestamp of the main stream, end where its last
+	// sample ends, in 90kHz units
+	kind       string
+	first, end int64
+	timed      bool
+}
+
+func (h SegmentHealth) OK() bool {
+	return len(h.Problems) == 0
+}
+
+const (
+	// verifyAttempts is how many times a segment failing the checks is
+	// downloaded before it is kept as it is
+	verifyAttempts = 3
+	// tsClock is the rate of the MPEG-TS timestamps, tsWrap where they wrap
+	// around
+	tsClock = 90000
+	tsWrap  = 1 << 33
+	// maxJump is the largest gap between the timestamps of two segments
+	// that is not reported
+	maxJump = tsClock / 2
+)
+
+// errRefetch is returned by the callback of a segment failing the checks, to
+// download it again.
+var errRefetch = errors.New("segment failed the checks")
+
+// segmentCheck measures a segment while it is downloaded. The MPEG-TS
+// segments are demuxed, the fMP4 ones kept in memory to be parsed, counted
+// by the spool until release is called.
+type segmentCheck struct {
+	size    int64
+	head    []byte
+	fmp4    *bytes.Buffer
+	spool   *joiner.Spool
+	demuxer *ts.Demuxer
+	streams map[int]*streamTimes
+}
+
+// streamTimes are the timestamps of the PES packets of a stream, unwrapped
+// from the first one.
+type streamTimes struct {
+	kind     string
+	first    int64
+	min, max int64
+	count    int
+}
+
+func newSegmentCheck(fmp4 bool, spool *joiner.Spool) *segmentCheck {
+	c := &segmentCheck{streams: map[int]*streamTimes{}, spool: spool}
+	if fmp4 {
+		c.fmp4 = &bytes.Buffer{}
+	} else {
+		c.demuxer = ts.NewDemuxer(c.pes)
+	}
+	return c
+}
+
+func (c *segmentCheck) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	if n := 512 - len(c.head); n > 0 {
+		c.head = append(c.head, p[:min(n, len(p))]...)
+	}
+	if c.fmp4 != nil {
+		c.spool.Hold(int64(len(p)))
+		return c.fmp4.Write(p)
+	}
+	return c.demuxer.Write(p)
+}
+
+func (c *segmentCheck) release() {
+	if c.fmp4 != nil {
+		c.spool.Release(int64(c.fmp4.Len()))
+		c.fmp4 = nil
+	}
+}
+
+func (c *segmentCheck) pes(pes *ts.PES) error {
+	kind := ts.Stream{Type: pes.StreamType}.Kind()
+	if pes.PTS < 0 || kind != "video" && kind != "audio" {
+		return nil
+	}
+
+	s := c.streams[pes.PID]
+	if s == nil {
+		c.streams[pes.PID] = &streamTimes{kind: kind, first: pes.PTS, count: 1}
+		return nil
+	}
+	v := unwrap(pes.PTS - s.first)
+	s.min = min(s.min, v)
+	s.max = max(s.max, v)
+	s.count++
+	return nil
+}
+
+// unwrap returns a difference of MPEG-TS timestamps between -2^32 and 2^32.
+func unwrap(d int64) int64 {
+	d %= tsWrap
+	if d >= tsWrap/2 {
+		d -= tsWrap
+	} else if d < -tsWrap/2 {
+		d += tsWrap
+	}
+	return d
+}
+
+// packedAudio reports whether the segment is an audio elementary stream,
+// starting with an ID3 tag or the sync word of an AAC, MP3 or AC-3 frame.
+func packedAudio(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("ID3")) ||
+		len(head) >= 2 && (head[0] == 0xff && head[1]&0xe0 == 0xe0 || head[0] == 0x0b && head[1] == 0x77)
+}
+
+// result checks the segment. The main stream, the video or the first audio
+// stream, gives the duration.
+func (c *segmentCheck) result(h *SegmentHealth) {
+	h.Problems = nil
+	h.Measured = 0
+	h.timed = false
+
+	switch {
+	case c.size == 0:
+		h.Problems = append(h.Problems, "empty")
+		return
+	case c.fmp4 != nil:
+		boxes, err := mp4.Parse(c.fmp4.Bytes())
+		if err != nil {
+			h.Problems = append(h.Problems, "invalid MP4 boxes: "+err.Error())
+		} else if mp4.Find(boxes, "moof") == nil || mp4.Find(boxes, "mdat") == nil {
+			h.Problems = append(h.Problems, "no moof and mdat boxes")
+		}
+		return
+	case packedAudio(c.head):
+		return
+	case c.head[0] != 0x47:
+		h.Problems = append(h.Problems, "not MPEG-TS, starts with "+preview(c.head))
+		return
+	}
+
+	c.demuxer.Flush()
+	stats := c.demuxer.Stats()
+	if c.size%int64(ts.PacketLength) != 0 || stats.Skipped > 0 {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d bytes out of the %d byte packets", stats.Skipped, ts.PacketLength))
+	}
+	if n := len(stats.ContinuityErrors); n > 0 {
+		h.Problems = append(h.Problems, fmt.Sprintf("%d continuity errors, first %s", n, stats.ContinuityErrors[0]))
+	}
+
+	var main *streamTimes
+	for _, pid := range sortedPIDs(c.streams) {
+		s := c.streams[pid]
+		if main == nil || s.kind == "video" && main.kind != "video" {
+			main = s
+		}
+	}
+	if main == nil {
+		h.Problems = append(h.Problems, "no audio or video")
+		return
+	}
+
+	// the last sample lasts as long as the average one
+	span := main.max - main.min
+	if main.count > 1 {
+		span += span / int64(main.count-1)
+	}
+	h.Measured = time.Duration(span) * time.Second / tsClock
+	h.kind = main.kind
+	h.first = main.first + main.min
+	h.end = h.first + span
+	h.timed = true
+
+	if main.count > 1 {
+		diff := h.Measured - h.Duration
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > max(time.Second/2, h.Duration/10) {
+			h.Problems = append(h.Problems, fmt.Sprintf("lasts %s, #EXTINF says %s", h.Measured.Round(time.Millisecond), h.Duration.Round(time.Millisecond)))
+		}
+	}
+}
+
+func sortedPIDs(streams map[int]*streamTimes) []int {
+	var pids []int
+	for pid := range streams {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// preview quotes the start of a segment that is text, like an error page.
+func preview(head []byte) string {
+	s := string(head[:min(len(head), 32)])
+	for _, r := range s {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return fmt.Sprintf("% x", head[:min(len(head), 8)])
+		}
+	}
+	return fmt.Sprintf("%q", strings.Join(strings.Fields(s), " "))
+}
+
+// watch registers the segment of a block to be verified.
+func (j *job) watch(id int, segment *m3u8.MediaSegment) {
+	if !j.opts.Verify || j.trackType == "SUBTITLES" {
+		return
+	}
+	j.l.Lock()
+	j.health[id] = &SegmentHealth{
+		Sequence:      segment.SeqId,
+		URI:           segment.URI,
+		Duration:      time.Duration(segment.Duration * float64(time.Second)),
+		id:            id,
+		discontinuity: segment.Discontinuity,
+	}
+	j.l.Unlock()
+}
+
+// check returns the check of a block being downloaded, nil when it is not
+// verified nor the first segment the start of the video is measured on.
+func (j *job) check(id int) *segmentCheck {
+	j.l.Lock()
+	defer j.l.Unlock()
+	if j.health[id] == nil && (id != 0 || j.start == nil || !j.start.pending()) {
+		return nil
+	}
+	return newSegmentCheck(j.fmp4, j.spool)
+}
+
+// verified records the result of the checks of a block, and reports whether
+// it is downloaded again.
+func (j *job) verified(id int, c *segmentCheck) bool {
+	j.l.Lock()
+	defer j.l.Unlock()
+	h := j.health[id]
+	if h == nil {
+		return false
+	}
+	c.result(h)
+	if h.OK() || h.Refetched+1 >= verifyAttempts {
+		return false
+	}
+	h.Refetched++
+	j.logger.Printf("[!] Segment %d failed the checks, downloading it again: %s", h.Sequence, strings.Join(h.Problems, ", "))
+	return true
+}
+
+// healthReport returns the health of the segments in the order of the
+// playlist, after checking that the timestamps continue from one segment to
+// the next.
+func (j *job) healthReport() []SegmentHealth {
+	j.l.Lock()
+	defer j.l.Unlock()
+	if len(j.health) == 0 {
+		return nil
+	}
+
+	list := make([]*SegmentHealth, 0, len(j.health))
+	for _, h := range j.health {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].id < list[b].id
+	})
+
+	report := make([]SegmentHealth, len(list))
+	for i, h := range list {
+		if i > 0 {
+			prev := list[i-1]
+			if h.timed && prev.timed && h.kind == prev.kind && !h.discontinuity && h.Sequence == prev.Sequence+1 {
+				if jump := unwrap(h.first - prev.end); jump > maxJump || jump < -maxJump {
+					h.Problems = append(h.Problems, fmt.Sprintf("timestamps jump by %s from the previous segment",
+						(time.Duration(jump)*time.Second/tsClock).Round(time.Millisecond)))
+				}
+			}
+		}
+		report[i] = *h
+	}
+	return report
+}
@@ -0,0 +1,174 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+// tsWriter writes MPEG-TS packets with a PAT, a PMT on pid 0x1000 and the
+// PES packets of the streams.
+type tsWriter struct {
+	bytes.Buffer
+	cc map[int]byte
+}
+
+func newTSWriter(streams map[int]byte) *tsWriter {
+	w := &tsWriter{cc: map[int]byte{}}
+	w.psi(0, []byte{0x00, 0, 0, 0x00, 0x01, 0xc1, 0, 0, 0x00, 0x01, 0xf0, 0x00})
+	pmt := []byte{0x02, 0, 0, 0x00, 0x01, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00}
+	for _, pid := range []int{0x100, 0x101} {
+		if t, ok := streams[pid]; ok {
+			pmt = append(pmt, t, 0xe0|byte(pid>>8), byte(pid), 0xf0, 0x00)
+		}
+	}
+	w.psi(0x1000, pmt)
+	return w
+}
+
+func (w *tsWriter) psi(pid int, s []byte) {
+	// section length, with the crc
+	binary.BigEndian.PutUint16(s[1:], 0xb000|uint16(len(s)+4-3))
+	s = binary.BigEndian.AppendUint32(s, ts.CRC32(s))
+	payload := append([]byte{0}, s...)
+	w.packet(pid, true, append(payload, bytes.Repeat([]byte{0xff}, 184-len(payload))...))
+}
+
+// packet writes a packet of pid, with an adaptation field stuffing the
+// payload to 184 bytes.
+func (w *tsWriter) packet(pid int, start bool, payload []byte) {
+	pkt := []byte{0x47, byte(pid >> 8), byte(pid), 0x10 | w.cc[pid]}
+	if start {
+		pkt[1] |= 0x40
+	}
+	w.cc[pid] = (w.cc[pid] + 1) & 0x0f
+	if n := 184 - len(payload); n > 0 {
+		pkt[3] |= 0x20
+		pkt = append(pkt, byte(n-1))
+		if n > 1 {
+			pkt = append(pkt, 0x00)
+			pkt = append(pkt, bytes.Repeat([]byte{0xff}, n-2)...)
+		}
+	}
+	w.Write(append(pkt, payload...))
+}
+
+// pes writes a PES packet with a PTS in one packet.
+func (w *tsWriter) pes(pid int, pts int64, data []byte) {
+	id := byte(0xe0)
+	if pid != 0x100 {
+		id = 0xc0
+	}
+	p := []byte{0, 0, 1, id, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 1, byte(pts >> 7), byte(pts<<1) | 1}
+	w.packet(pid, true, append(p, data...))
+}
+
+// videoSegment returns a segment of n video frames from pts, step apart.
+func videoSegment(pts, step int64, n int) *tsWriter {
+	w := newTSWriter(map[int]byte{0x100: ts.StreamTypeH264})
+	for i := 0; i < n; i++ {
+		w.pes(0x100, pts+int64(i)*step, []byte{0, 0, 0, 1, 0x09, 0xf0})
+	}
+	return w
+}
+
+func box(typ string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(b, typ...), payload...)
+}
+
+func TestSegmentCheck(t *testing.T) {
+	dropped := videoSegment(0, 36000, 10).Bytes()
+	// the 5th packet lost
+	dropped = append(dropped[:4*188:4*188], dropped[5*188:]...)
+
+	tests := []struct {
+		name     string
+		fmp4     bool
+		data     []byte
+		measured time.Duration
+		problems []string
+	}{
+		{"ok", false, videoSegment(0, 36000, 10).Bytes(), 4 * time.Second, nil},
+		{"wrapped", false, videoSegment(1<<33-36000*5, 36000, 10).Bytes(), 4 * time.Second, nil},
+		{"short", false, videoSegment(0, 18000, 10).Bytes(), 2 * time.Second, []string{"lasts 2s, #EXTINF says 4s"}},
+		{"truncated", false, videoSegment(0, 36000, 10).Bytes()[:188*11+100], 3600 * time.Millisecond, []string{"100 bytes out of"}},
+		{"continuity", false, dropped, 0, []string{"1 continuity errors"}},
+		{"empty", false, nil, 0, []string{"empty"}},
+		{"html", false, []byte("<html><body>404</body></html>"), 0, []string{`not MPEG-TS, starts with "<html>`}},
+		{"packed audio", false, []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), 0, nil},
+		{"adts", false, []byte{0xff, 0xf1, 0x50, 0x80}, 0, nil},
+		{"no streams", false, newTSWriter(nil).Bytes(), 0, []string{"no audio or video"}},
+		{"fmp4", true, append(box("moof", box("mfhd", make([]byte, 8))), box("mdat", []byte{1, 2, 3})...), 0, nil},
+		{"fmp4 without mdat", true, box("styp", []byte("msdh")), 0, []string{"no moof and mdat boxes"}},
+		{"fmp4 cut", true, box("moof", make([]byte, 16))[:12], 0, []string{"invalid MP4 boxes"}},
+	}
+	for _, tt := range tests {
+		c := newSegmentCheck(tt.fmp4, joiner.NewSpool(t.TempDir(), 0))
+		// in small writes, like a download
+		for data := tt.data; len(data) > 0; {
+			n := min(len(data), 100)
+			c.Write(data[:n])
+			data = data[n:]
+		}
+		h := &SegmentHealth{Duration: 4 * time.Second}
+		c.result(h)
+		c.release()
+
+		if tt.name != "continuity" && h.Measured != tt.measured {
+			t.Errorf("%s: measured %s, want %s", tt.name, h.Measured, tt.measured)
+		}
+		if len(h.Problems) < len(tt.problems) || len(tt.problems) == 0 && len(h.Problems) > 0 {
+			t.Errorf("%s: problems %q, want %q", tt.name, h.Problems, tt.problems)
+			continue
+		}
+		for i, p := range tt.problems {
+			if !strings.Contains(h.Problems[i], p) {
+				t.Errorf("%s: problem %q, want %q", tt.name, h.Problems[i], p)
+			}
+		}
+	}
+}
+
+func TestHealthReport(t *testing.T) {
+	second := int64(tsClock)
+	tests := []struct {
+		name string
+		next SegmentHealth
+		jump string
+	}{
+		{"continuous", SegmentHealth{Sequence: 1, first: 4 * second}, ""},
+		{"small gap", SegmentHealth{Sequence: 1, first: 4*second + second/4}, ""},
+		{"jump", SegmentHealth{Sequence: 1, first: 6 * second}, "timestamps jump by 2s"},
+		{"back", SegmentHealth{Sequence: 1, first: 1 * second}, "timestamps jump by -3s"},
+		{"wrapped", SegmentHealth{Sequence: 1, first: 4*second - tsWrap}, ""},
+		{"discontinuity", SegmentHealth{Sequence: 1, first: 9 * second, discontinuity: true}, ""},
+		{"sequence gap", SegmentHealth{Sequence: 2, first: 9 * second}, ""},
+		{"other kind", SegmentHealth{Sequence: 1, first: 9 * second, kind: "audio"}, ""},
+	}
+	for _, tt := range tests {
+		next := tt.next
+		next.id, next.timed, next.end = 1, true, next.first+4*second
+		if next.kind == "" {
+			next.kind = "video"
+		}
+		j := &job{health: map[int]*SegmentHealth{
+			1: &next,
+			0: {id: 0, kind: "video", timed: true, first: 0, end: 4 * second},
+		}}
+		report := j.healthReport()
+		if len(report) != 2 || report[0].id != 0 {
+			t.Fatalf("%s: report %+v", tt.name, report)
+		}
+		problems := strings.Join(report[1].Problems, ", ")
+		if tt.jump == "" && problems != "" || !strings.Contains(problems, tt.jump) {
+			t.Errorf("%s: problems %q, want %q", tt.name, problems, tt.jump)
+		}
+	}
+}
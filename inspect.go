@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/downloader"
+	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
+	"github.com/guonaihong/clop"
+)
+
+type InspectConf struct {
+	URL        string        `clop:"-u; --url" usage:"url of m3u8 file"`
+	File       string        `clop:"-f; --m3u8-file" usage:"use local m3u8 file instead of downloading from url"`
+	Retry      int           `clop:"-r; --retry" usage:"number of retries" default:"3"`
+	Timeout    time.Duration `clop:"-t; --timeout" usage:"timeout" default:"60s"`
+	Proxy      string        `clop:"-p; --proxy" usage:"proxy. Example: http://127.0.0.1:8080"`
+	Headers    []string      `clop:"-H; --header; greedy" usage:"http header. Example: Referer:http://www.example.com"`
+	SkipVerify bool          `clop:"-s; --skipverify" usage:"skip verify server certificate"`
+}
+
+func checkInspectConf() {
+	c := &conf.Inspect
+	if c.URL == "" && c.File == "" {
+		fmt.Println("You must set the -u or -f parameter")
+		clop.Usage()
+	}
+
+	if c.Retry <= 0 {
+		c.Retry = 1
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second * 60
+	}
+}
+
+// inspect prints the description of the playlist in JSON.
+func inspect() {
+	c := &conf.Inspect
+
+	client, err := zhttp.NewClient(c.Timeout, c.Proxy, c.SkipVerify)
+	if err != nil {
+		log.Fatalln("[-] Initialization failed:", err)
+	}
+
+	var data []byte
+	if c.File != "" {
+		data, err = os.ReadFile(c.File)
+		if err != nil {
+			log.Fatalln("[-] Load m3u8 file failed:", err)
+		}
+	}
+
+	d, err := downloader.New(downloader.Options{
+		Retry:    c.Retry,
+		Headers:  parseHeaders(c.Headers),
+		Playlist: data,
+		Client:   client,
+		Logger:   log.Default(),
+	})
+	if err != nil {
+		log.Fatalln("[-] Initialization failed:", err)
+	}
+
+	info, err := d.Inspect(context.Background(), c.URL)
+	if err != nil {
+		log.Fatalln("[-] Parse m3u8 file failed:", err)
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		log.Fatalln("[-] Encode inspection failed:", err)
+	}
+	fmt.Println(string(out))
+}
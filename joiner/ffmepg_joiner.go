@@ -2,6 +2,7 @@ package joiner
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,6 +15,11 @@ type FFmepgJoiner struct {
 	outFile  string
 	cacheDir string
 	blocks   map[int]string
+	commit   CommitFunc
+	periods  PeriodFunc
+	// keep is set when the cache directory is the one of a resumed
+	// download, which Abort keeps
+	keep bool
 }
 
 func NewFFmepg(ffmpeg string, outFile string) (*FFmepgJoiner, error) {
@@ -37,17 +43,117 @@ func NewFFmepg(ffmpeg string, outFile string) (*FFmepgJoiner, error) {
 	return joiner, nil
 }
 
+// ResumeFFmepg uses the cache directory of outFile, next to it, so that it
+// survives between runs, and reuses the cached blocks whose size matches.
+func ResumeFFmepg(ffmpeg string, outFile string, sizes map[int]int64) (*FFmepgJoiner, error) {
+	joiner := &FFmepgJoiner{
+		ffmpeg:  ffmpeg,
+		outFile: outFile,
+		blocks:  map[int]string{},
+		keep:    true,
+	}
+
+	_, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := resumeDir(outFile)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	joiner.cacheDir = dir
+
+	for id, size := range sizes {
+		file := joiner.blockFile(id)
+		info, err := os.Stat(file)
+		if err == nil && info.Size() == size {
+			joiner.blocks[id] = file
+		}
+	}
+
+	return joiner, nil
+}
+
+// resumeDir is the cache directory of a resumed download to outFile.
+func resumeDir(outFile string) (string, error) {
+	out, err := filepath.Abs(outFile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(out), "m3u8_cache_"+filepath.Base(out)), nil
+}
+
+// Keep moves the blocks to the cache directory of a resumed download, for
+// ResumeFFmepg to find them, and keeps it on Abort.
+func (j *FFmepgJoiner) Keep() error {
+	if j.keep {
+		return nil
+	}
+	dir, err := resumeDir(j.outFile)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(j.cacheDir, dir)
+	if err != nil {
+		return err
+	}
+
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.cacheDir = dir
+	j.keep = true
+	for id := range j.blocks {
+		j.blocks[id] = j.blockFile(id)
+	}
+	return nil
+}
+
 func (j *FFmepgJoiner) mkdir() (string, error) {
-	cache, err := os.MkdirTemp("./", "m3u8_cache_*")
+	// next to the out file, so that Keep can rename it
+	cache, err := os.MkdirTemp(filepath.Dir(j.outFile), "m3u8_cache_*")
 	if err != nil {
 		return "", err
 	}
 	return filepath.Abs(cache)
 }
 
-func (j *FFmepgJoiner) Add(id int, block []byte) error {
-	file := filepath.Join(j.cacheDir, fmt.Sprintf("%d.ts", id))
-	err := os.WriteFile(file, block, 0644)
+func (j *FFmepgJoiner) blockFile(id int) string {
+	return filepath.Join(j.cacheDir, fmt.Sprintf("%d.ts", id))
+}
+
+func (j *FFmepgJoiner) SetCommit(fn CommitFunc) {
+	j.commit = fn
+}
+
+// SetPeriods makes ffmpeg concatenate the discontinuity periods rather than
+// the segments, so that the timestamps are rebased at the discontinuities
+// only. The segments of a period are joined as they are, after the init
+// segment if there is one.
+func (j *FFmepgJoiner) SetPeriods(fn PeriodFunc) {
+	j.periods = fn
+}
+
+// Has reports whether the block is already in the cache directory.
+func (j *FFmepgJoiner) Has(id int) bool {
+	j.l.Lock()
+	_, ok := j.blocks[id]
+	j.l.Unlock()
+	return ok
+}
+
+func (j *FFmepgJoiner) Add(id int, block *Block) error {
+	file := j.blockFile(id)
+	size := block.Size()
+	err := block.MoveTo(file)
 	if err != nil {
 		return err
 	}
@@ -55,9 +161,36 @@ func (j *FFmepgJoiner) Add(id int, block []byte) error {
 	j.l.Lock()
 	j.blocks[id] = file
 	j.l.Unlock()
+
+	if j.commit != nil {
+		err = syncFile(file)
+		if err == nil {
+			err = j.commit(id, 0, size)
+		}
+	}
 	return err
 }
 
+// syncFile flushes a block file to disk before it is recorded.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	return err
+}
+
+// Abort keeps the cache directory of a resumed download or after Keep, and
+// removes it otherwise.
+func (j *FFmepgJoiner) Abort() error {
+	if j.keep || j.cacheDir == "" {
+		return nil
+	}
+	return os.RemoveAll(j.cacheDir)
+}
+
 func (j *FFmepgJoiner) merge(mergeFile string) error {
 	cmd := exec.Command(j.ffmpeg, "-y", "-loglevel", "error", "-f", "concat", "-safe", "0", "-i", mergeFile, "-c", "copy", j.outFile)
 	cmd.Stdout = os.Stdout
@@ -66,19 +199,18 @@ func (j *FFmepgJoiner) merge(mergeFile string) error {
 }
 
 func (j *FFmepgJoiner) Merge() error {
+	files, err := j.inputs()
+	if err != nil {
+		return err
+	}
+
 	var text string
-	i := 0
-	for {
-		file, ok := j.blocks[i]
-		if !ok {
-			break
-		}
+	for _, file := range files {
 		text += fmt.Sprintf("file '%s'\n", file)
-		i++
 	}
 
 	mergeFile := filepath.Join(j.cacheDir, "merge_list.txt")
-	err := os.WriteFile(mergeFile, []byte(text), 0644)
+	err = os.WriteFile(mergeFile, []byte(text), 0644)
 	if err != nil {
 		return err
 	}
@@ -94,3 +226,86 @@ func (j *FFmepgJoiner) Merge() error {
 
 	return nil
 }
+
+// inputs returns the files to concatenate, the blocks or the periods made of
+// them.
+func (j *FFmepgJoiner) inputs() ([]string, error) {
+	var files []string
+	var init string
+	var out *os.File
+	period := -1
+	// changed is set when the init segment changes within a period
+	changed := false
+	for i := 0; ; i++ {
+		file, ok := j.blocks[i]
+		if !ok {
+			break
+		}
+		if j.periods == nil {
+			files = append(files, file)
+			continue
+		}
+
+		p := j.periods(i)
+		if p < 0 {
+			init = file
+			changed = out != nil
+			continue
+		}
+		if p == period && changed {
+			changed = false
+			err := appendFile(out, init)
+			if err != nil {
+				out.Close()
+				return nil, err
+			}
+		}
+		if p != period || out == nil {
+			changed = false
+			if out != nil {
+				err := out.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var err error
+			path := filepath.Join(j.cacheDir, fmt.Sprintf("period_%d.ts", p))
+			out, err = os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, path)
+			period = p
+
+			if init != "" {
+				err = appendFile(out, init)
+				if err != nil {
+					out.Close()
+					return nil, err
+				}
+			}
+		}
+
+		err := appendFile(out, file)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+
+	if out != nil {
+		return files, out.Close()
+	}
+	return files, nil
+}
+
+func appendFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,89 @@
+package joiner
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/mp4"
+)
+
+// FMP4Joiner joins fMP4 segments into one fragmented MP4 file, with the
+// sample entries of every init segment, decode times starting at 0 and an
+// mfra index, instead of concatenating them as they are.
+type FMP4Joiner struct {
+	l      sync.Mutex
+	blocks map[int]*Block
+	index  int
+	writer *mp4.FragmentWriter
+	// periods makes the decode times continue at the discontinuities when
+	// it is set
+	periods PeriodFunc
+	period  int
+}
+
+func NewFMP4(outFile string) (*FMP4Joiner, error) {
+	writer, err := mp4.NewFragmentWriter(outFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FMP4Joiner{
+		blocks: map[int]*Block{},
+		writer: writer,
+	}, nil
+}
+
+// SetPeriods makes the decode times continue at the discontinuities, instead
+// of following the ones of the segments.
+func (j *FMP4Joiner) SetPeriods(fn PeriodFunc) {
+	j.periods = fn
+}
+
+func (j *FMP4Joiner) Add(id int, block *Block) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.blocks[id] = block
+
+	for {
+		block, ok := j.blocks[j.index]
+		if !ok {
+			return nil
+		}
+		delete(j.blocks, j.index)
+
+		if j.periods != nil {
+			if p := j.periods(j.index); p > j.period {
+				j.writer.Discontinuity()
+				j.period = p
+			}
+		}
+
+		var buf bytes.Buffer
+		_, err := block.WriteTo(&buf)
+		block.Release()
+		if err == nil {
+			err = j.writer.Add(buf.Bytes())
+		}
+		if err != nil {
+			return fmt.Errorf("join segment %d error: %w", j.index, err)
+		}
+		j.index++
+	}
+}
+
+func (j *FMP4Joiner) Merge() error {
+	return j.writer.Close()
+}
+
+// Abort drops the blocks and the fragments, nothing is written to the out
+// file.
+func (j *FMP4Joiner) Abort() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	for id, block := range j.blocks {
+		block.Release()
+		delete(j.blocks, id)
+	}
+	return j.writer.Abort()
+}
@@ -1,6 +1,19 @@
 package joiner
 
+// Joiner writes the blocks to the out file in the order of their ids. It
+// takes over the blocks added, which must not be used afterwards.
 type Joiner interface {
-	Add(id int, block []byte) error
+	Add(id int, block *Block) error
 	Merge() error
+	// Abort stops the joiner without merging. What was committed is kept
+	// for a resumed download, everything else is removed.
+	Abort() error
 }
+
+// PeriodFunc returns the discontinuity period of a block, counting from 0,
+// or -1 for an init segment, which starts the media of every period.
+type PeriodFunc func(id int) int
+
+// CommitFunc is called once a block has been persisted, with the offset and
+// size it occupies in the joiner's storage.
+type CommitFunc func(id int, offset, size int64) error
@@ -1,15 +1,30 @@
 package joiner
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 type MemoryJoiner struct {
 	l      sync.Mutex
-	blocks map[int][]byte
+	blocks map[int]*Block
 	file   *os.File
 	index  int
+	offset int64
+	commit CommitFunc
+	// periods splits the out file at the discontinuities when it is set
+	periods PeriodFunc
+	period  int
+	init    []byte
+	// pending is set when an init segment is kept for the next block
+	pending bool
+	outFile string
+	files   []string
 }
 
 func NewMem(outFile string) (*MemoryJoiner, error) {
@@ -19,14 +34,116 @@ func NewMem(outFile string) (*MemoryJoiner, error) {
 	}
 
 	joiner := &MemoryJoiner{
-		blocks: map[int][]byte{},
-		file:   f,
+		blocks:  map[int]*Block{},
+		file:    f,
+		outFile: outFile,
+		files:   []string{outFile},
 	}
 
 	return joiner, nil
 }
 
-func (j *MemoryJoiner) Add(id int, block []byte) error {
+// ResumeMem reopens outFile, discards everything after offset and continues
+// appending from block index.
+func ResumeMem(outFile string, index int, offset int64) (*MemoryJoiner, error) {
+	f, err := os.OpenFile(outFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Truncate(offset)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	joiner := &MemoryJoiner{
+		blocks:  map[int]*Block{},
+		file:    f,
+		index:   index,
+		offset:  offset,
+		outFile: outFile,
+		files:   []string{outFile},
+	}
+
+	return joiner, nil
+}
+
+func (j *MemoryJoiner) SetCommit(fn CommitFunc) {
+	j.commit = fn
+}
+
+// SetPeriods writes every discontinuity period to its own file, the first
+// one to the out file and the next ones to <out file>.<n><ext>, starting
+// with the init segment if there is one. It can not be used with a commit
+// function.
+func (j *MemoryJoiner) SetPeriods(fn PeriodFunc) {
+	j.periods = fn
+}
+
+// Files returns the files written, one per period when they are split.
+func (j *MemoryJoiner) Files() []string {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return append([]string(nil), j.files...)
+}
+
+// split starts the file of the period of the block, and keeps the init
+// segment to write it at the start of the next files. An init segment is
+// written in place only at the start of the first file, the next ones go
+// before the block that follows them. It reports whether the block is
+// written to the current file.
+func (j *MemoryJoiner) split(id int, block *Block) (bool, error) {
+	period := j.periods(id)
+	if period < 0 {
+		var buf bytes.Buffer
+		_, err := block.WriteTo(&buf)
+		if err != nil {
+			return false, err
+		}
+		j.init = buf.Bytes()
+		if j.offset == 0 && len(j.files) == 1 {
+			return true, nil
+		}
+		j.pending = true
+		return false, nil
+	}
+	if period <= j.period {
+		if j.pending {
+			j.pending = false
+			_, err := j.file.Write(j.init)
+			return true, err
+		}
+		return true, nil
+	}
+
+	err := j.file.Close()
+	if err != nil {
+		return false, err
+	}
+
+	ext := filepath.Ext(j.outFile)
+	file := strings.TrimSuffix(j.outFile, ext) + "." + strconv.Itoa(period+1) + ext
+	j.file, err = os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	j.files = append(j.files, file)
+	j.period = period
+	j.offset = 0
+	j.pending = false
+
+	_, err = j.file.Write(j.init)
+	return true, err
+}
+
+func (j *MemoryJoiner) Add(id int, block *Block) error {
 	j.l.Lock()
 	j.blocks[id] = block
 	err := j.merge()
@@ -38,10 +155,33 @@ func (j *MemoryJoiner) merge() error {
 	for {
 		block, ok := j.blocks[j.index]
 		if ok {
-			_, err := j.file.Write(block)
-			if err != nil {
-				return err
+			write := true
+			if j.periods != nil {
+				var err error
+				write, err = j.split(j.index, block)
+				if err != nil {
+					return err
+				}
+			}
+			if write {
+				_, err := block.WriteTo(j.file)
+				if err != nil {
+					return err
+				}
+				if j.commit != nil {
+					// the block must be on disk before it is recorded
+					err = j.file.Sync()
+					if err != nil {
+						return err
+					}
+					err = j.commit(j.index, j.offset, block.Size())
+					if err != nil {
+						return err
+					}
+				}
+				j.offset += block.Size()
 			}
+			block.Release()
 			delete(j.blocks, j.index)
 			j.index++
 		} else {
@@ -54,3 +194,15 @@ func (j *MemoryJoiner) merge() error {
 func (j *MemoryJoiner) Merge() error {
 	return j.file.Close()
 }
+
+// Abort drops the blocks that could not be written in order yet. The out
+// file keeps the blocks written so far.
+func (j *MemoryJoiner) Abort() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	for id, block := range j.blocks {
+		block.Release()
+		delete(j.blocks, id)
+	}
+	return j.file.Close()
+}
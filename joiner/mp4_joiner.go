@@ -0,0 +1,108 @@
+package joiner
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/mp4"
+	"github.com/greyh4t/m3u8-Downloader-Go/ts"
+)
+
+// MP4Joiner remuxes MPEG-TS segments to an MP4 file without ffmpeg. The
+// H.264, H.265 and AAC streams are kept, the timed metadata and private
+// streams are dropped. With fragmented, every segment makes a fragment.
+type MP4Joiner struct {
+	l       sync.Mutex
+	blocks  map[int]*Block
+	index   int
+	demuxer *ts.Demuxer
+	muxer   *mp4.Muxer
+	// periods rebases the timestamps at the discontinuities when it is set
+	periods PeriodFunc
+	period  int
+}
+
+func NewMP4(outFile string, fragmented bool) (*MP4Joiner, error) {
+	muxer, err := mp4.NewMuxer(outFile, fragmented)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &MP4Joiner{
+		blocks: map[int]*Block{},
+		muxer:  muxer,
+	}
+	j.demuxer = ts.NewDemuxer(j.write)
+	return j, nil
+}
+
+// SetPeriods makes the timestamps continue at the discontinuities, instead of
+// following the timestamps of the segments.
+func (j *MP4Joiner) SetPeriods(fn PeriodFunc) {
+	j.periods = fn
+}
+
+func (j *MP4Joiner) write(pes *ts.PES) error {
+	var codec mp4.Codec
+	switch pes.StreamType {
+	case ts.StreamTypeH264:
+		codec = mp4.H264
+	case ts.StreamTypeH265:
+		codec = mp4.H265
+	case ts.StreamTypeAAC:
+		codec = mp4.AAC
+	case 0x01, 0x02, 0x03, 0x04, 0x11, ts.StreamTypeAC3, ts.StreamTypeEAC3:
+		return fmt.Errorf("stream type 0x%02x can not be remuxed to mp4", pes.StreamType)
+	default:
+		return nil
+	}
+	return j.muxer.Write(pes.PID, codec, pes.PTS, pes.DTS, pes.Data)
+}
+
+func (j *MP4Joiner) Add(id int, block *Block) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.blocks[id] = block
+
+	for {
+		block, ok := j.blocks[j.index]
+		if !ok {
+			return nil
+		}
+		delete(j.blocks, j.index)
+
+		if j.periods != nil {
+			if p := j.periods(j.index); p > j.period {
+				j.muxer.Discontinuity()
+				j.period = p
+			}
+		}
+
+		_, err := block.WriteTo(j.demuxer)
+		if err == nil {
+			err = j.demuxer.Flush()
+		}
+		block.Release()
+		if err != nil {
+			return fmt.Errorf("remux segment %d error: %w", j.index, err)
+		}
+		j.muxer.Fragment()
+		j.index++
+	}
+}
+
+func (j *MP4Joiner) Merge() error {
+	return j.muxer.Close()
+}
+
+// Abort drops the blocks and the samples, nothing is written to the out
+// file.
+func (j *MP4Joiner) Abort() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	for id, block := range j.blocks {
+		block.Release()
+		delete(j.blocks, id)
+	}
+	return j.muxer.Abort()
+}
@@ -0,0 +1,111 @@
+package joiner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mux adds all the streams of the tracks to outFile with ffmpeg, without
+// re-encoding them. The subtitle streams are converted to subtitleCodec if it
+// is set, as containers like MP4 do not take WebVTT as it is.
+func Mux(ffmpeg string, outFile string, tracks []string, subtitleCodec string) error {
+	ext := filepath.Ext(outFile)
+	tmpFile := strings.TrimSuffix(outFile, ext) + ".muxing" + ext
+
+	args := []string{"-y", "-loglevel", "error", "-i", outFile}
+	for _, track := range tracks {
+		args = append(args, "-i", track)
+	}
+	for i := 0; i <= len(tracks); i++ {
+		args = append(args, "-map", strconv.Itoa(i))
+	}
+	args = append(args, "-c", "copy")
+	if subtitleCodec != "" {
+		args = append(args, "-c:s", subtitleCodec)
+	}
+	args = append(args, tmpFile)
+
+	cmd := exec.Command(ffmpeg, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("ffmpeg mux error: %w", err)
+	}
+
+	return os.Rename(tmpFile, outFile)
+}
+
+// Trim cuts outFile to duration from start with ffmpeg. The video is
+// re-encoded with an encoder of its codec, so that it starts at start instead
+// of the key frame before. The audio only files are not re-encoded.
+func Trim(ffmpeg string, outFile string, start, duration time.Duration) error {
+	ext := filepath.Ext(outFile)
+	tmpFile := strings.TrimSuffix(outFile, ext) + ".trimming" + ext
+
+	args := []string{"-y", "-loglevel", "error", "-ss", formatSeconds(start), "-i", outFile}
+	if duration > 0 {
+		args = append(args, "-t", formatSeconds(duration))
+	}
+	args = append(args, "-map", "0", "-c", "copy")
+	if codec, ok := probeVideo(ffmpeg, outFile); ok {
+		encoder, ok := encoders[codec]
+		if !ok {
+			encoder = encoders["h264"]
+		}
+		args = append(args, "-c:v")
+		args = append(args, encoder...)
+	}
+	args = append(args, tmpFile)
+
+	cmd := exec.Command(ffmpeg, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("ffmpeg trim error: %w", err)
+	}
+
+	return os.Rename(tmpFile, outFile)
+}
+
+// encoders are the ffmpeg encoders and their options for the video codecs,
+// by the names ffmpeg gives to the codecs. The other codecs are encoded to
+// H.264.
+var encoders = map[string][]string{
+	"h264":       {"libx264", "-crf", "18"},
+	"hevc":       {"libx265", "-crf", "20"},
+	"vp9":        {"libvpx-vp9", "-crf", "31", "-b:v", "0"},
+	"av1":        {"libsvtav1", "-crf", "30"},
+	"mpeg2video": {"mpeg2video", "-q:v", "2"},
+}
+
+var videoStream = regexp.MustCompile(`Stream #\d+:\d+.*: Video: (\w+)`)
+
+// probeVideo returns the codec of the first video stream of file, as ffmpeg
+// prints it, and false if file has no video.
+func probeVideo(ffmpeg string, file string) (string, bool) {
+	// ffmpeg fails without an output file, after it printed the streams
+	out, _ := exec.Command(ffmpeg, "-hide_banner", "-i", file).CombinedOutput()
+	return videoCodec(out)
+}
+
+func videoCodec(info []byte) (string, bool) {
+	m := videoStream.FindSubmatch(info)
+	if m == nil {
+		return "", false
+	}
+	return string(m[1]), true
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
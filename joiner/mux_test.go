@@ -0,0 +1,31 @@
+package joiner
+
+import "testing"
+
+func TestVideoCodec(t *testing.T) {
+	tests := []struct {
+		info  string
+		codec string
+		ok    bool
+	}{
+		{`Input #0, mpegts, from 'out.ts':
+  Duration: 00:00:24.00, start: 1.400000, bitrate: 1000 kb/s
+  Program 1
+    Stream #0:0[0x100]: Video: hevc (Main 10) (HEVC / 0x43564548), yuv420p10le(tv), 1920x1080, 25 fps
+    Stream #0:1[0x101](und): Audio: aac (LC) ([15][0][0][0] / 0x000F), 48000 Hz, stereo, fltp
+`, "hevc", true},
+		{`Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'out.mp4':
+    Stream #0:0[0x1](und): Audio: aac (LC) (mp4a / 0x6134706D), 44100 Hz, stereo, fltp, 128 kb/s (default)
+    Stream #0:1[0x2](und): Video: h264 (High) (avc1 / 0x31637661), yuv420p, 1280x720, 30 fps (default)
+`, "h264", true},
+		{`Input #0, aac, from 'out.aac':
+    Stream #0:0: Audio: aac (LC), 48000 Hz, stereo, fltp
+`, "", false},
+	}
+	for i, tt := range tests {
+		codec, ok := videoCodec([]byte(tt.info))
+		if codec != tt.codec || ok != tt.ok {
+			t.Errorf("%d: videoCodec = %s, %v, want %s, %v", i, codec, ok, tt.codec, tt.ok)
+		}
+	}
+}
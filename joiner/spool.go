@@ -0,0 +1,228 @@
+package joiner
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+const chunkSize = 32 * 1024
+
+// Spool stores downloaded blocks in memory as long as the total size of the
+// blocks held stays under a limit, and in temporary files after that.
+type Spool struct {
+	l     sync.Mutex
+	dir   string
+	tmp   string
+	limit int64
+	used  int64
+}
+
+// NewSpool creates a spool that keeps up to limit bytes in memory. The
+// temporary files are created in a directory under dir, made on first use.
+// If dir is empty, the default directory for temporary files is used.
+func NewSpool(dir string, limit int64) *Spool {
+	return &Spool{
+		dir:   dir,
+		limit: limit,
+	}
+}
+
+func (s *Spool) reserve(n int64) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.used+n > s.limit {
+		return false
+	}
+	s.used += n
+	return true
+}
+
+func (s *Spool) free(n int64) {
+	s.l.Lock()
+	s.used -= n
+	s.l.Unlock()
+}
+
+// Hold counts n bytes held in memory outside of the blocks, like the whole
+// segments some decryptions need, so that fewer blocks are kept in memory
+// until Release is called. The limit can be exceeded by them.
+func (s *Spool) Hold(n int64) {
+	s.l.Lock()
+	s.used += n
+	s.l.Unlock()
+}
+
+// Release stops counting n bytes counted by Hold.
+func (s *Spool) Release(n int64) {
+	s.free(n)
+}
+
+// ReadAll reads r to the end in memory, counting the data with Hold. The
+// returned function releases it.
+func (s *Spool) ReadAll(r io.Reader) ([]byte, func(), error) {
+	var data []byte
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		s.Hold(int64(n))
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.Release(int64(len(data)))
+			return nil, nil, err
+		}
+	}
+	size := int64(len(data))
+	return data, func() { s.Release(size) }, nil
+}
+
+func (s *Spool) createTemp() (*os.File, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.tmp == "" {
+		dir, err := os.MkdirTemp(s.dir, "m3u8_spool_*")
+		if err != nil {
+			return nil, err
+		}
+		s.tmp = dir
+	}
+	return os.CreateTemp(s.tmp, "*.ts")
+}
+
+// Write reads r to the end into a new block.
+func (s *Spool) Write(r io.Reader) (*Block, error) {
+	b := &Block{spool: s}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if b.file == "" && s.reserve(int64(n)) {
+				b.data = append(b.data, buf[:n]...)
+			} else if werr := b.writeFile(buf[:n]); werr != nil {
+				b.Release()
+				return nil, werr
+			}
+			b.size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			b.Release()
+			return nil, err
+		}
+	}
+
+	if b.f != nil {
+		err := b.f.Close()
+		b.f = nil
+		if err != nil {
+			b.Release()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Close removes the directory of the temporary files.
+func (s *Spool) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.tmp == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.tmp)
+	s.tmp = ""
+	return err
+}
+
+// Block is a downloaded segment held in memory or in a temporary file.
+type Block struct {
+	spool *Spool
+	data  []byte
+	file  string
+	f     *os.File
+	size  int64
+}
+
+// writeFile appends p to the temporary file of the block, moving the data
+// held in memory to it first.
+func (b *Block) writeFile(p []byte) error {
+	if b.f == nil {
+		f, err := b.spool.createTemp()
+		if err != nil {
+			return err
+		}
+		b.f = f
+		b.file = f.Name()
+
+		_, err = f.Write(b.data)
+		if err != nil {
+			return err
+		}
+		b.spool.free(int64(len(b.data)))
+		b.data = nil
+	}
+	_, err := b.f.Write(p)
+	return err
+}
+
+func (b *Block) Size() int64 {
+	return b.size
+}
+
+func (b *Block) WriteTo(w io.Writer) (int64, error) {
+	if b.file == "" {
+		n, err := w.Write(b.data)
+		return int64(n), err
+	}
+
+	f, err := os.Open(b.file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// MoveTo saves the block to path and releases it.
+func (b *Block) MoveTo(path string) error {
+	if b.file != "" && os.Rename(b.file, path) == nil {
+		b.file = ""
+		b.Release()
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	b.Release()
+	return nil
+}
+
+// Release frees the memory or removes the temporary file of the block.
+func (b *Block) Release() {
+	if b.f != nil {
+		b.f.Close()
+		b.f = nil
+	}
+	if b.file != "" {
+		os.Remove(b.file)
+		b.file = ""
+	}
+	if b.data != nil {
+		b.spool.free(int64(len(b.data)))
+		b.data = nil
+	}
+}
@@ -0,0 +1,39 @@
+package joiner
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpoolHold(t *testing.T) {
+	s := NewSpool(t.TempDir(), 100)
+	defer s.Close()
+
+	data, release, err := s.ReadAll(bytes.NewReader(make([]byte, 80)))
+	if err != nil || len(data) != 80 {
+		t.Fatalf("ReadAll = %d bytes, %v", len(data), err)
+	}
+
+	// the segment read whole leaves room for 20 bytes only
+	b, err := s.Write(bytes.NewReader(make([]byte, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.file == "" {
+		t.Error("block held in memory over the limit")
+	}
+	b.Release()
+
+	release()
+	b, err = s.Write(bytes.NewReader(make([]byte, 50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.file != "" {
+		t.Error("block written to a file under the limit")
+	}
+	b.Release()
+	if s.used != 0 {
+		t.Errorf("%d bytes still counted", s.used)
+	}
+}
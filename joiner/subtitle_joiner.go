@@ -0,0 +1,103 @@
+package joiner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/webvtt"
+)
+
+// SubtitleJoiner merges the cues of WebVTT segments into one subtitle file,
+// in the WebVTT or SRT format.
+type SubtitleJoiner struct {
+	l        sync.Mutex
+	blocks   map[int]*Block
+	outFile  string
+	format   string
+	timeline func(*webvtt.Merger)
+}
+
+func NewSubtitle(outFile string, format string) (*SubtitleJoiner, error) {
+	if format != "vtt" && format != "srt" {
+		return nil, fmt.Errorf("unsupported subtitle format %s", format)
+	}
+
+	joiner := &SubtitleJoiner{
+		blocks:  map[int]*Block{},
+		outFile: outFile,
+		format:  format,
+	}
+
+	return joiner, nil
+}
+
+// SetTimeline sets the function that times the cues on the time line of the
+// video, called before the segments are merged.
+func (j *SubtitleJoiner) SetTimeline(fn func(*webvtt.Merger)) {
+	j.timeline = fn
+}
+
+func (j *SubtitleJoiner) Add(id int, block *Block) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.blocks[id] = block
+	return nil
+}
+
+func (j *SubtitleJoiner) Merge() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	var ids []int
+	for id := range j.blocks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	merger := webvtt.NewMerger()
+	if j.timeline != nil {
+		j.timeline(merger)
+	}
+	for _, id := range ids {
+		var buf bytes.Buffer
+		_, err := j.blocks[id].WriteTo(&buf)
+		if err != nil {
+			return err
+		}
+		j.blocks[id].Release()
+		delete(j.blocks, id)
+
+		err = merger.Add(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", id, err)
+		}
+	}
+
+	f, err := os.Create(j.outFile)
+	if err != nil {
+		return err
+	}
+
+	if j.format == "srt" {
+		err = merger.WriteSRT(f)
+	} else {
+		err = merger.WriteVTT(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *SubtitleJoiner) Abort() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	for id, block := range j.blocks {
+		block.Release()
+		delete(j.blocks, id)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package journal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const magic = "m3u8-journal 2"
+
+var ErrMismatch = errors.New("journal was written for a different playlist")
+
+type Entry struct {
+	ID     int
+	Offset int64
+	Size   int64
+}
+
+// Journal records the segments that have been committed to the output file,
+// so an interrupted download can continue where it stopped.
+type Journal struct {
+	l           sync.Mutex
+	path        string
+	fingerprint string
+	file        *os.File
+	entries     map[int]Entry
+}
+
+// Open loads the journal at path, or creates it if it does not exist.
+// ErrMismatch is returned when the journal belongs to another playlist.
+func Open(path string, fingerprint string) (*Journal, error) {
+	entries, err := load(path, fingerprint)
+	if os.IsNotExist(err) {
+		return Create(path, fingerprint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		path:        path,
+		fingerprint: fingerprint,
+		file:        f,
+		entries:     entries,
+	}, nil
+}
+
+// Create starts an empty journal at path, discarding any previous one.
+func Create(path string, fingerprint string) (*Journal, error) {
+	j := &Journal{
+		path:        path,
+		fingerprint: fingerprint,
+		entries:     map[int]Entry{},
+	}
+
+	err := j.rewrite()
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func load(path string, fingerprint string) (map[int]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, ErrMismatch
+	}
+	if scanner.Text() != magic+" "+fingerprint {
+		return nil, ErrMismatch
+	}
+
+	entries := map[int]Entry{}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// a line cut off by a crash can still look like a smaller entry, the
+		// checksum ending every record tells it apart
+		if len(fields) != 4 || fields[3] != checksum(strings.Join(fields[:3], " ")) {
+			continue
+		}
+		id, err1 := strconv.Atoi(fields[0])
+		offset, err2 := strconv.ParseInt(fields[1], 10, 64)
+		size, err3 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		entries[id] = Entry{ID: id, Offset: offset, Size: size}
+	}
+
+	return entries, scanner.Err()
+}
+
+func (j *Journal) rewrite() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, magic, j.fingerprint)
+	for _, e := range j.sorted() {
+		w.WriteString(record(e))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	err = os.Rename(tmp, j.path)
+	if err != nil {
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (j *Journal) sorted() []Entry {
+	list := make([]Entry, 0, len(j.entries))
+	for _, e := range j.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].ID < list[b].ID
+	})
+	return list
+}
+
+// Entries returns the recorded segments ordered by id.
+func (j *Journal) Entries() []Entry {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.sorted()
+}
+
+func (j *Journal) Done(id int) bool {
+	j.l.Lock()
+	_, ok := j.entries[id]
+	j.l.Unlock()
+	return ok
+}
+
+// Retain drops every entry for which keep returns false.
+func (j *Journal) Retain(keep func(Entry) bool) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	for id, e := range j.entries {
+		if !keep(e) {
+			delete(j.entries, id)
+		}
+	}
+
+	return j.rewrite()
+}
+
+func (j *Journal) Add(id int, offset, size int64) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	e := Entry{ID: id, Offset: offset, Size: size}
+	_, err := j.file.WriteString(record(e))
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	j.entries[id] = e
+	return nil
+}
+
+// record is the line of an entry, ended by the checksum of its fields.
+func record(e Entry) string {
+	fields := fmt.Sprintf("%d %d %d", e.ID, e.Offset, e.Size)
+	return fields + " " + checksum(fields) + "\n"
+}
+
+func checksum(fields string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(fields)))
+}
+
+func (j *Journal) Close() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.file.Close()
+}
+
+// Remove closes and deletes the journal once the download is complete.
+func (j *Journal) Remove() error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.file.Close()
+	return os.Remove(j.path)
+}
@@ -0,0 +1,57 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenIgnoresCutRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ts.journal")
+	j, err := Create(path, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []Entry{{0, 0, 1000}, {1, 1000, 2345}} {
+		err = j.Add(e.ID, e.Offset, e.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// a crash while writing the record of block 1, inside its size
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := len(data) - len(record(Entry{1, 1000, 2345})) + len("1 1000 23")
+	err = os.WriteFile(path, data[:cut], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = Open(path, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	entries := j.Entries()
+	if len(entries) != 1 || entries[0] != (Entry{0, 0, 1000}) {
+		t.Fatalf("entries = %v, want only block 0", entries)
+	}
+}
+
+func TestOpenMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ts.journal")
+	j, err := Create(path, "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	_, err = Open(path, "other")
+	if err != ErrMismatch {
+		t.Fatalf("err = %v, want ErrMismatch", err)
+	}
+}
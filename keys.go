@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/greyh4t/m3u8-Downloader-Go/downloader"
+)
+
+// parseKeys reads the keys given on the command line. A --key without KID
+// and --key-file replace the key of every segment, --key-map the key of a
+// single key uri.
+func parseKeys() error {
+	for _, s := range conf.Keys {
+		kid, key, ok := strings.Cut(strings.ReplaceAll(s, "-", ""), ":")
+		if !ok {
+			if conf.key != nil {
+				return fmt.Errorf("only one --key without KID can be set")
+			}
+			k, err := downloader.ParseKey([]byte(s))
+			if err != nil {
+				return err
+			}
+			conf.key = k
+			continue
+		}
+
+		kidBytes, err := hex.DecodeString(kid)
+		if err != nil || len(kidBytes) != 16 {
+			return fmt.Errorf("invalid KID %s", kid)
+		}
+		keyBytes, err := hex.DecodeString(key)
+		if err != nil || len(keyBytes) != 16 {
+			return fmt.Errorf("invalid key %s", key)
+		}
+		if conf.keys == nil {
+			conf.keys = map[string][]byte{}
+		}
+		conf.keys[hex.EncodeToString(kidBytes)] = keyBytes
+	}
+
+	if conf.KeyFile != "" {
+		if conf.key != nil {
+			return fmt.Errorf("--key-file can not be used with a --key without KID")
+		}
+		key, err := readKeyFile(conf.KeyFile)
+		if err != nil {
+			return err
+		}
+		conf.key = key
+	}
+
+	for _, s := range conf.KeyMap {
+		// key uris often have a query string, the path rarely has a '='
+		i := strings.LastIndex(s, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid key map %s, must be URI=path", s)
+		}
+		key, err := readKeyFile(s[i+1:])
+		if err != nil {
+			return err
+		}
+		if conf.keyMap == nil {
+			conf.keyMap = map[string][]byte{}
+		}
+		conf.keyMap[s[:i]] = key
+	}
+
+	return nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file error: %w", err)
+	}
+
+	key, err := downloader.DecodeKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return key, nil
+}
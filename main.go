@@ -1,36 +1,27 @@
 package main
 
 import (
-	"bytes"
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
-	"path/filepath"
-	"sort"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/grafov/m3u8"
-	"github.com/greyh4t/hackpool"
-	"github.com/greyh4t/m3u8-Downloader-Go/decrypter"
-	"github.com/greyh4t/m3u8-Downloader-Go/joiner"
+	"github.com/greyh4t/m3u8-Downloader-Go/downloader"
 	"github.com/greyh4t/m3u8-Downloader-Go/processbar"
-	"github.com/greyh4t/m3u8-Downloader-Go/ts"
 	"github.com/greyh4t/m3u8-Downloader-Go/zhttp"
 	"github.com/guonaihong/clop"
 )
 
 var (
-	ZHTTP        *zhttp.Zhttp
-	JOINER       joiner.Joiner
-	BAR          *processbar.Bar
-	conf         *Conf
-	keyCache     = map[string][]byte{}
-	keyCacheLock sync.Mutex
+	BAR  *processbar.Bar
+	conf *Conf
 )
 
 type Conf struct {
@@ -46,21 +37,86 @@ type Conf struct {
 	SkipVerify        bool          `clop:"-s; --skipverify" usage:"skip verify server certificate"`
 	MergeWithFFmpeg   bool          `clop:"-m; --merge-with-ffmpeg" usage:"merge with ffmpeg"`
 	FFmpeg            string        `clop:"-F; --ffmpeg" usage:"path of ffmpeg" default:"ffmpeg"`
-	DesiredResolution string        `clop:"-d; --desired-resolution" usage:"desired resolution. Example: 1920x1080"`
+	DesiredResolution string        `clop:"-d; --desired-resolution" usage:"desired resolution, or the closest one. Example: 1920x1080"`
 	ListResolution    bool          `clop:"-l; --list-resolution" usage:"list resolution"`
+	Live              bool          `clop:"--live" usage:"record a live stream until it ends or is interrupted with Ctrl-C"`
+	MaxDuration       time.Duration `clop:"--max-duration" usage:"stop recording a live stream after this much media. Example: 2h"`
+	Resume            bool          `clop:"--resume" usage:"resume an interrupted download, using a journal next to the out file"`
+	MaxMemory         int           `clop:"--max-memory" usage:"megabytes of downloaded segments held in memory, the others are written to temporary files" default:"256"`
+	Keys              []string      `clop:"--key; greedy" usage:"decryption key in hex, used instead of downloading the key. Example: KEY, or KID:KEY for fMP4 segments encrypted with cenc or cbcs"`
+	KeyFile           string        `clop:"--key-file" usage:"file holding the decryption key, in binary or hex"`
+	KeyMap            []string      `clop:"--key-map; greedy" usage:"use a local key file for a key uri. Example: key.bin=/path/to/key.bin"`
+	KeyCommand        string        `clop:"--key-command" usage:"command printing the key, in binary or hex, of the uri in $M3U8_KEY_URI"`
+	AudioLang         []string      `clop:"--audio-lang; greedy" usage:"language of the audio renditions to download, or all. Example: en"`
+	AudioName         string        `clop:"--audio-name" usage:"name of the audio rendition to download"`
+	SubLang           []string      `clop:"--sub-lang; greedy" usage:"language of the subtitle renditions to download, all by default"`
+	NoSubs            bool          `clop:"--no-subs" usage:"don't download subtitle renditions"`
+	SubFormat         string        `clop:"--sub-format" usage:"format of the subtitle files, vtt or srt" default:"vtt"`
+	Select            string        `clop:"--select" usage:"variant selection expression. Example: height<=1080,bandwidth<5M,codec=hvc1|avc1,fps<=30,range=SDR"`
+	MaxHeight         int           `clop:"--max-height" usage:"maximum height of the variant"`
+	MaxBandwidth      string        `clop:"--max-bandwidth" usage:"maximum bandwidth of the variant. Example: 5M"`
+	Codecs            []string      `clop:"--codec; greedy" usage:"preferred video codecs of the variant, in order. Example: hvc1 avc1"`
+	Start             string        `clop:"--start" usage:"start of the part to download, an offset or a program date time. Example: 12:00, 720s or 2024-05-01T10:12:00Z"`
+	End               string        `clop:"--end" usage:"end of the part to download, an offset or a program date time. Example: 15:00"`
+	Segments          string        `clop:"--segments" usage:"numbers of the segments to download, counting from 1. Example: 100-250"`
+	PreciseClip       bool          `clop:"--precise-clip" usage:"trim the out file exactly at --start and --end, re-encoding the video. Requires -m"`
+	SplitPeriods      bool          `clop:"--split-periods" usage:"save every discontinuity period to its own file"`
+	Format            string        `clop:"--format" usage:"remux the MPEG-TS segments without ffmpeg, to mp4 or fmp4 (fragmented). fMP4 segments are joined to fmp4"`
+	SkipAds           bool          `clop:"--skip-ads" usage:"leave out the ad breaks marked in the playlist and report them"`
+	AdHosts           bool          `clop:"--ad-hosts" usage:"also take the discontinuity periods served from another host as ad breaks, with --skip-ads"`
+	Verify            bool          `clop:"--verify" usage:"check the packets, timestamps and duration of every segment, download again the ones failing and report them"`
+	Accept            []string      `clop:"--accept; greedy" usage:"more content types accepted for a kind of resource: playlist, key, segment or subtitle. Example: segment=text/plain"`
+	SegmentSize       string        `clop:"--segment-size" usage:"minimum and maximum size of the segments. Example: 10K-50M"`
+	NoValidate        bool          `clop:"--no-validate" usage:"accept any response with a 2xx status, without checking its content"`
+	Inspect           InspectConf   `clop:"subcommand=inspect" usage:"print a description of the playlist in JSON"`
 	headers           map[string]string
+	key               []byte
+	keys              map[string][]byte
+	keyMap            map[string][]byte
+	rules             map[zhttp.Kind]zhttp.Rule
+	selector          downloader.VariantSelector
+	clip              downloader.Clip
 }
 
 func init() {
 	conf = &Conf{}
 	clop.CommandLine.SetExit(true)
 	clop.SetVersion("1.5.3")
-	clop.Bind(&conf)
+	clop.Bind(conf)
+
+	if clop.IsSetSubcommand("inspect") {
+		checkInspectConf()
+		return
+	}
 
 	checkConf()
 
 	if len(conf.Headers) > 0 {
-		parseHeaders()
+		conf.headers = parseHeaders(conf.Headers)
+	}
+
+	err := parseKeys()
+	if err != nil {
+		fmt.Println(err)
+		clop.Usage()
+	}
+
+	err = parseSelector()
+	if err != nil {
+		fmt.Println(err)
+		clop.Usage()
+	}
+
+	err = parseClip()
+	if err != nil {
+		fmt.Println(err)
+		clop.Usage()
+	}
+
+	err = parseRules()
+	if err != nil {
+		fmt.Println(err)
+		clop.Usage()
 	}
 }
 
@@ -81,401 +137,374 @@ func checkConf() {
 	if conf.Timeout <= 0 {
 		conf.Timeout = time.Second * 60
 	}
-}
 
-func parseHeaders() {
-	conf.headers = map[string]string{}
-	for _, header := range conf.Headers {
-		s := strings.SplitN(header, ":", 2)
-		key := strings.TrimRight(s[0], " ")
-		if len(s) == 2 {
-			conf.headers[key] = strings.TrimLeft(s[1], " ")
-		} else {
-			conf.headers[key] = ""
-		}
+	if conf.MaxMemory < 0 {
+		conf.MaxMemory = 0
 	}
-}
-
-func startDownload(mpl *m3u8.MediaPlaylist) {
-	containMap := mpl.Map != nil && mpl.Map.URI != ""
-	count := mpl.Count()
-	if containMap {
-		count += 1
-	}
-
-	BAR = processbar.New(int(count))
-	BAR.Flush()
-
-	pool := hackpool.New(conf.Connections, download)
 
-	go func() {
-		if containMap {
-			pool.Push(mpl.Map.URI, conf.headers, conf.Retry, callback(0, nil, nil))
-		}
-
-		for i, segment := range mpl.GetAllSegments() {
-			key, iv, err := getKey(i, segment.Key)
-			if err != nil {
-				log.Fatalln("[-] Download failed: %w", err)
-			}
-			if containMap {
-				pool.Push(segment.URI, conf.headers, conf.Retry, callback(i+1, key, iv))
-			} else {
-				pool.Push(segment.URI, conf.headers, conf.Retry, callback(i, key, iv))
-			}
+	if conf.Live {
+		if conf.URL == "" || conf.File != "" {
+			fmt.Println("--live can only be used with the -u parameter")
+			clop.Usage()
 		}
-		pool.CloseQueue()
-	}()
-
-	pool.Run()
-
-	BAR.Finish()
-}
-
-func callback(id int, key, iv []byte) func([]byte, error) {
-	return func(data []byte, err error) {
-		if err != nil {
-			log.Fatalln("[-] Download failed:", id, err)
+		if conf.Resume {
+			fmt.Println("--live can not be used with --resume")
+			clop.Usage()
 		}
-
-		if key != nil {
-			data, err = decrypter.Decrypt(data, key, iv)
-			if err != nil {
-				log.Fatalln("[-] Decrypt failed:", err)
-			}
+		if conf.Start != "" || conf.End != "" || conf.Segments != "" {
+			fmt.Println("--live can not be used with --start, --end or --segments")
+			clop.Usage()
 		}
-
-		if !conf.NoFix {
-			data = ts.TryFix(data)
+		if conf.SkipAds {
+			fmt.Println("--live can not be used with --skip-ads")
+			clop.Usage()
 		}
+	}
 
-		err = JOINER.Add(id, data)
-		if err != nil {
-			log.Fatalln("[-] Write file failed:", err)
-		}
+	if conf.SplitPeriods && (conf.MergeWithFFmpeg || conf.Resume) {
+		fmt.Println("--split-periods can not be used with -m or --resume")
+		clop.Usage()
+	}
 
-		BAR.Incr()
-		BAR.Flush()
+	if conf.PreciseClip && !conf.MergeWithFFmpeg {
+		fmt.Println("--precise-clip can only be used with the -m parameter")
+		clop.Usage()
 	}
-}
 
-func getKey(id int, key *m3u8.Key) ([]byte, []byte, error) {
-	if key != nil && key.URI != "" {
-		var k, iv []byte
-		k, err := fetchKey(key.URI)
-		if err != nil {
-			return nil, nil, fmt.Errorf("download key from %s error: %w", key.URI, err)
+	if conf.Format != "" {
+		if conf.Format != "mp4" && conf.Format != "fmp4" {
+			fmt.Println("--format must be mp4 or fmp4")
+			clop.Usage()
 		}
-
-		if key.IV != "" {
-			iv, err = hex.DecodeString(strings.TrimPrefix(key.IV, "0x"))
-			if err != nil {
-				return nil, nil, fmt.Errorf("decode iv error: %w", err)
-			}
-		} else {
-			iv = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(id)}
+		if conf.MergeWithFFmpeg || conf.Resume || conf.SplitPeriods {
+			fmt.Println("--format can not be used with -m, --resume or --split-periods")
+			clop.Usage()
 		}
-		return k, iv, nil
 	}
 
-	return nil, nil, nil
-}
-
-func downloadM3u8(m3u8URL string) ([]byte, error) {
-	return get(m3u8URL, conf.headers, conf.Retry)
-}
-
-func fetchKey(url string) ([]byte, error) {
-	keyCacheLock.Lock()
-	defer keyCacheLock.Unlock()
-
-	key := keyCache[url]
-	if key != nil {
-		return key, nil
+	if conf.SkipAds && conf.PreciseClip {
+		fmt.Println("--skip-ads can not be used with --precise-clip")
+		clop.Usage()
 	}
 
-	key, err := get(url, conf.headers, conf.Retry)
-	if err != nil {
-		return nil, err
+	if conf.AdHosts && !conf.SkipAds {
+		fmt.Println("--ad-hosts can only be used with --skip-ads")
+		clop.Usage()
 	}
-
-	keyCache[url] = key
-
-	return key, nil
-}
-
-func download(args ...interface{}) {
-	url := args[0].(string)
-	headers := args[1].(map[string]string)
-	retry := args[2].(int)
-	fn := args[3].(func([]byte, error))
-
-	data, err := get(url, headers, retry)
-	fn(data, err)
 }
 
-func formatURI(base string, uri string) (string, error) {
-	if strings.HasPrefix(uri, "http") {
-		return uri, nil
+func parseHeaders(list []string) map[string]string {
+	headers := map[string]string{}
+	for _, header := range list {
+		s := strings.SplitN(header, ":", 2)
+		key := strings.TrimRight(s[0], " ")
+		if len(s) == 2 {
+			headers[key] = strings.TrimLeft(s[1], " ")
+		} else {
+			headers[key] = ""
+		}
 	}
+	return headers
+}
 
-	if base == "" {
-		return "", fmt.Errorf("base url must be set")
+// progress shows the progress of the download on a bar, created on the
+// first call.
+func progress(done, total int) {
+	if BAR == nil {
+		BAR = processbar.New(total)
 	}
+	BAR.Set(done, total)
+	BAR.Flush()
+}
 
-	u, err := url.Parse(base)
+func printVariants(d *downloader.Downloader) error {
+	variants, err := d.Variants(context.Background(), conf.URL)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	u, err = u.Parse(uri)
-	if err != nil {
-		return "", err
+	var list []string
+	for _, v := range variants {
+		list = append(list, formatVariant(v))
+		for _, alt := range v.Alternatives {
+			typ := "Audio:"
+			if alt.Type == "SUBTITLES" {
+				typ = "Subtitle:"
+			}
+			line := fmt.Sprintf("    %-9s Language: %-6s Name: %s", typ, alt.Language, alt.Name)
+			if alt.Default {
+				line += " (default)"
+			}
+			list = append(list, line)
+		}
 	}
-
-	return u.String(), nil
+	fmt.Println(strings.Join(list, "\n"))
+	return nil
 }
 
-func filename(u string, u1 string) string {
-	obj, _ := url.Parse(u)
-	_, filename := filepath.Split(obj.Path)
-	if filename == "" {
-		filename = "index_" + time.Now().Format("20060102150405")
-	}
-	ext := filepath.Ext(filename)
-	lowerExt := strings.ToLower(ext)
-	if lowerExt == ".ts" || lowerExt == ".mp4" {
-		return filename
-	}
-	filename = strings.TrimSuffix(filename, ext)
-
-	o1, _ := url.Parse(u1)
-	_, f1 := filepath.Split(o1.Path)
-	ext = filepath.Ext(f1)
-	if ext == ".m4s" {
-		ext = ".mp4"
+func main() {
+	if clop.IsSetSubcommand("inspect") {
+		inspect()
+		return
 	}
 
-	return filename + ext
-}
-
-func get(url string, headers map[string]string, retry int) ([]byte, error) {
-	statusCode, data, err := ZHTTP.Get(url, headers, retry)
+	client, err := zhttp.NewClient(conf.Timeout, conf.Proxy, conf.SkipVerify)
 	if err != nil {
-		return nil, err
-	}
-
-	if statusCode/100 != 2 || len(data) == 0 {
-		return nil, fmt.Errorf("http status code: %d", statusCode)
+		log.Fatalln("[-] Initialization failed:", err)
 	}
 
-	return data, nil
-}
-
-func parseM3u8(m3u8URL string, desiredResolution string, data []byte) (*m3u8.MediaPlaylist, error) {
-	if data != nil {
-		playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(data), true)
+	var data []byte
+	if conf.File != "" {
+		data, err = os.ReadFile(conf.File)
 		if err != nil {
-			return nil, err
-		}
-
-		if listType == m3u8.MEDIA {
-			mpl := playlist.(*m3u8.MediaPlaylist)
-
-			if mpl.Map != nil && mpl.Map.URI != "" {
-				uri, err := formatURI(m3u8URL, mpl.Map.URI)
-				if err != nil {
-					return nil, fmt.Errorf("format uri failed: %w", err)
-				}
-				mpl.Map.URI = uri
-			}
-
-			if mpl.Key != nil && mpl.Key.URI != "" {
-				uri, err := formatURI(m3u8URL, mpl.Key.URI)
-				if err != nil {
-					return nil, fmt.Errorf("format uri failed: %w", err)
-				}
-				mpl.Key.URI = uri
-			}
-
-			for _, segment := range mpl.GetAllSegments() {
-				uri, err := formatURI(m3u8URL, segment.URI)
-				if err != nil {
-					return nil, fmt.Errorf("format uri failed: %w", err)
-				}
-				segment.URI = uri
-
-				if segment.Key == nil && mpl.Key != nil {
-					segment.Key = mpl.Key
-				}
-
-				if segment.Key != nil && segment.Key.URI != "" {
-					uri, err := formatURI(m3u8URL, segment.Key.URI)
-					if err != nil {
-						return nil, fmt.Errorf("format uri failed: %w", err)
-					}
-					segment.Key.URI = uri
-				}
-			}
-
-			return mpl, nil
-			// Master Playlist
-		} else {
-			mpl := playlist.(*m3u8.MasterPlaylist)
-			variant, err := findVariant(mpl.Variants, desiredResolution)
-			if err != nil {
-				return nil, err
-			}
-
-			u, err := formatURI(m3u8URL, variant.URI)
-			if err != nil {
-				return nil, fmt.Errorf("format uri failed: %w", err)
-			}
-			return parseM3u8(u, desiredResolution, nil)
+			log.Fatalln("[-] Load m3u8 file failed:", err)
 		}
 	}
 
-	data, err := downloadM3u8(m3u8URL)
+	// ask which variant to download when none is selected by the options
+	var pick func([]*m3u8.Variant) (*m3u8.Variant, error)
+	if !variantSelected() && !conf.ListResolution && stdinIsTerminal() {
+		pick = pickVariant
+	}
+
+	maxMemory := int64(conf.MaxMemory) << 20
+	if maxMemory == 0 {
+		// every segment is written to a temporary file
+		maxMemory = -1
+	}
+
+	d, err := downloader.New(downloader.Options{
+		OutFile:         conf.OutFile,
+		Connections:     conf.Connections,
+		Retry:           conf.Retry,
+		Headers:         conf.headers,
+		Playlist:        data,
+		Selector:        conf.selector,
+		PickVariant:     pick,
+		NoFix:           conf.NoFix,
+		MaxMemory:       maxMemory,
+		Resume:          conf.Resume,
+		Live:            conf.Live,
+		MaxDuration:     conf.MaxDuration,
+		Clip:            conf.clip,
+		SkipAds:         conf.SkipAds,
+		AdHosts:         conf.AdHosts,
+		Verify:          conf.Verify,
+		Rules:           conf.rules,
+		Key:             conf.key,
+		KeyMap:          conf.keyMap,
+		KeyCommand:      conf.KeyCommand,
+		CENCKeys:        conf.keys,
+		AudioLang:       conf.AudioLang,
+		AudioName:       conf.AudioName,
+		SubtitleLang:    conf.SubLang,
+		NoSubtitles:     conf.NoSubs,
+		SubtitleFormat:  conf.SubFormat,
+		MergeWithFFmpeg: conf.MergeWithFFmpeg,
+		SplitPeriods:    conf.SplitPeriods,
+		Format:          conf.Format,
+		FFmpeg:          conf.FFmpeg,
+		Client:          client,
+		Progress:        progress,
+		Logger:          log.Default(),
+	})
 	if err != nil {
-		return nil, err
+		log.Fatalln("[-] Initialization failed:", err)
 	}
-	return parseM3u8(m3u8URL, desiredResolution, data)
-}
 
-func listResolution(m3u8URL string, data []byte) error {
-	if data != nil {
-		playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(data), true)
+	if conf.ListResolution {
+		err := printVariants(d)
 		if err != nil {
-			return err
-		}
-
-		if listType == m3u8.MEDIA {
-			return fmt.Errorf("resource is not a playlist")
-		} else {
-			mpl := playlist.(*m3u8.MasterPlaylist)
-			var list []string
-			for _, v := range mpl.Variants {
-				if v.Iframe {
-					continue
-				}
-				list = append(list, fmt.Sprintf("Resolution: %-9s Bandwidth: %-8d FrameRate: %.2f Codecs: %s", v.Resolution, v.Bandwidth, v.FrameRate, v.Codecs))
-			}
-			fmt.Println(strings.Join(list, "\n"))
-			return nil
+			log.Fatalln("[-] Parse m3u8 file failed:", err)
 		}
+		return
 	}
 
-	data, err := downloadM3u8(m3u8URL)
+	// Ctrl-C stops the download, a second one terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	result, err := d.Download(ctx, conf.URL)
+	if BAR != nil {
+		BAR.Finish()
+	}
+	if errors.Is(err, downloader.ErrResumable) {
+		log.Println("[-]", err)
+		log.Fatalln("[-] Run the same command with --resume to continue")
+	}
 	if err != nil {
-		return err
+		log.Fatalln("[-]", err)
 	}
-	return listResolution(m3u8URL, data)
-}
 
-func findVariant(variants []*m3u8.Variant, resolution string) (*m3u8.Variant, error) {
-	if len(variants) == 0 {
-		return nil, fmt.Errorf("variants not found")
+	if len(result.Periods) > 1 {
+		log.Println("[+] Saved", len(result.Periods), "discontinuity periods to", strings.Join(result.Periods, ", "))
+	} else if result.OutFile != "" {
+		log.Println("[+] Saved to", result.OutFile)
 	}
-
-	sort.Slice(variants, func(i, j int) bool {
-		if variants[i].Resolution != "" && variants[j].Resolution != "" {
-			widthi, heighti := parseResolution(variants[i].Resolution)
-			widthj, heightj := parseResolution(variants[j].Resolution)
-			if widthi*heighti < widthj*heightj {
-				return false
-			} else if widthi*heighti > widthj*heightj {
-				return true
-			}
+	for _, track := range result.Tracks {
+		files := track.OutFile
+		if len(track.Periods) > 1 {
+			files = strings.Join(track.Periods, ", ")
 		}
+		log.Println("[+] Saved", strings.ToLower(track.Type), track.Language, "to", files)
+	}
 
-		return variants[i].Bandwidth > variants[j].Bandwidth
-	})
-
-	if resolution != "" {
-		for _, v := range variants {
-			if v.Iframe {
-				continue
-			}
-			if v.Resolution == resolution {
-				return v, nil
-			}
+	printAds(result.Ads)
+	if conf.Verify {
+		printHealth("", result.Health)
+		for _, track := range result.Tracks {
+			printHealth(strings.ToLower(track.Type)+" "+track.Language+" ", track.Health)
 		}
-
-		return nil, fmt.Errorf("resolution %s not found", resolution)
 	}
-
-	return variants[0], nil
 }
 
-func parseResolution(resolution string) (uint64, uint64) {
-	arr := strings.Split(resolution, "x")
-	if len(arr) != 2 {
-		return 0, 0
-	}
-	width, err := strconv.ParseUint(arr[0], 10, 64)
-	if err != nil {
-		return 0, 0
+// printAds reports the ad breaks left out.
+func printAds(ads []downloader.AdBreak) {
+	if len(ads) == 0 {
+		return
 	}
-	height, err := strconv.ParseUint(arr[1], 10, 64)
-	if err != nil {
-		return 0, 0
+	var total time.Duration
+	for _, ad := range ads {
+		total += ad.Duration
+		log.Printf("[+] Skipped ad break at %s, %s in %d segments, marked by %s",
+			ad.Start.Round(time.Millisecond), ad.Duration.Round(time.Millisecond), ad.Segments, ad.Source)
 	}
-	return width, height
+	log.Printf("[+] Ad breaks skipped: %d, %s in total", len(ads), total.Round(time.Millisecond))
 }
 
-func main() {
-	var err error
-	ZHTTP, err = zhttp.New(conf.Timeout, conf.Proxy, conf.SkipVerify)
-	if err != nil {
-		log.Fatalln("[-] Initialization failed:", err)
+// printHealth reports the segments failing the checks of --verify.
+func printHealth(track string, health []downloader.SegmentHealth) {
+	if len(health) == 0 {
+		return
+	}
+	var flagged, refetched int
+	for _, h := range health {
+		if h.Refetched > 0 {
+			refetched++
+		}
+		if h.OK() {
+			continue
+		}
+		flagged++
+		msg := fmt.Sprintf("[!] Segment %d of %s%s: %s", h.Sequence, track, h.URI, strings.Join(h.Problems, ", "))
+		if h.Refetched > 0 {
+			msg += fmt.Sprintf(" (downloaded %d times)", h.Refetched+1)
+		}
+		log.Println(msg)
 	}
+	log.Printf("[+] Verified %d %ssegments: %d OK, %d flagged, %d downloaded again",
+		len(health), track, len(health)-flagged, flagged, refetched)
+}
 
-	var data []byte
-	if conf.File != "" {
-		data, err = os.ReadFile(conf.File)
+func parseClip() error {
+	var err error
+	c := downloader.Clip{Precise: conf.PreciseClip}
+	if conf.Start != "" {
+		c.Start, c.StartTime, err = downloader.ParseClipTime(conf.Start)
 		if err != nil {
-			log.Fatalln("[-] Load m3u8 file failed:", err)
+			return err
 		}
 	}
-
-	if conf.ListResolution {
-		err := listResolution(conf.URL, data)
+	if conf.End != "" {
+		c.End, c.EndTime, err = downloader.ParseClipTime(conf.End)
 		if err != nil {
-			log.Fatalln("[-] Parse m3u8 file failed:", err)
+			return err
 		}
-		return
 	}
-
-	mpl, err := parseM3u8(conf.URL, conf.DesiredResolution, data)
-	if err != nil {
-		log.Fatalln("[-] Parse m3u8 file failed:", err)
+	if conf.Segments != "" {
+		c.FirstSegment, c.LastSegment, err = downloader.ParseSegmentRange(conf.Segments)
+		if err != nil {
+			return err
+		}
 	}
+	conf.clip = c
+	return nil
+}
 
-	outFile := conf.OutFile
-	if outFile == "" {
-		outFile = filename(conf.URL, mpl.Segments[0].URI)
+// parseRules builds the rules checking the responses from --accept,
+// --segment-size and --no-validate.
+func parseRules() error {
+	rules := zhttp.DefaultRules()
+	if conf.NoValidate {
+		rules = map[zhttp.Kind]zhttp.Rule{}
+		for _, kind := range []zhttp.Kind{zhttp.Playlist, zhttp.Key, zhttp.Segment, zhttp.Subtitle, zhttp.Encrypted} {
+			rules[kind] = zhttp.Rule{}
+		}
 	}
 
-	if conf.MergeWithFFmpeg {
-		JOINER, err = joiner.NewFFmepg(conf.FFmpeg, outFile)
-		if err != nil {
-			log.Fatalln("[-]", err)
+	for _, accept := range conf.Accept {
+		name, types, ok := strings.Cut(accept, "=")
+		if !ok || types == "" {
+			return fmt.Errorf("invalid --accept %s, must be kind=type,type", accept)
 		}
-	} else {
-		JOINER, err = joiner.NewMem(outFile)
+		kind, err := zhttp.ParseKind(name)
 		if err != nil {
-			log.Fatalln("[-]", err)
+			return err
+		}
+		// the encrypted segments are served like the other ones
+		kinds := []zhttp.Kind{kind}
+		if kind == zhttp.Segment {
+			kinds = append(kinds, zhttp.Encrypted)
+		}
+		for _, kind := range kinds {
+			rule := rules[kind]
+			rule.ContentTypes = append(rule.ContentTypes, strings.Split(types, ",")...)
+			rules[kind] = rule
 		}
 	}
 
-	if mpl.Count() > 0 {
-		startDownload(mpl)
-
-		err = JOINER.Merge()
-		if err != nil {
-			log.Fatalln("[-] Saved to", outFile, "failed:", err)
-		} else {
-			log.Println("[+] Saved to", outFile)
+	if conf.SegmentSize != "" {
+		from, to, _ := strings.Cut(conf.SegmentSize, "-")
+		var minSize, maxSize int64
+		var err error
+		if from != "" {
+			minSize, err = parseSize(from)
+			if err != nil {
+				return err
+			}
+		}
+		if to != "" {
+			maxSize, err = parseSize(to)
+			if err != nil {
+				return err
+			}
+		}
+		if maxSize > 0 && maxSize < minSize {
+			return fmt.Errorf("invalid segment size %s", conf.SegmentSize)
+		}
+		for _, kind := range []zhttp.Kind{zhttp.Segment, zhttp.Encrypted} {
+			rule := rules[kind]
+			rule.MinSize, rule.MaxSize = minSize, maxSize
+			rules[kind] = rule
 		}
 	}
+
+	conf.rules = rules
+	return nil
+}
+
+// parseSize accepts a number of bytes with an optional K, M or G suffix, in
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	size := s
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * mult, nil
 }
@@ -0,0 +1,52 @@
+package mp4
+
+import "fmt"
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// aacFrameSamples is the number of samples of an AAC frame.
+const aacFrameSamples = 1024
+
+// adtsHeader is the header of an AAC frame in an ADTS stream.
+type adtsHeader struct {
+	objectType  uint8
+	rateIndex   uint8
+	channels    uint8
+	headerSize  int
+	frameLength int
+}
+
+func parseADTS(data []byte) (adtsHeader, error) {
+	var h adtsHeader
+	if len(data) < 7 {
+		return h, errShortData
+	}
+	if data[0] != 0xff || data[1]&0xf6 != 0xf0 {
+		return h, fmt.Errorf("invalid adts sync word")
+	}
+	h.headerSize = 7
+	if data[1]&0x01 == 0 {
+		// crc
+		h.headerSize = 9
+	}
+	h.objectType = data[2]>>6 + 1
+	h.rateIndex = data[2] >> 2 & 0x0f
+	h.channels = data[2]&0x01<<2 | data[3]>>6
+	h.frameLength = int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	if int(h.rateIndex) >= len(aacSampleRates) {
+		return h, fmt.Errorf("invalid adts sample rate index %d", h.rateIndex)
+	}
+	if h.frameLength < h.headerSize {
+		return h, fmt.Errorf("invalid adts frame length %d", h.frameLength)
+	}
+	return h, nil
+}
+
+func (h adtsHeader) sampleRate() int {
+	return aacSampleRates[h.rateIndex]
+}
+
+// audioSpecificConfig returns the AudioSpecificConfig of the esds box.
+func (h adtsHeader) audioSpecificConfig() []byte {
+	return []byte{h.objectType<<3 | h.rateIndex>>1, h.rateIndex<<7 | h.channels<<3}
+}
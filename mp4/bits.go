@@ -0,0 +1,116 @@
+package mp4
+
+import "errors"
+
+var errShortData = errors.New("data too short")
+
+// bitReader reads the fields of a parameter set. Reading past the end
+// returns zeros and sets err.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortData
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.data)*8 {
+		r.err = errShortData
+	}
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("invalid exp-golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 != 0 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// unescape removes the emulation prevention bytes of a NAL unit.
+func unescape(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// splitNALUs returns the NAL units of an Annex B byte stream.
+func splitNALUs(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, trimZeros(data[start:i]))
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, trimZeros(data[start:]))
+	}
+
+	list := nalus[:0]
+	for _, n := range nalus {
+		if len(n) > 0 {
+			list = append(list, n)
+		}
+	}
+	return list
+}
+
+// trimZeros removes the zero byte of a 4 byte start code and the trailing
+// zeros of a NAL unit.
+func trimZeros(nalu []byte) []byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	return nalu
+}
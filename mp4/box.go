@@ -0,0 +1,62 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// buffer builds boxes in memory.
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) u8(v uint8) {
+	b.WriteByte(v)
+}
+
+func (b *buffer) u16(v uint16) {
+	b.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (b *buffer) u32(v uint32) {
+	b.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (b *buffer) u64(v uint64) {
+	b.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (b *buffer) zeros(n int) {
+	b.Write(make([]byte, n))
+}
+
+// box writes a box of type typ, whose content is written by fn.
+func (b *buffer) box(typ string, fn func()) {
+	start := b.Len()
+	b.u32(0)
+	b.WriteString(typ)
+	fn()
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+func (b *buffer) fullBox(typ string, version uint8, flags uint32, fn func()) {
+	b.box(typ, func() {
+		b.u32(uint32(version)<<24 | flags)
+		fn()
+	})
+}
+
+// matrix writes the identity transformation matrix of mvhd and tkhd.
+func (b *buffer) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
+
+// descriptor writes an MPEG-4 descriptor of the esds box, shorter than 128
+// bytes.
+func (b *buffer) descriptor(tag uint8, content []byte) {
+	b.u8(tag)
+	b.u8(uint8(len(content)))
+	b.Write(content)
+}
@@ -0,0 +1,691 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// FragmentWriter joins fMP4 segments into one fragmented MP4 file. The
+// sample entries of every init segment are merged into one moov box, the
+// decode times of the fragments are made to start at 0 and to continue at
+// the discontinuities, and the file ends with an mfra box indexing the
+// fragments that start with a sync sample. The styp, sidx, emsg and prft
+// boxes of the segments are dropped. The fragments are stored in a temporary
+// file next to the out file until Close.
+type FragmentWriter struct {
+	outFile  string
+	tmp      *os.File
+	w        *bufio.Writer
+	size     int64
+	ftyp     *Box
+	moov     *Box
+	tracks   []*fragTrack
+	ids      map[uint32]*fragTrack
+	section  map[uint32]*sectionTrack
+	sequence uint32
+	// origin is the decode time of the first fragment, in seconds
+	origin float64
+	known  bool
+}
+
+type fragTrack struct {
+	id        uint32
+	timescale uint32
+	trak      *Box
+	trex      *Box
+	entries   []*Box
+	// offset is added to the decode times of the fragments, next is where
+	// the last fragment ends. in is where the last fragment ends in the
+	// segments, for the fragments without tfdt.
+	offset int64
+	next   int64
+	in     int64
+	known  bool
+	rebase bool
+	random []randomAccess
+}
+
+// sectionTrack holds the defaults of a track of the current init segment,
+// and the index in the merged sample entries of each of its own.
+type sectionTrack struct {
+	descriptionIndex uint32
+	duration         uint32
+	size             uint32
+	flags            uint32
+	descriptions     []uint32
+}
+
+// randomAccess is an entry of the tfra box.
+type randomAccess struct {
+	time   int64
+	offset int64
+	traf   int
+}
+
+const (
+	tfhdBaseDataOffset    = 0x01
+	tfhdDescriptionIndex  = 0x02
+	tfhdDefaultDuration   = 0x08
+	tfhdDefaultSize       = 0x10
+	tfhdDefaultFlags      = 0x20
+	tfhdDurationIsEmpty   = 0x010000
+	tfhdDefaultBaseIsMoof = 0x020000
+
+	trunDataOffset      = 0x01
+	trunFirstFlags      = 0x04
+	trunSampleDuration  = 0x100
+	trunSampleSize      = 0x200
+	trunSampleFlags     = 0x400
+	trunCompositionTime = 0x800
+
+	sampleIsNonSync = 0x10000
+)
+
+func NewFragmentWriter(outFile string) (*FragmentWriter, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(outFile), filepath.Base(outFile)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &FragmentWriter{
+		outFile: outFile,
+		tmp:     tmp,
+		w:       bufio.NewWriter(tmp),
+		ids:     map[uint32]*fragTrack{},
+	}, nil
+}
+
+// Add adds a segment. An init segment starts a new map section, the
+// fragments of a media segment are appended.
+func (f *FragmentWriter) Add(segment []byte) error {
+	boxes, err := Parse(segment)
+	if err != nil {
+		return err
+	}
+
+	if moov := Find(boxes, "moov"); moov != nil {
+		err = f.init(Find(boxes, "ftyp"), moov)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, moof := range boxes {
+		if moof.Type != "moof" {
+			continue
+		}
+		if f.section == nil {
+			return fmt.Errorf("fragment before the init segment")
+		}
+
+		var mdat *Box
+		for _, b := range boxes[i+1:] {
+			if b.Type == "moof" {
+				break
+			}
+			if b.Type == "mdat" {
+				mdat = b
+				break
+			}
+		}
+		if mdat == nil {
+			return fmt.Errorf("mdat box of fragment at %d not found", moof.Offset)
+		}
+
+		if !f.known {
+			f.setOrigin(boxes[i:])
+		}
+		err = f.fragment(segment, moof, mdat)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discontinuity makes the decode times of the next fragments continue after
+// the last one of their track, whatever their value.
+func (f *FragmentWriter) Discontinuity() {
+	for _, t := range f.tracks {
+		t.rebase = true
+	}
+}
+
+func (f *FragmentWriter) init(ftyp, moov *Box) error {
+	if f.moov == nil {
+		f.ftyp = ftyp
+		f.moov = moov
+	}
+
+	trex := map[uint32]*Box{}
+	if mvex := moov.Find("mvex"); mvex != nil {
+		for _, b := range mvex.FindAll("trex") {
+			if len(b.Data) >= 24 {
+				trex[binary.BigEndian.Uint32(b.Data[4:])] = b
+			}
+		}
+	}
+
+	section := map[uint32]*sectionTrack{}
+	for _, trak := range moov.FindAll("trak") {
+		tkhd := trak.Find("tkhd")
+		mdhd := trak.Find("mdia", "mdhd")
+		stsd := trak.Find("mdia", "minf", "stbl", "stsd")
+		if tkhd == nil || mdhd == nil || stsd == nil {
+			return fmt.Errorf("incomplete track in init segment")
+		}
+		id, ok := field32(tkhd, 12, 20)
+		if !ok {
+			return fmt.Errorf("tkhd box too short")
+		}
+		timescale, ok := field32(mdhd, 12, 20)
+		if !ok || timescale == 0 {
+			return fmt.Errorf("invalid mdhd box of track %d", id)
+		}
+
+		t := f.ids[id]
+		if t == nil {
+			t = &fragTrack{id: id, timescale: timescale, trak: trak, trex: trex[id]}
+			f.ids[id] = t
+			f.tracks = append(f.tracks, t)
+		} else if t.timescale != timescale {
+			return fmt.Errorf("timescale of track %d changes from %d to %d", id, t.timescale, timescale)
+		}
+
+		s := &sectionTrack{descriptionIndex: 1}
+		if b := trex[id]; b != nil {
+			s.descriptionIndex = binary.BigEndian.Uint32(b.Data[8:])
+			s.duration = binary.BigEndian.Uint32(b.Data[12:])
+			s.size = binary.BigEndian.Uint32(b.Data[16:])
+			s.flags = binary.BigEndian.Uint32(b.Data[20:])
+		}
+		for _, entry := range stsd.Children {
+			s.descriptions = append(s.descriptions, t.addEntry(entry))
+		}
+		section[id] = s
+	}
+	f.section = section
+	return nil
+}
+
+// addEntry returns the index of a sample entry in the merged ones, adding it
+// when it differs from them.
+func (t *fragTrack) addEntry(entry *Box) uint32 {
+	data := entry.Encode(nil)
+	for i, e := range t.entries {
+		if bytes.Equal(e.Encode(nil), data) {
+			return uint32(i + 1)
+		}
+	}
+	t.entries = append(t.entries, entry)
+	return uint32(len(t.entries))
+}
+
+// field32 reads a field of a full box at offset v0 in version 0, v1 in
+// version 1.
+func field32(b *Box, v0, v1 int) (uint32, bool) {
+	p := v0
+	if version, _ := b.FullBox(); version == 1 {
+		p = v1
+	}
+	if len(b.Data) < p+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b.Data[p:]), true
+}
+
+// setOrigin makes the earliest track of the first fragments start at 0, the
+// others keeping their distance to it.
+func (f *FragmentWriter) setOrigin(boxes []*Box) {
+	f.origin = math.MaxFloat64
+	for _, moof := range boxes {
+		for _, traf := range moof.FindAll("traf") {
+			tfhd := traf.Find("tfhd")
+			tfdt := traf.Find("tfdt")
+			if tfhd == nil || len(tfhd.Data) < 8 || tfdt == nil {
+				continue
+			}
+			t := f.ids[binary.BigEndian.Uint32(tfhd.Data[4:])]
+			v, ok := decodeTime(tfdt)
+			if t != nil && ok {
+				f.origin = math.Min(f.origin, float64(v)/float64(t.timescale))
+			}
+		}
+	}
+	if f.origin == math.MaxFloat64 {
+		f.origin = 0
+	}
+	f.known = true
+}
+
+func decodeTime(tfdt *Box) (int64, bool) {
+	version, _ := tfdt.FullBox()
+	switch {
+	case version == 1 && len(tfdt.Data) >= 12:
+		return int64(binary.BigEndian.Uint64(tfdt.Data[4:])), true
+	case version == 0 && len(tfdt.Data) >= 8:
+		return int64(binary.BigEndian.Uint32(tfdt.Data[4:])), true
+	}
+	return 0, false
+}
+
+// trafInfo is what the mfra box needs of a track fragment.
+type trafInfo struct {
+	track *fragTrack
+	time  int64
+	sync  bool
+}
+
+// run is a trun box rewritten with a data offset, and the position of its
+// samples in the segment.
+type run struct {
+	box *Box
+	pos int
+}
+
+// fragment writes a moof box rewritten with the decode times and data
+// offsets of the out file, and the mdat box that follows it.
+func (f *FragmentWriter) fragment(data []byte, moof, mdat *Box) error {
+	mdatStart := mdat.Offset + 8
+	if binary.BigEndian.Uint32(data[mdat.Offset:]) == 1 {
+		mdatStart += 8
+	}
+	mdatEnd := mdatStart + len(mdat.Data)
+
+	f.sequence++
+	out := &Box{Type: "moof"}
+	var runs []run
+	var trafs []trafInfo
+	end := moof.Offset
+	for _, c := range moof.Children {
+		switch c.Type {
+		case "mfhd":
+			var b buffer
+			b.u32(0)
+			b.u32(f.sequence)
+			out.Children = append(out.Children, &Box{Type: "mfhd", Data: b.Bytes()})
+		case "traf":
+			traf, info, list, err := f.traf(c, moof, &end, mdatStart, mdatEnd)
+			if err != nil {
+				return err
+			}
+			out.Children = append(out.Children, traf)
+			runs = append(runs, list...)
+			trafs = append(trafs, info)
+		default:
+			out.Children = append(out.Children, c)
+		}
+	}
+
+	size := out.Size()
+	header := 8
+	if len(mdat.Data)+8 > math.MaxUint32 {
+		header = 16
+	}
+	for _, r := range runs {
+		binary.BigEndian.PutUint32(r.box.Data[8:], uint32(size+header+r.pos-mdatStart))
+	}
+	for i, info := range trafs {
+		if info.sync {
+			info.track.random = append(info.track.random, randomAccess{time: info.time, offset: f.size, traf: i + 1})
+		}
+	}
+
+	var b buffer
+	if header == 16 {
+		b.u32(1)
+		b.WriteString("mdat")
+		b.u64(uint64(len(mdat.Data) + 16))
+	} else {
+		b.u32(uint32(len(mdat.Data) + 8))
+		b.WriteString("mdat")
+	}
+	for _, chunk := range [][]byte{out.Encode(nil), b.Bytes(), data[mdatStart:mdatEnd]} {
+		_, err := f.w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		f.size += int64(len(chunk))
+	}
+	return nil
+}
+
+// traf returns a track fragment with the defaults of the map section made
+// explicit, its decode time in the out file and its data offsets to be set
+// by the caller. end is where the data of the previous track fragment ends.
+func (f *FragmentWriter) traf(traf, moof *Box, end *int, mdatStart, mdatEnd int) (*Box, trafInfo, []run, error) {
+	var info trafInfo
+	tfhd := traf.Find("tfhd")
+	if tfhd == nil || len(tfhd.Data) < 8 {
+		return nil, info, nil, fmt.Errorf("tfhd box not found")
+	}
+	_, flags := tfhd.FullBox()
+	id := binary.BigEndian.Uint32(tfhd.Data[4:])
+	t := f.ids[id]
+	s := f.section[id]
+	if t == nil || s == nil {
+		return nil, info, nil, fmt.Errorf("track %d not found in the init segment", id)
+	}
+	info.track = t
+
+	description, duration, size, sampleFlags := s.descriptionIndex, s.duration, s.size, s.flags
+	base := *end
+	if flags&tfhdDefaultBaseIsMoof != 0 {
+		base = moof.Offset
+	}
+	d := tfhd.Data[8:]
+	for _, field := range []struct {
+		flag uint32
+		v    *uint32
+	}{
+		{tfhdBaseDataOffset, nil},
+		{tfhdDescriptionIndex, &description},
+		{tfhdDefaultDuration, &duration},
+		{tfhdDefaultSize, &size},
+		{tfhdDefaultFlags, &sampleFlags},
+	} {
+		if flags&field.flag == 0 {
+			continue
+		}
+		if field.v == nil {
+			if len(d) < 8 {
+				return nil, info, nil, fmt.Errorf("tfhd box too short")
+			}
+			base = int(binary.BigEndian.Uint64(d))
+			d = d[8:]
+			continue
+		}
+		if len(d) < 4 {
+			return nil, info, nil, fmt.Errorf("tfhd box too short")
+		}
+		*field.v = binary.BigEndian.Uint32(d)
+		d = d[4:]
+	}
+	if description < 1 || int(description) > len(s.descriptions) {
+		return nil, info, nil, fmt.Errorf("invalid sample description index %d of track %d", description, id)
+	}
+
+	var b buffer
+	b.u32(tfhdDefaultBaseIsMoof | tfhdDescriptionIndex | tfhdDefaultDuration | tfhdDefaultSize | tfhdDefaultFlags | flags&tfhdDurationIsEmpty)
+	b.u32(id)
+	b.u32(s.descriptions[description-1])
+	b.u32(duration)
+	b.u32(size)
+	b.u32(sampleFlags)
+	out := &Box{Type: "traf", Children: []*Box{{Type: "tfhd", Data: b.Bytes()}, nil}}
+
+	var runs []run
+	var total int64
+	next := base
+	first := true
+	for _, c := range traf.Children {
+		switch c.Type {
+		case "tfhd", "tfdt":
+			continue
+		case "trun":
+		default:
+			out.Children = append(out.Children, c)
+			continue
+		}
+
+		_, flags := c.FullBox()
+		if len(c.Data) < 8 {
+			return nil, info, nil, fmt.Errorf("trun box too short")
+		}
+		count := int(binary.BigEndian.Uint32(c.Data[4:]))
+		p := 8
+		if flags&trunDataOffset != 0 {
+			if len(c.Data) < p+4 {
+				return nil, info, nil, fmt.Errorf("trun box too short")
+			}
+			next = base + int(int32(binary.BigEndian.Uint32(c.Data[p:])))
+			p += 4
+		}
+		rest := c.Data[p:]
+		firstFlags := sampleFlags
+		if flags&trunFirstFlags != 0 {
+			if len(c.Data) < p+4 {
+				return nil, info, nil, fmt.Errorf("trun box too short")
+			}
+			firstFlags = binary.BigEndian.Uint32(c.Data[p:])
+			p += 4
+		}
+
+		pos := next
+		stride := 0
+		for _, flag := range []uint32{trunSampleDuration, trunSampleSize, trunSampleFlags, trunCompositionTime} {
+			if flags&flag != 0 {
+				stride += 4
+			}
+		}
+		if len(c.Data) < p+count*stride {
+			return nil, info, nil, fmt.Errorf("trun box too short")
+		}
+		for i := 0; i < count; i++ {
+			q := p + i*stride
+			if flags&trunSampleDuration != 0 {
+				total += int64(binary.BigEndian.Uint32(c.Data[q:]))
+				q += 4
+			} else {
+				total += int64(duration)
+			}
+			if flags&trunSampleSize != 0 {
+				next += int(binary.BigEndian.Uint32(c.Data[q:]))
+				q += 4
+			} else {
+				next += int(size)
+			}
+			if i == 0 && first && flags&trunFirstFlags == 0 && flags&trunSampleFlags != 0 {
+				firstFlags = binary.BigEndian.Uint32(c.Data[q:])
+			}
+		}
+		if count > 0 && first {
+			info.sync = firstFlags&sampleIsNonSync == 0
+			first = false
+		}
+		if count > 0 && (pos < mdatStart || next > mdatEnd) {
+			return nil, info, nil, fmt.Errorf("samples of track %d are out of the mdat box", id)
+		}
+
+		var rb buffer
+		rb.u32(binary.BigEndian.Uint32(c.Data) | trunDataOffset)
+		rb.u32(uint32(count))
+		rb.u32(0)
+		rb.Write(rest)
+		r := &Box{Type: "trun", Data: rb.Bytes()}
+		out.Children = append(out.Children, r)
+		runs = append(runs, run{box: r, pos: pos})
+	}
+	*end = next
+
+	in := t.in
+	if tfdt := traf.Find("tfdt"); tfdt != nil {
+		v, ok := decodeTime(tfdt)
+		if !ok {
+			return nil, info, nil, fmt.Errorf("tfdt box too short")
+		}
+		in = v
+	}
+	if !t.known {
+		t.offset = -int64(math.Round(f.origin * float64(t.timescale)))
+		t.known = true
+	}
+	// the decode times continue at the discontinuities, and never go back
+	if t.rebase || in+t.offset < t.next {
+		t.offset = t.next - in
+		t.rebase = false
+	}
+	info.time = in + t.offset
+	t.in = in + total
+	t.next = info.time + total
+
+	var db buffer
+	db.u32(1 << 24)
+	db.u64(uint64(info.time))
+	out.Children[1] = &Box{Type: "tfdt", Data: db.Bytes()}
+	return out, info, runs, nil
+}
+
+// Close writes the out file and removes the temporary file.
+func (f *FragmentWriter) Close() error {
+	defer os.Remove(f.tmp.Name())
+	defer f.tmp.Close()
+
+	err := f.w.Flush()
+	if err != nil {
+		return err
+	}
+	if f.sequence == 0 {
+		return fmt.Errorf("no fragments")
+	}
+
+	header := ftyp(true)
+	if f.ftyp != nil {
+		header = f.ftyp.Encode(nil)
+	}
+	header = append(header, f.moovBox()...)
+
+	out, err := os.Create(f.outFile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	_, err = w.Write(header)
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(f.tmp, 0, f.size))
+	}
+	if err == nil {
+		_, err = w.Write(f.mfra(int64(len(header))))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Abort removes the temporary file without writing the out file.
+func (f *FragmentWriter) Abort() error {
+	f.tmp.Close()
+	return os.Remove(f.tmp.Name())
+}
+
+// moovBox returns the moov box of the first init segment with the tracks and
+// sample entries of all of them, and the durations of the fragments.
+func (f *FragmentWriter) moovBox() []byte {
+	var timescale uint32 = movieTimescale
+	if mvhd := f.moov.Find("mvhd"); mvhd != nil {
+		if v, ok := field32(mvhd, 12, 20); ok && v > 0 {
+			timescale = v
+		}
+	}
+
+	var duration int64
+	var nextID uint32
+	for _, t := range f.tracks {
+		duration = max(duration, t.next*int64(timescale)/int64(t.timescale))
+		nextID = max(nextID, t.id+1)
+	}
+
+	moov := &Box{Type: "moov", Data: f.moov.Data}
+	traks := false
+	for _, c := range f.moov.Children {
+		switch c.Type {
+		case "mvhd":
+			setDuration(c, 16, 24, duration)
+			if len(c.Data) >= 4 {
+				binary.BigEndian.PutUint32(c.Data[len(c.Data)-4:], nextID)
+			}
+			moov.Children = append(moov.Children, c)
+		case "trak":
+			if traks {
+				continue
+			}
+			traks = true
+			for _, t := range f.tracks {
+				moov.Children = append(moov.Children, t.trakBox(timescale))
+			}
+		case "mvex":
+		default:
+			moov.Children = append(moov.Children, c)
+		}
+	}
+
+	var b buffer
+	b.u32(1 << 24)
+	b.u64(uint64(duration))
+	mvex := &Box{Type: "mvex", Children: []*Box{{Type: "mehd", Data: b.Bytes()}}}
+	for _, t := range f.tracks {
+		trex := t.trex
+		if trex == nil {
+			var b buffer
+			b.u32(0)
+			b.u32(t.id)
+			b.u32(1)
+			b.zeros(12)
+			trex = &Box{Type: "trex", Data: b.Bytes()}
+		}
+		mvex.Children = append(mvex.Children, trex)
+	}
+	moov.Children = append(moov.Children, mvex)
+	return moov.Encode(nil)
+}
+
+// trakBox returns the trak box of the track with its duration and the sample
+// entries of all the init segments.
+func (t *fragTrack) trakBox(timescale uint32) *Box {
+	if tkhd := t.trak.Find("tkhd"); tkhd != nil {
+		setDuration(tkhd, 20, 28, t.next*int64(timescale)/int64(t.timescale))
+	}
+	if stsd := t.trak.Find("mdia", "minf", "stbl", "stsd"); stsd != nil && len(stsd.Data) >= 8 {
+		binary.BigEndian.PutUint32(stsd.Data[4:], uint32(len(t.entries)))
+		stsd.Children = t.entries
+	}
+	return t.trak
+}
+
+// setDuration sets the duration field of a full box, at offset v0 in
+// version 0 and v1 in version 1.
+func setDuration(b *Box, v0, v1 int, duration int64) {
+	version, _ := b.FullBox()
+	switch {
+	case version == 1 && len(b.Data) >= v1+8:
+		binary.BigEndian.PutUint64(b.Data[v1:], uint64(duration))
+	case version == 0 && len(b.Data) >= v0+4:
+		binary.BigEndian.PutUint32(b.Data[v0:], uint32(min(duration, math.MaxUint32)))
+	}
+}
+
+// mfra returns the mfra box listing the fragments of every track starting
+// with a sync sample, the moof boxes being at base in the out file.
+func (f *FragmentWriter) mfra(base int64) []byte {
+	var b buffer
+	b.box("mfra", func() {
+		for _, t := range f.tracks {
+			b.fullBox("tfra", 1, 0, func() {
+				b.u32(t.id)
+				// 1 byte traf, trun and sample numbers
+				b.u32(0)
+				b.u32(uint32(len(t.random)))
+				for _, r := range t.random {
+					b.u64(uint64(r.time))
+					b.u64(uint64(base + r.offset))
+					b.u8(uint8(r.traf))
+					b.u8(1)
+					b.u8(1)
+				}
+			})
+		}
+		b.fullBox("mfro", 0, 0, func() {
+			b.u32(uint32(b.Len() + 4))
+		})
+	})
+	return b.Bytes()
+}
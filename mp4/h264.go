@@ -0,0 +1,141 @@
+package mp4
+
+import "fmt"
+
+const (
+	h264IDR = 5
+	h264SPS = 7
+	h264PPS = 8
+	h264AUD = 9
+)
+
+// videoInfo is what the sample entry needs from a sequence parameter set.
+type videoInfo struct {
+	width          int
+	height         int
+	chromaFormat   uint
+	bitDepthLuma   uint
+	bitDepthChroma uint
+}
+
+// parseH264SPS parses a H.264 sequence parameter set, with its NAL header.
+func parseH264SPS(nalu []byte) (videoInfo, error) {
+	info := videoInfo{chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8}
+	data := unescape(nalu)
+	if len(data) < 4 {
+		return info, fmt.Errorf("h264 sps too short")
+	}
+	r := &bitReader{data: data[4:]}
+	profile := data[1]
+
+	r.ue() // seq_parameter_set_id
+	separatePlanes := false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		info.chromaFormat = r.ue()
+		if info.chromaFormat == 3 {
+			separatePlanes = r.bit() == 1
+		}
+		info.bitDepthLuma = 8 + r.ue()
+		info.bitDepthChroma = 8 + r.ue()
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if info.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var left, right, top, bottom uint
+	if r.bit() == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return info, fmt.Errorf("parse h264 sps error: %w", r.err)
+	}
+
+	cropX, cropY := uint(1), 2-frameMbsOnly
+	if info.chromaFormat != 0 && !separatePlanes {
+		if info.chromaFormat != 3 {
+			cropX = 2
+		}
+		if info.chromaFormat == 1 {
+			cropY *= 2
+		}
+	}
+	info.width = int(widthMbs*16 - cropX*(left+right))
+	info.height = int((2-frameMbsOnly)*heightMapUnits*16 - cropY*(top+bottom))
+	return info, nil
+}
+
+// avcC returns the AVC decoder configuration record.
+func avcC(sps, pps [][]byte, info videoInfo) []byte {
+	var b buffer
+	b.u8(1)
+	b.u8(sps[0][1])
+	b.u8(sps[0][2])
+	b.u8(sps[0][3])
+	// 4 byte NAL unit lengths
+	b.u8(0xff)
+	b.u8(0xe0 | uint8(len(sps)))
+	for _, s := range sps {
+		b.u16(uint16(len(s)))
+		b.Write(s)
+	}
+	b.u8(uint8(len(pps)))
+	for _, p := range pps {
+		b.u16(uint16(len(p)))
+		b.Write(p)
+	}
+
+	switch sps[0][1] {
+	case 100, 110, 122, 144:
+		b.u8(0xfc | uint8(info.chromaFormat))
+		b.u8(0xf8 | uint8(info.bitDepthLuma-8))
+		b.u8(0xf8 | uint8(info.bitDepthChroma-8))
+		b.u8(0)
+	}
+	return b.Bytes()
+}
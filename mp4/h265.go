@@ -0,0 +1,126 @@
+package mp4
+
+import "fmt"
+
+const (
+	h265VPS = 32
+	h265SPS = 33
+	h265PPS = 34
+	h265AUD = 35
+)
+
+func h265Type(nalu []byte) int {
+	return int(nalu[0] >> 1 & 0x3f)
+}
+
+// h265Keyframe reports whether the NAL unit type is an intra random access
+// point.
+func h265Keyframe(t int) bool {
+	return t >= 16 && t <= 23
+}
+
+// h265SPSInfo is a parsed H.265 sequence parameter set. ptl holds the general
+// profile, tier and level, as they are copied to the hvcC box.
+type h265SPSInfo struct {
+	videoInfo
+	ptl       []byte
+	subLayers uint
+	nested    uint
+}
+
+// parseH265SPS parses a H.265 sequence parameter set, with its NAL header.
+func parseH265SPS(nalu []byte) (h265SPSInfo, error) {
+	var info h265SPSInfo
+	data := unescape(nalu)
+	if len(data) < 15 {
+		return info, fmt.Errorf("h265 sps too short")
+	}
+	data = data[2:]
+	info.ptl = data[1:13]
+
+	r := &bitReader{data: data}
+	r.bits(4) // sps_video_parameter_set_id
+	maxSubLayers := r.bits(3)
+	info.subLayers = maxSubLayers + 1
+	info.nested = r.bit()
+
+	// profile_tier_level
+	r.skip(96)
+	var profile, level [8]uint
+	for i := uint(0); i < maxSubLayers; i++ {
+		profile[i] = r.bit()
+		level[i] = r.bit()
+	}
+	if maxSubLayers > 0 {
+		r.skip(2 * int(8-maxSubLayers))
+	}
+	for i := uint(0); i < maxSubLayers; i++ {
+		if profile[i] == 1 {
+			r.skip(88)
+		}
+		if level[i] == 1 {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	info.chromaFormat = r.ue()
+	if info.chromaFormat == 3 {
+		r.bit() // separate_colour_plane_flag
+	}
+	width := r.ue()
+	height := r.ue()
+	var left, right, top, bottom uint
+	if r.bit() == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	info.bitDepthLuma = 8 + r.ue()
+	info.bitDepthChroma = 8 + r.ue()
+	if r.err != nil {
+		return info, fmt.Errorf("parse h265 sps error: %w", r.err)
+	}
+
+	cropX, cropY := uint(1), uint(1)
+	if info.chromaFormat == 1 || info.chromaFormat == 2 {
+		cropX = 2
+	}
+	if info.chromaFormat == 1 {
+		cropY = 2
+	}
+	info.width = int(width - cropX*(left+right))
+	info.height = int(height - cropY*(top+bottom))
+	return info, nil
+}
+
+// hvcC returns the HEVC decoder configuration record.
+func hvcC(vps, sps, pps [][]byte, info h265SPSInfo) []byte {
+	var b buffer
+	b.u8(1)
+	b.Write(info.ptl)
+	// min_spatial_segmentation_idc and parallelismType unknown
+	b.u16(0xf000)
+	b.u8(0xfc)
+	b.u8(0xfc | uint8(info.chromaFormat))
+	b.u8(0xf8 | uint8(info.bitDepthLuma-8))
+	b.u8(0xf8 | uint8(info.bitDepthChroma-8))
+	// avgFrameRate
+	b.u16(0)
+	// 4 byte NAL unit lengths
+	b.u8(uint8(info.subLayers)<<3 | uint8(info.nested)<<2 | 3)
+
+	b.u8(3)
+	for _, array := range []struct {
+		t     uint8
+		nalus [][]byte
+	}{{h265VPS, vps}, {h265SPS, sps}, {h265PPS, pps}} {
+		// array_completeness: the parameter sets are not repeated in the
+		// samples
+		b.u8(0x80 | array.t)
+		b.u16(uint16(len(array.nalus)))
+		for _, n := range array.nalus {
+			b.u16(uint16(len(n)))
+			b.Write(n)
+		}
+	}
+	return b.Bytes()
+}
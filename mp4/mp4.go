@@ -0,0 +1,201 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// containers lists the boxes that hold other boxes, with the size of the
+// fields that come before their children.
+var containers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "mvex": 0,
+	"moof": 0, "traf": 0, "edts": 0, "dinf": 0, "udta": 0, "mfra": 0,
+	"sinf": 0, "schi": 0,
+	"stsd": 8,
+	"avc1": 78, "avc3": 78, "hvc1": 78, "hev1": 78, "dvh1": 78, "dvhe": 78,
+	"av01": 78, "vp09": 78, "mp4v": 78, "encv": 78,
+	"mp4a": 28, "ac-3": 28, "ec-3": 28, "Opus": 28, "fLaC": 28, "enca": 28,
+}
+
+// Box is a parsed ISO BMFF box. For containers Data holds the fields before
+// the children, for other boxes the whole payload. Data of parsed boxes
+// points into the parsed buffer, so changes to it are made in place.
+type Box struct {
+	Type     string
+	Offset   int
+	Data     []byte
+	Children []*Box
+}
+
+func Parse(data []byte) ([]*Box, error) {
+	return parse(data, 0)
+}
+
+func parse(data []byte, base int) ([]*Box, error) {
+	var boxes []*Box
+	for i := 0; i < len(data); {
+		if len(data)-i < 8 {
+			return nil, fmt.Errorf("truncated box header at %d", base+i)
+		}
+
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - i
+		case 1:
+			if len(data)-i < 16 {
+				return nil, fmt.Errorf("truncated box header at %d", base+i)
+			}
+			size = int(binary.BigEndian.Uint64(data[i+8:]))
+			header = 16
+		}
+		if size < header || i+size > len(data) {
+			return nil, fmt.Errorf("invalid size %d of box %q at %d", size, typ, base+i)
+		}
+
+		box := &Box{
+			Type:   typ,
+			Offset: base + i,
+			Data:   data[i+header : i+size],
+		}
+
+		prefix, ok := containers[typ]
+		if ok {
+			prefix = prefixSize(prefix, box.Data)
+		}
+		if ok && prefix <= len(box.Data) {
+			children, err := parse(box.Data[prefix:], base+i+header+prefix)
+			if err != nil {
+				return nil, err
+			}
+			box.Children = children
+			box.Data = box.Data[:prefix]
+		}
+
+		boxes = append(boxes, box)
+		i += size
+	}
+	return boxes, nil
+}
+
+// prefixSize handles the QuickTime audio sample entries, which have more
+// fields in versions 1 and 2.
+func prefixSize(prefix int, payload []byte) int {
+	if prefix != 28 || len(payload) < 10 {
+		return prefix
+	}
+	switch binary.BigEndian.Uint16(payload[8:]) {
+	case 1:
+		return prefix + 16
+	case 2:
+		return prefix + 36
+	}
+	return prefix
+}
+
+func (b *Box) IsContainer() bool {
+	_, ok := containers[b.Type]
+	return ok
+}
+
+func (b *Box) Size() int {
+	size := 8 + len(b.Data)
+	for _, c := range b.Children {
+		size += c.Size()
+	}
+	if size > 0xffffffff {
+		size += 8
+	}
+	return size
+}
+
+func (b *Box) Encode(buf []byte) []byte {
+	size := b.Size()
+	if size > 0xffffffff {
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = append(buf, b.Type...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+		buf = append(buf, b.Type...)
+	}
+	buf = append(buf, b.Data...)
+	for _, c := range b.Children {
+		buf = c.Encode(buf)
+	}
+	return buf
+}
+
+func Encode(boxes []*Box) []byte {
+	var buf []byte
+	for _, b := range boxes {
+		buf = b.Encode(buf)
+	}
+	return buf
+}
+
+// Find returns the first box matching the path of box types.
+func Find(boxes []*Box, path ...string) *Box {
+	for _, b := range boxes {
+		if b.Type != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b
+		}
+		if found := Find(b.Children, path[1:]...); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (b *Box) Find(path ...string) *Box {
+	return Find(b.Children, path...)
+}
+
+func (b *Box) FindAll(typ string) []*Box {
+	var list []*Box
+	for _, c := range b.Children {
+		if c.Type == typ {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// Remove drops the children of the given types, at any depth.
+func (b *Box) Remove(types ...string) {
+	children := b.Children[:0]
+	for _, c := range b.Children {
+		drop := false
+		for _, t := range types {
+			if c.Type == t {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			c.Remove(types...)
+			children = append(children, c)
+		}
+	}
+	b.Children = children
+}
+
+// FullBox returns the version and flags of a full box.
+func (b *Box) FullBox() (byte, uint32) {
+	if len(b.Data) < 4 {
+		return 0, 0
+	}
+	return b.Data[0], binary.BigEndian.Uint32(b.Data) & 0xffffff
+}
+
+// Rename changes in place the type of a box parsed from data. Renaming a box
+// to "free" hides it from readers without moving the data that follows.
+func Rename(data []byte, b *Box, typ string) {
+	copy(data[b.Offset+4:b.Offset+8], typ)
+	b.Type = typ
+}
@@ -0,0 +1,439 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Codec is the codec of an elementary stream.
+type Codec int
+
+const (
+	H264 Codec = iota + 1
+	H265
+	AAC
+)
+
+const (
+	// clock is the rate of the MPEG-TS timestamps, used as timescale of the
+	// video tracks
+	clock = 90000
+	// wrap is where the 33 bit MPEG-TS timestamps wrap around
+	wrap = 1 << 33
+)
+
+// Muxer writes H.264, H.265 and AAC elementary streams to an MP4 file. The
+// samples are stored in a temporary file next to the out file until Close,
+// which writes the out file with the sample tables before the media data,
+// or as fragments of the samples written between calls to Fragment.
+type Muxer struct {
+	outFile    string
+	fragmented bool
+	tmp        *os.File
+	w          *bufio.Writer
+	size       int64
+	tracks     []*track
+	pids       map[int]*track
+	fragment   int
+	// offset is added to the timestamps so that they continue at the
+	// discontinuities, end is where the last sample ends
+	offset int64
+	rebase bool
+	end    int64
+}
+
+type track struct {
+	id        uint32
+	codec     Codec
+	timescale uint32
+	// the parameter sets of the video, and the configuration of the audio
+	vps, sps, pps [][]byte
+	info          videoInfo
+	hevc          h265SPSInfo
+	config        []byte
+	channels      int
+	samples       []sample
+	durations     []uint32
+	// last is the last timestamp unwrapped, when known
+	last  int64
+	known bool
+	// duration is the duration of the last video sample, in clock units
+	duration int64
+	// pending holds the start of an AAC frame continued in the next PES
+	// packet, next is the timestamp of the next frame
+	pending []byte
+	next    int64
+	resync  bool
+	pts     int64
+}
+
+type sample struct {
+	offset int64
+	size   uint32
+	// dts is in the timescale of the track, cto is the composition time
+	// offset
+	dts      int64
+	cto      int64
+	sync     bool
+	fragment int
+}
+
+// NewMuxer starts an MP4 file, fragmented or not.
+func NewMuxer(outFile string, fragmented bool) (*Muxer, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(outFile), filepath.Base(outFile)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &Muxer{
+		outFile:    outFile,
+		fragmented: fragmented,
+		tmp:        tmp,
+		w:          bufio.NewWriter(tmp),
+		pids:       map[int]*track{},
+	}, nil
+}
+
+// Write adds the data of a PES packet of the stream pid. pts and dts are in
+// 90kHz units, negative when missing.
+func (m *Muxer) Write(pid int, codec Codec, pts, dts int64, data []byte) error {
+	t := m.pids[pid]
+	if t == nil {
+		t = &track{codec: codec, timescale: clock}
+		m.pids[pid] = t
+		m.tracks = append(m.tracks, t)
+	}
+
+	switch codec {
+	case H264, H265:
+		return m.writeVideo(t, pts, dts, data)
+	case AAC:
+		return m.writeAudio(t, pts, data)
+	}
+	return fmt.Errorf("unsupported codec %d", codec)
+}
+
+// Discontinuity makes the timestamps of the next samples continue after the
+// last one, whatever their value.
+func (m *Muxer) Discontinuity() {
+	if len(m.tracks) == 0 {
+		return
+	}
+	m.rebase = true
+	for _, t := range m.tracks {
+		t.known = false
+		t.pending = nil
+	}
+}
+
+// Fragment ends the current fragment.
+func (m *Muxer) Fragment() {
+	m.fragment++
+}
+
+// timestamp unwraps a timestamp of the track and moves it to the time line
+// of the file.
+func (m *Muxer) timestamp(t *track, raw int64) int64 {
+	v := raw
+	if t.known {
+		v = t.last - t.last%wrap + raw
+		if v-t.last > wrap/2 {
+			v -= wrap
+		} else if t.last-v > wrap/2 {
+			v += wrap
+		}
+	}
+	t.last, t.known = v, true
+
+	if m.rebase {
+		m.offset = m.end - v
+		m.rebase = false
+	}
+	return v + m.offset
+}
+
+func (m *Muxer) writeVideo(t *track, pts, dts int64, data []byte) error {
+	if pts < 0 {
+		return nil
+	}
+
+	var nalus [][]byte
+	key := false
+	for _, n := range splitNALUs(data) {
+		var set *[][]byte
+		if t.codec == H264 {
+			switch n[0] & 0x1f {
+			case h264AUD:
+				continue
+			case h264SPS:
+				set = &t.sps
+			case h264PPS:
+				set = &t.pps
+			case h264IDR:
+				key = true
+			}
+		} else {
+			switch typ := h265Type(n); {
+			case typ == h265AUD:
+				continue
+			case typ == h265VPS:
+				set = &t.vps
+			case typ == h265SPS:
+				set = &t.sps
+			case typ == h265PPS:
+				set = &t.pps
+			case h265Keyframe(typ):
+				key = true
+			}
+		}
+
+		if set != nil {
+			// the first parameter sets go to the sample entry, the ones
+			// that differ stay in the samples
+			if *set == nil {
+				err := t.setParameterSet(set, n)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if bytes.Equal((*set)[0], n) {
+				continue
+			}
+		}
+		nalus = append(nalus, n)
+	}
+
+	// the samples before the first key frame can not be decoded
+	if len(nalus) == 0 || len(t.samples) == 0 && (!key || !t.configured()) {
+		return nil
+	}
+
+	d := m.timestamp(t, dts)
+	cto := (pts - dts) % wrap
+	if cto < 0 {
+		cto += wrap
+	}
+	if cto > wrap/2 {
+		// presented before it is decoded
+		cto = 0
+	}
+
+	if n := len(t.samples); n > 0 {
+		prev := t.samples[n-1].dts
+		if d <= prev {
+			d = prev + 1
+		}
+		t.duration = d - prev
+	}
+
+	var size uint32
+	for _, n := range nalus {
+		size += 4 + uint32(len(n))
+	}
+	s := sample{offset: m.size, size: size, dts: d, cto: cto, sync: key, fragment: m.fragment}
+	for _, n := range nalus {
+		var b buffer
+		b.u32(uint32(len(n)))
+		_, err := m.w.Write(b.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = m.w.Write(n)
+		if err != nil {
+			return err
+		}
+	}
+	m.size += int64(size)
+	t.samples = append(t.samples, s)
+
+	duration := t.duration
+	if duration == 0 {
+		duration = clock / 30
+	}
+	m.extend(d + duration)
+	return nil
+}
+
+func (t *track) setParameterSet(set *[][]byte, nalu []byte) error {
+	nalu = append([]byte(nil), nalu...)
+	if set == &t.sps {
+		var err error
+		if t.codec == H264 {
+			t.info, err = parseH264SPS(nalu)
+		} else {
+			t.hevc, err = parseH265SPS(nalu)
+			t.info = t.hevc.videoInfo
+		}
+		if err != nil {
+			return err
+		}
+	}
+	*set = [][]byte{nalu}
+	return nil
+}
+
+// configured reports whether the parameter sets of the video are known.
+func (t *track) configured() bool {
+	return t.sps != nil && t.pps != nil && (t.codec == H264 || t.vps != nil)
+}
+
+func (m *Muxer) writeAudio(t *track, pts int64, data []byte) error {
+	if len(t.pending) == 0 && pts >= 0 {
+		t.pts = m.timestamp(t, pts)
+		t.resync = true
+	}
+	if !t.resync && len(t.samples) == 0 {
+		// no timestamp yet
+		return nil
+	}
+
+	data = append(t.pending, data...)
+	for len(data) > 0 {
+		h, err := parseADTS(data)
+		if err == errShortData || err == nil && h.frameLength > len(data) {
+			break
+		}
+		if err != nil {
+			// skip to the next sync word
+			i := 1
+			for ; i+1 < len(data); i++ {
+				if data[i] == 0xff && data[i+1]&0xf6 == 0xf0 {
+					break
+				}
+			}
+			data = data[i:]
+			continue
+		}
+
+		if t.config == nil {
+			t.config = h.audioSpecificConfig()
+			t.timescale = uint32(h.sampleRate())
+			t.channels = int(h.channels)
+		}
+
+		if t.resync {
+			// the frames follow each other, unless the timestamp of the
+			// packet is off by more than half a frame
+			target := t.pts * int64(t.timescale) / clock
+			n := len(t.samples)
+			if n == 0 || target > t.samples[n-1].dts && abs(target-t.next) > aacFrameSamples/2 {
+				t.next = target
+			}
+			t.resync = false
+		}
+
+		frame := data[h.headerSize:h.frameLength]
+		_, err = m.w.Write(frame)
+		if err != nil {
+			return err
+		}
+		t.samples = append(t.samples, sample{
+			offset:   m.size,
+			size:     uint32(len(frame)),
+			dts:      t.next,
+			sync:     true,
+			fragment: m.fragment,
+		})
+		m.size += int64(len(frame))
+		t.next += aacFrameSamples
+		m.extend(t.next * clock / int64(t.timescale))
+
+		data = data[h.frameLength:]
+	}
+	t.pending = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Muxer) extend(end int64) {
+	if end > m.end {
+		m.end = end
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Close writes the out file and removes the temporary file.
+func (m *Muxer) Close() error {
+	defer os.Remove(m.tmp.Name())
+	defer m.tmp.Close()
+
+	err := m.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	var tracks []*track
+	for _, t := range m.tracks {
+		if len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no audio or video samples")
+	}
+	// video first
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].codec != AAC && tracks[j].codec == AAC
+	})
+	for i, t := range tracks {
+		t.id = uint32(i + 1)
+		t.finish()
+	}
+
+	f, err := os.Create(m.outFile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if m.fragmented {
+		err = m.writeFragmented(w, tracks)
+	} else {
+		err = m.writeFaststart(w, tracks)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Abort removes the temporary file without writing the out file.
+func (m *Muxer) Abort() error {
+	m.tmp.Close()
+	return os.Remove(m.tmp.Name())
+}
+
+// finish computes the durations of the samples, the last one lasting as long
+// as the one before.
+func (t *track) finish() {
+	n := len(t.samples)
+	t.durations = make([]uint32, n)
+	for i := 0; i+1 < n; i++ {
+		t.durations[i] = uint32(t.samples[i+1].dts - t.samples[i].dts)
+	}
+	switch {
+	case t.codec == AAC:
+		t.durations[n-1] = aacFrameSamples
+	case n > 1:
+		t.durations[n-1] = t.durations[n-2]
+	default:
+		t.durations[n-1] = clock / 30
+	}
+}
+
+// data returns a reader of the data of a sample.
+func (m *Muxer) data(s sample) io.Reader {
+	return io.NewSectionReader(m.tmp, s.offset, int64(s.size))
+}
@@ -0,0 +1,317 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// bitWriter writes the exp-Golomb codes of a parameter set.
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bit(b uint) {
+	if w.n%8 == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= byte(b&1) << (7 - w.n%8)
+	w.n++
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	bits := 0
+	for x := v; x > 1; x >>= 1 {
+		bits++
+	}
+	for i := 0; i < bits; i++ {
+		w.bit(0)
+	}
+	for i := bits; i >= 0; i-- {
+		w.bit(v >> i)
+	}
+}
+
+// h264SPSOf returns a baseline sequence parameter set of a width x height
+// video, both multiples of 16.
+func h264SPSOf(width, height int) []byte {
+	w := &bitWriter{}
+	w.ue(0) // seq_parameter_set_id
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // pic_order_cnt_type
+	w.ue(0) // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1) // max_num_ref_frames
+	w.bit(0)
+	w.ue(uint(width/16 - 1))
+	w.ue(uint(height/16 - 1))
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	w.bit(0) // frame_cropping_flag
+	w.bit(0) // vui_parameters_present_flag
+	w.bit(1) // rbsp_stop_one_bit
+	return append([]byte{0x67, 66, 0xc0, 30}, w.data...)
+}
+
+// accessUnit returns the Annex B data of a video frame.
+func accessUnit(key bool, n int) []byte {
+	data := []byte{0, 0, 0, 1, 0x09, 0xf0}
+	if key {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, h264SPSOf(320, 240)...)
+		data = append(data, 0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80)
+		data = append(data, 0, 0, 1, 0x65)
+	} else {
+		data = append(data, 0, 0, 1, 0x41)
+	}
+	for i := 0; i < n; i++ {
+		data = append(data, byte(i%200+1))
+	}
+	return data
+}
+
+// adtsFrames returns n AAC LC stereo 48kHz frames of size bytes of payload.
+func adtsFrames(n, size int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		length := 7 + size
+		data = append(data, 0xff, 0xf1, 1<<6|3<<2, 2<<6|byte(length>>11)&3, byte(length>>3), byte(length&7)<<5|0x1f, 0xfc)
+		for j := 0; j < size; j++ {
+			data = append(data, byte(j+1))
+		}
+	}
+	return data
+}
+
+func parseFile(t *testing.T, path string) []*Box {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse %s: %v", path, err)
+	}
+	return boxes
+}
+
+// table returns the entries of a sample table box, fields u32 each after
+// the entry count.
+func table(b *Box, fields int) [][]uint32 {
+	if b == nil {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(b.Data[4:]))
+	list := make([][]uint32, n)
+	for i := range list {
+		for f := 0; f < fields; f++ {
+			list[i] = append(list[i], binary.BigEndian.Uint32(b.Data[8+(i*fields+f)*4:]))
+		}
+	}
+	return list
+}
+
+// elst returns the segment durations and media times of an edit list.
+func elst(trak *Box) [][]int64 {
+	b := trak.Find("edts", "elst")
+	if b == nil {
+		return nil
+	}
+	var list [][]int64
+	for _, e := range table(b, 3) {
+		list = append(list, []int64{int64(e[0]), int64(int32(e[1]))})
+	}
+	return list
+}
+
+// writeStreams muxes 5 video frames from dts 90000 with composition time
+// offsets, and 3 AAC frames starting half a second after the first frame is
+// presented.
+func writeStreams(t *testing.T, m *Muxer, fragment bool) {
+	ctos := []int64{3000, 6000, 0, 3000, 3000}
+	for i, cto := range ctos {
+		dts := int64(90000 + i*3000)
+		err := m.Write(0x100, H264, dts+cto, dts, accessUnit(i == 0, 50+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fragment && i == 2 {
+			m.Fragment()
+		}
+	}
+	err := m.Write(0x101, AAC, 93000+45000, -1, adtsFrames(3, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxerFaststart(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.mp4")
+	m, err := NewMuxer(out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeStreams(t, m, false)
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes := parseFile(t, out)
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.Type)
+	}
+	if !reflect.DeepEqual(types, []string{"ftyp", "moov", "mdat"}) {
+		t.Fatalf("boxes %v", types)
+	}
+	traks := Find(boxes, "moov").FindAll("trak")
+	if len(traks) != 2 {
+		t.Fatalf("%d tracks", len(traks))
+	}
+	video, audio := traks[0].Find("mdia", "minf", "stbl"), traks[1].Find("mdia", "minf", "stbl")
+
+	if entry := video.Find("stsd", "avc1"); entry == nil ||
+		binary.BigEndian.Uint16(entry.Data[24:]) != 320 || binary.BigEndian.Uint16(entry.Data[26:]) != 240 {
+		t.Errorf("video sample entry %+v, want avc1 320x240", entry)
+	}
+	if got := table(video.Find("stts"), 2); !reflect.DeepEqual(got, [][]uint32{{5, 3000}}) {
+		t.Errorf("video stts %v", got)
+	}
+	if got := table(video.Find("ctts"), 2); !reflect.DeepEqual(got, [][]uint32{{1, 3000}, {1, 6000}, {1, 0}, {2, 3000}}) {
+		t.Errorf("video ctts %v", got)
+	}
+	if got := table(video.Find("stss"), 1); !reflect.DeepEqual(got, [][]uint32{{1}}) {
+		t.Errorf("video stss %v", got)
+	}
+	if got := table(audio.Find("stts"), 2); !reflect.DeepEqual(got, [][]uint32{{3, 1024}}) {
+		t.Errorf("audio stts %v", got)
+	}
+	if audio.Find("ctts") != nil || audio.Find("stss") != nil {
+		t.Error("audio has ctts or stss")
+	}
+
+	// the video edit starts at the composition offset of its first frame and
+	// runs to the end of the track, the audio one after an empty edit of
+	// half a second
+	if got := elst(traks[0]); !reflect.DeepEqual(got, [][]int64{{133, 3000}}) {
+		t.Errorf("video elst %v", got)
+	}
+	if got := elst(traks[1]); !reflect.DeepEqual(got, [][]int64{{500, -1}, {64, 0}}) {
+		t.Errorf("audio elst %v", got)
+	}
+
+	// the samples of each track make a chunk in the mdat box
+	mdat := Find(boxes, "mdat")
+	var total uint32
+	for i, stbl := range []*Box{video, audio} {
+		stsz := stbl.Find("stsz")
+		count := binary.BigEndian.Uint32(stsz.Data[8:])
+		if want := []uint32{5, 3}[i]; count != want {
+			t.Errorf("track %d has %d samples, want %d", i, count, want)
+		}
+		for j := uint32(0); j < count; j++ {
+			total += binary.BigEndian.Uint32(stsz.Data[12+4*j:])
+		}
+		stco := table(stbl.Find("stco"), 1)
+		if len(stco) != 1 || int(stco[0][0]) < mdat.Offset+8 {
+			t.Errorf("track %d stco %v, mdat at %d", i, stco, mdat.Offset)
+		}
+	}
+	if int(total) != len(mdat.Data) {
+		t.Errorf("samples of %d bytes, mdat of %d", total, len(mdat.Data))
+	}
+	if size := binary.BigEndian.Uint32(audio.Find("stsz").Data[12:]); size != 20 {
+		t.Errorf("audio sample of %d bytes, want the frame without its header", size)
+	}
+}
+
+func TestMuxerFragmented(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.mp4")
+	m, err := NewMuxer(out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeStreams(t, m, true)
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes := parseFile(t, out)
+	if Find(boxes, "moov", "mvex") == nil {
+		t.Fatal("no mvex box")
+	}
+	var moofs []*Box
+	for _, b := range boxes {
+		if b.Type == "moof" {
+			moofs = append(moofs, b)
+		}
+	}
+	if len(moofs) != 2 {
+		t.Fatalf("%d fragments, want 2", len(moofs))
+	}
+
+	// video samples 0-2 in the first fragment, 3-4 and the audio in the
+	// second one
+	want := [][]uint32{{3}, {2, 3}}
+	for i, moof := range moofs {
+		var counts []uint32
+		for _, traf := range moof.FindAll("traf") {
+			counts = append(counts, binary.BigEndian.Uint32(traf.Find("trun").Data[4:]))
+		}
+		if !reflect.DeepEqual(counts, want[i]) {
+			t.Errorf("fragment %d has %v samples, want %v", i, counts, want[i])
+		}
+	}
+	tfdt := moofs[1].FindAll("traf")[0].Find("tfdt")
+	if d := binary.BigEndian.Uint64(tfdt.Data[4:]); d != 9000 {
+		t.Errorf("second video fragment at %d, want 9000", d)
+	}
+}
+
+func TestSampleTablesCo64(t *testing.T) {
+	tr := &track{codec: AAC, timescale: 48000}
+	for i := 0; i < 4; i++ {
+		tr.samples = append(tr.samples, sample{offset: int64(i * 100), size: 100, dts: int64(i * 1024), sync: true})
+	}
+	// a gap in the data starts a new chunk
+	tr.samples[3].offset = 1000
+	tr.finish()
+
+	for _, co64 := range []bool{false, true} {
+		base := int64(1000)
+		if co64 {
+			base = 1 << 32
+		}
+		var b buffer
+		b.box("stbl", func() {
+			tr.sampleTables(&b, base, co64)
+		})
+		boxes, err := Parse(b.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stbl := boxes[0]
+
+		if got := table(stbl.Find("stsc"), 3); !reflect.DeepEqual(got, [][]uint32{{1, 3, 1}, {2, 1, 1}}) {
+			t.Errorf("co64 %v: stsc %v", co64, got)
+		}
+		if co64 {
+			c := stbl.Find("co64")
+			if stbl.Find("stco") != nil || c == nil {
+				t.Fatal("no co64 box for offsets beyond 4GB")
+			}
+			if first, second := binary.BigEndian.Uint64(c.Data[8:]), binary.BigEndian.Uint64(c.Data[16:]); first != 1<<32 || second != 1<<32+1000 {
+				t.Errorf("co64 offsets %d, %d", first, second)
+			}
+			continue
+		}
+		if got := table(stbl.Find("stco"), 1); !reflect.DeepEqual(got, [][]uint32{{1000}, {2000}}) {
+			t.Errorf("stco %v", got)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package mp4
+
+import (
+	"bufio"
+	"io"
+	"math"
+)
+
+// movieTimescale is the timescale of the durations of mvhd, tkhd and elst.
+const movieTimescale = 1000
+
+// timing is the position of a track on the time line of the movie.
+type timing struct {
+	// delay is the time before the first sample is presented, in the
+	// movie timescale
+	delay int64
+	// start is the composition time offset of the first sample, the media
+	// time presented first
+	start int64
+	// duration is the duration of the track in its timescale, and
+	// presented the time presented after start, in the movie timescale
+	duration  int64
+	presented int64
+}
+
+// timings returns the position of the tracks, the first sample of each one
+// being presented at its timestamp.
+func timings(tracks []*track) []timing {
+	first := make([]int64, len(tracks))
+	base := int64(math.MaxInt64)
+	for i, t := range tracks {
+		s := t.samples[0]
+		first[i] = (s.dts + s.cto) * clock / int64(t.timescale)
+		if first[i] < base {
+			base = first[i]
+		}
+	}
+
+	list := make([]timing, len(tracks))
+	for i, t := range tracks {
+		var d int64
+		for _, v := range t.durations {
+			d += int64(v)
+		}
+		start := t.samples[0].cto
+		list[i] = timing{
+			delay:     (first[i] - base) * movieTimescale / clock,
+			start:     start,
+			duration:  d,
+			presented: (d - start) * movieTimescale / int64(t.timescale),
+		}
+	}
+	return list
+}
+
+func ftyp(fragmented bool) []byte {
+	var b buffer
+	b.box("ftyp", func() {
+		b.WriteString("isom")
+		b.u32(0x200)
+		if fragmented {
+			b.WriteString("isomiso6mp41")
+		} else {
+			b.WriteString("isomiso2avc1mp41")
+		}
+	})
+	return b.Bytes()
+}
+
+// writeFaststart writes the moov box before the media data, which is the
+// temporary file as it is.
+func (m *Muxer) writeFaststart(w *bufio.Writer, tracks []*track) error {
+	header := ftyp(false)
+
+	mdatHeader := int64(8)
+	if m.size+8 > math.MaxUint32 {
+		mdatHeader = 16
+	}
+
+	// the size of the moov box does not depend on the offsets, but on
+	// whether they fit in 32 bits
+	moov := m.moov(tracks, 0, false)
+	co64 := int64(len(header)+len(moov))+mdatHeader+m.size > math.MaxUint32
+	moov = m.moov(tracks, 0, co64)
+	moov = m.moov(tracks, int64(len(header)+len(moov))+mdatHeader, co64)
+
+	for _, box := range [][]byte{header, moov} {
+		_, err := w.Write(box)
+		if err != nil {
+			return err
+		}
+	}
+
+	var b buffer
+	if mdatHeader == 16 {
+		b.u32(1)
+		b.WriteString("mdat")
+		b.u64(uint64(m.size + 16))
+	} else {
+		b.u32(uint32(m.size + 8))
+		b.WriteString("mdat")
+	}
+	_, err := w.Write(b.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(m.tmp, 0, m.size))
+	return err
+}
+
+// writeFragmented writes a moov box without samples, followed by a moof and
+// a mdat box per fragment.
+func (m *Muxer) writeFragmented(w *bufio.Writer, tracks []*track) error {
+	for _, box := range [][]byte{ftyp(true), m.moov(tracks, 0, false)} {
+		_, err := w.Write(box)
+		if err != nil {
+			return err
+		}
+	}
+
+	next := make([]int, len(tracks))
+	seq := uint32(0)
+	for f := 0; f <= m.fragment; f++ {
+		// the samples of every track in the fragment
+		runs := make([][2]int, len(tracks))
+		var size int64
+		for i, t := range tracks {
+			start := next[i]
+			for next[i] < len(t.samples) && t.samples[next[i]].fragment == f {
+				size += int64(t.samples[next[i]].size)
+				next[i]++
+			}
+			runs[i] = [2]int{start, next[i]}
+		}
+		if size == 0 {
+			continue
+		}
+
+		seq++
+		moof := moofBox(tracks, runs, seq, 0)
+		moof = moofBox(tracks, runs, seq, int64(len(moof))+8)
+		_, err := w.Write(moof)
+		if err != nil {
+			return err
+		}
+
+		var b buffer
+		b.u32(uint32(size + 8))
+		b.WriteString("mdat")
+		_, err = w.Write(b.Bytes())
+		if err != nil {
+			return err
+		}
+		for i, t := range tracks {
+			for _, s := range t.samples[runs[i][0]:runs[i][1]] {
+				_, err = io.Copy(w, m.data(s))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Muxer) moov(tracks []*track, base int64, co64 bool) []byte {
+	list := timings(tracks)
+	var duration int64
+	for _, t := range list {
+		if d := t.delay + t.presented; d > duration {
+			duration = d
+		}
+	}
+
+	var b buffer
+	b.box("moov", func() {
+		b.fullBox("mvhd", 0, 0, func() {
+			b.u32(0)
+			b.u32(0)
+			b.u32(movieTimescale)
+			b.u32(uint32(duration))
+			b.u32(0x00010000)
+			b.u16(0x0100)
+			b.zeros(10)
+			b.matrix()
+			b.zeros(24)
+			b.u32(uint32(len(tracks) + 1))
+		})
+		for i, t := range tracks {
+			m.trak(&b, t, list[i], base, co64)
+		}
+		if m.fragmented {
+			b.box("mvex", func() {
+				for _, t := range tracks {
+					b.fullBox("trex", 0, 0, func() {
+						b.u32(t.id)
+						b.u32(1)
+						b.u32(0)
+						b.u32(0)
+						b.u32(0)
+					})
+				}
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+func (m *Muxer) trak(b *buffer, t *track, tm timing, base int64, co64 bool) {
+	video := t.codec != AAC
+	b.box("trak", func() {
+		// enabled and in the movie
+		b.fullBox("tkhd", 0, 3, func() {
+			b.u32(0)
+			b.u32(0)
+			b.u32(t.id)
+			b.u32(0)
+			b.u32(uint32(tm.delay + tm.presented))
+			b.zeros(8)
+			b.u16(0)
+			b.u16(0)
+			if video {
+				b.u16(0)
+			} else {
+				b.u16(0x0100)
+			}
+			b.u16(0)
+			b.matrix()
+			b.u32(uint32(t.info.width) << 16)
+			b.u32(uint32(t.info.height) << 16)
+		})
+
+		if tm.delay > 0 || tm.start > 0 {
+			b.box("edts", func() {
+				entries := []int64{-1, tm.delay, tm.start, tm.presented}
+				if tm.delay == 0 {
+					entries = entries[2:]
+				}
+				b.fullBox("elst", 0, 0, func() {
+					b.u32(uint32(len(entries) / 2))
+					for i := 0; i < len(entries); i += 2 {
+						b.u32(uint32(entries[i+1]))
+						b.u32(uint32(entries[i]))
+						b.u16(1)
+						b.u16(0)
+					}
+				})
+			})
+		}
+
+		b.box("mdia", func() {
+			duration := tm.duration
+			if m.fragmented {
+				duration = 0
+			}
+			if duration > math.MaxUint32 {
+				b.fullBox("mdhd", 1, 0, func() {
+					b.u64(0)
+					b.u64(0)
+					b.u32(t.timescale)
+					b.u64(uint64(duration))
+					b.u16(0x55c4) // und
+					b.u16(0)
+				})
+			} else {
+				b.fullBox("mdhd", 0, 0, func() {
+					b.u32(0)
+					b.u32(0)
+					b.u32(t.timescale)
+					b.u32(uint32(duration))
+					b.u16(0x55c4)
+					b.u16(0)
+				})
+			}
+
+			b.fullBox("hdlr", 0, 0, func() {
+				b.u32(0)
+				if video {
+					b.WriteString("vide")
+				} else {
+					b.WriteString("soun")
+				}
+				b.zeros(12)
+				if video {
+					b.WriteString("VideoHandler\x00")
+				} else {
+					b.WriteString("SoundHandler\x00")
+				}
+			})
+
+			b.box("minf", func() {
+				if video {
+					b.fullBox("vmhd", 0, 1, func() {
+						b.zeros(8)
+					})
+				} else {
+					b.fullBox("smhd", 0, 0, func() {
+						b.zeros(4)
+					})
+				}
+				b.box("dinf", func() {
+					b.fullBox("dref", 0, 0, func() {
+						b.u32(1)
+						// in the same file
+						b.fullBox("url ", 0, 1, func() {})
+					})
+				})
+				b.box("stbl", func() {
+					b.fullBox("stsd", 0, 0, func() {
+						b.u32(1)
+						t.sampleEntry(b)
+					})
+					if m.fragmented {
+						b.fullBox("stts", 0, 0, func() { b.u32(0) })
+						b.fullBox("stsc", 0, 0, func() { b.u32(0) })
+						b.fullBox("stsz", 0, 0, func() { b.u32(0); b.u32(0) })
+						b.fullBox("stco", 0, 0, func() { b.u32(0) })
+						return
+					}
+					t.sampleTables(b, base, co64)
+				})
+			})
+		})
+	})
+}
+
+func (t *track) sampleEntry(b *buffer) {
+	switch t.codec {
+	case H264, H265:
+		typ, configType := "avc1", "avcC"
+		if t.codec == H265 {
+			typ, configType = "hvc1", "hvcC"
+		}
+		b.box(typ, func() {
+			b.zeros(6)
+			b.u16(1)
+			b.zeros(16)
+			b.u16(uint16(t.info.width))
+			b.u16(uint16(t.info.height))
+			b.u32(0x00480000)
+			b.u32(0x00480000)
+			b.u32(0)
+			b.u16(1)
+			b.zeros(32)
+			b.u16(0x18)
+			b.u16(0xffff)
+			b.box(configType, func() {
+				if t.codec == H264 {
+					b.Write(avcC(t.sps, t.pps, t.info))
+				} else {
+					b.Write(hvcC(t.vps, t.sps, t.pps, t.hevc))
+				}
+			})
+		})
+	case AAC:
+		b.box("mp4a", func() {
+			b.zeros(6)
+			b.u16(1)
+			b.zeros(8)
+			b.u16(uint16(t.channels))
+			b.u16(16)
+			b.zeros(4)
+			b.u32(t.timescale << 16)
+			b.fullBox("esds", 0, 0, func() {
+				var config, es buffer
+				// audio ISO/IEC 14496-3, audio stream
+				config.u8(0x40)
+				config.u8(0x15)
+				config.zeros(11)
+				config.descriptor(0x05, t.config)
+
+				es.u16(0)
+				es.u8(0)
+				es.descriptor(0x04, config.Bytes())
+				es.descriptor(0x06, []byte{0x02})
+				b.descriptor(0x03, es.Bytes())
+			})
+		})
+	}
+}
+
+// sampleTables writes the tables of the samples, whose data is at base in
+// the file. The samples that follow each other in the data of the file make
+// a chunk.
+func (t *track) sampleTables(b *buffer, base int64, co64 bool) {
+	b.fullBox("stts", 0, 0, func() {
+		runs := runLengths(len(t.samples), func(i int) int64 { return int64(t.durations[i]) })
+		b.u32(uint32(len(runs)))
+		for _, r := range runs {
+			b.u32(uint32(r[0]))
+			b.u32(uint32(r[1]))
+		}
+	})
+
+	if t.codec != AAC {
+		runs := runLengths(len(t.samples), func(i int) int64 { return t.samples[i].cto })
+		if len(runs) > 1 || runs[0][1] != 0 {
+			b.fullBox("ctts", 0, 0, func() {
+				b.u32(uint32(len(runs)))
+				for _, r := range runs {
+					b.u32(uint32(r[0]))
+					b.u32(uint32(r[1]))
+				}
+			})
+		}
+
+		var sync []uint32
+		for i, s := range t.samples {
+			if s.sync {
+				sync = append(sync, uint32(i+1))
+			}
+		}
+		if len(sync) < len(t.samples) {
+			b.fullBox("stss", 0, 0, func() {
+				b.u32(uint32(len(sync)))
+				for _, n := range sync {
+					b.u32(n)
+				}
+			})
+		}
+	}
+
+	var chunks []int64
+	var counts []int
+	for i, s := range t.samples {
+		if i == 0 || s.offset != t.samples[i-1].offset+int64(t.samples[i-1].size) {
+			chunks = append(chunks, base+s.offset)
+			counts = append(counts, 0)
+		}
+		counts[len(counts)-1]++
+	}
+
+	b.fullBox("stsc", 0, 0, func() {
+		runs := runLengths(len(counts), func(i int) int64 { return int64(counts[i]) })
+		b.u32(uint32(len(runs)))
+		first := uint32(1)
+		for _, r := range runs {
+			b.u32(first)
+			b.u32(uint32(r[1]))
+			b.u32(1)
+			first += uint32(r[0])
+		}
+	})
+
+	b.fullBox("stsz", 0, 0, func() {
+		b.u32(0)
+		b.u32(uint32(len(t.samples)))
+		for _, s := range t.samples {
+			b.u32(s.size)
+		}
+	})
+
+	if co64 {
+		b.fullBox("co64", 0, 0, func() {
+			b.u32(uint32(len(chunks)))
+			for _, c := range chunks {
+				b.u64(uint64(c))
+			}
+		})
+	} else {
+		b.fullBox("stco", 0, 0, func() {
+			b.u32(uint32(len(chunks)))
+			for _, c := range chunks {
+				b.u32(uint32(c))
+			}
+		})
+	}
+}
+
+// runLengths returns the runs of equal values, as count and value.
+func runLengths(n int, value func(i int) int64) [][2]int64 {
+	var runs [][2]int64
+	for i := 0; i < n; i++ {
+		v := value(i)
+		if len(runs) > 0 && runs[len(runs)-1][1] == v {
+			runs[len(runs)-1][0]++
+			continue
+		}
+		runs = append(runs, [2]int64{1, v})
+	}
+	return runs
+}
+
+// moofBox returns the moof box of a fragment, with the data of the samples of
+// the tracks following each other at offset from the start of the box.
+func moofBox(tracks []*track, runs [][2]int, seq uint32, offset int64) []byte {
+	var b buffer
+	b.box("moof", func() {
+		b.fullBox("mfhd", 0, 0, func() {
+			b.u32(seq)
+		})
+		for i, t := range tracks {
+			samples := t.samples[runs[i][0]:runs[i][1]]
+			durations := t.durations[runs[i][0]:runs[i][1]]
+			if len(samples) == 0 {
+				continue
+			}
+			b.box("traf", func() {
+				// default-base-is-moof
+				b.fullBox("tfhd", 0, 0x020000, func() {
+					b.u32(t.id)
+				})
+				b.fullBox("tfdt", 1, 0, func() {
+					b.u64(uint64(samples[0].dts - t.samples[0].dts))
+				})
+				// data offset, and duration, size, flags and composition
+				// time offset of every sample
+				b.fullBox("trun", 0, 0x000f01, func() {
+					b.u32(uint32(len(samples)))
+					b.u32(uint32(offset))
+					for j, s := range samples {
+						b.u32(durations[j])
+						b.u32(s.size)
+						if s.sync {
+							b.u32(0x02000000)
+						} else {
+							b.u32(0x01010000)
+						}
+						b.u32(uint32(s.cto))
+						offset += int64(s.size)
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
@@ -25,14 +25,40 @@ type Bar struct {
 
 func New(total int) *Bar {
 	bar := &Bar{
-		total:  total,
-		tag:    "#",
-		format: "\r[%-50s] %3d%% %" + fmt.Sprintf("%d", digitCount(total)) + "d/%d %-11s",
+		total: total,
+		tag:   "#",
 	}
+	bar.setFormat()
 
 	return bar
 }
 
+func (b *Bar) setFormat() {
+	b.format = "\r[%-50s] %3d%% %" + fmt.Sprintf("%d", digitCount(b.total)) + "d/%d %-11s"
+}
+
+// AddTotal grows the total, for downloads whose size is not known upfront.
+func (b *Bar) AddTotal(n int) {
+	b.mut.Lock()
+	b.total += n
+	b.setFormat()
+	b.mut.Unlock()
+}
+
+// Set updates the count and the total at once.
+func (b *Bar) Set(count, total int) {
+	b.mut.Lock()
+	if b.startTime.IsZero() && count > 0 {
+		b.startTime = time.Now()
+	}
+	b.count = count
+	if total != b.total {
+		b.total = total
+		b.setFormat()
+	}
+	b.mut.Unlock()
+}
+
 func (b *Bar) SetTag(tag string) *Bar {
 	b.tag = tag
 	return b
@@ -104,5 +130,8 @@ func (b *Bar) Finish() {
 }
 
 func digitCount(n int) int {
+	if n <= 0 {
+		return 1
+	}
 	return int(math.Floor(math.Log10(float64(n)))) + 1
 }
@@ -0,0 +1,367 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// NoTimestamp is the PTS or DTS of a PES packet without one.
+const NoTimestamp int64 = -1
+
+// PES is a packetized elementary stream packet.
+type PES struct {
+	PID        int
+	StreamType byte
+	// PTS and DTS are in 90kHz units, DTS equals PTS when the packet only
+	// has a PTS.
+	PTS int64
+	DTS int64
+	// PCR is the last program clock reference before the packet started, in
+	// 27MHz units, NoTimestamp when there was none.
+	PCR  int64
+	Data []byte
+	// Damaged is set when packets of the PES packet were lost, according to
+	// the continuity counters.
+	Damaged bool
+}
+
+// ContinuityError is a packet whose continuity counter does not follow the
+// one of the previous packet of its PID.
+type ContinuityError struct {
+	PID int
+	// Packet is the index of the packet in the stream.
+	Packet   int64
+	Expected byte
+	Got      byte
+}
+
+func (e ContinuityError) Error() string {
+	return fmt.Sprintf("continuity error on pid %d at packet %d: expected counter %d, got %d", e.PID, e.Packet, e.Expected, e.Got)
+}
+
+// Stats counts what the demuxer read.
+type Stats struct {
+	Packets int64
+	// Skipped is the number of bytes that are not part of a packet, skipped
+	// to find the next sync byte or left at the end.
+	Skipped          int64
+	ContinuityErrors []ContinuityError
+}
+
+const pidNull = 0x1fff
+
+// Demuxer reassembles the PSI sections and the PES packets of the elementary
+// streams listed in the PMT. The packets are written to it in any chunks,
+// and every PES packet is passed to fn once it is complete, the next one
+// starts or Flush is called. The tables and PES packets that can not be
+// parsed are skipped. The continuity counters are checked, and the
+// duplicated packets dropped.
+type Demuxer struct {
+	fn       func(*PES) error
+	buf      []byte
+	pmts     map[int]bool
+	streams  map[int]byte
+	order    []Stream
+	psi      map[int][]byte
+	pes      map[int]*pesBuffer
+	counters map[int]counter
+	pcr      int64
+	stats    Stats
+}
+
+type pesBuffer struct {
+	bytes.Buffer
+	pcr     int64
+	damaged bool
+}
+
+// counter is the last continuity counter of a PID.
+type counter struct {
+	last      byte
+	duplicate bool
+}
+
+func NewDemuxer(fn func(*PES) error) *Demuxer {
+	return &Demuxer{
+		fn:       fn,
+		pmts:     map[int]bool{},
+		streams:  map[int]byte{},
+		psi:      map[int][]byte{},
+		pes:      map[int]*pesBuffer{},
+		counters: map[int]counter{},
+		pcr:      NoTimestamp,
+	}
+}
+
+func (d *Demuxer) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	data := d.buf
+	for len(data) >= packetLength {
+		if data[0] != syncByte {
+			// resynchronize on the next sync byte
+			i := bytes.IndexByte(data[1:], syncByte)
+			if i < 0 {
+				d.stats.Skipped += int64(len(data))
+				data = data[len(data):]
+				break
+			}
+			d.stats.Skipped += int64(1 + i)
+			data = data[1+i:]
+			continue
+		}
+		err := d.packet(Packet(data[:packetLength]))
+		if err != nil {
+			return 0, err
+		}
+		data = data[packetLength:]
+	}
+	d.buf = append(d.buf[:0], data...)
+	return len(p), nil
+}
+
+func (d *Demuxer) packet(pkt Packet) error {
+	d.stats.Packets++
+	pid := pkt.PID()
+	if pid == pidNull {
+		return nil
+	}
+
+	af := pkt.AdaptationField()
+	if len(af) >= 7 && af[0]&0x10 != 0 {
+		d.pcr = parsePCR(af[1:])
+	}
+
+	payload := pkt.Payload()
+	if payload == nil || !d.continuity(pid, pkt, af) {
+		return nil
+	}
+
+	switch {
+	case IsPAT(pid) || d.pmts[pid]:
+		d.psiPacket(pid, pkt.PayloadUnitStart(), payload)
+	default:
+		if _, ok := d.streams[pid]; !ok {
+			return nil
+		}
+		buf := d.pes[pid]
+		if pkt.PayloadUnitStart() {
+			err := d.emit(pid)
+			if err != nil {
+				return err
+			}
+			buf = &pesBuffer{pcr: d.pcr}
+			d.pes[pid] = buf
+		}
+		// the packets before the first start of a PES packet are dropped
+		if buf == nil {
+			return nil
+		}
+		buf.Write(payload)
+		// a PES packet with a length is complete without waiting for the
+		// next one
+		if b := buf.Bytes(); len(b) >= 6 {
+			if length := int(b[4])<<8 | int(b[5]); length > 0 && len(b) >= 6+length {
+				return d.emit(pid)
+			}
+		}
+	}
+	return nil
+}
+
+// continuity checks the continuity counter of a packet with a payload. It
+// returns false for the duplicate of the previous packet, which is dropped.
+func (d *Demuxer) continuity(pid int, pkt Packet, af []byte) bool {
+	cc := pkt.ContinuityCounter()
+	c, known := d.counters[pid]
+	d.counters[pid] = counter{last: cc}
+	// the discontinuity indicator resets the counter
+	if !known || len(af) > 0 && af[0]&0x80 != 0 {
+		return true
+	}
+
+	expected := (c.last + 1) & 0x0f
+	switch {
+	case cc == expected:
+		return true
+	case cc == c.last && !c.duplicate:
+		d.counters[pid] = counter{last: cc, duplicate: true}
+		return false
+	}
+
+	d.stats.ContinuityErrors = append(d.stats.ContinuityErrors, ContinuityError{
+		PID:      pid,
+		Packet:   d.stats.Packets - 1,
+		Expected: expected,
+		Got:      cc,
+	})
+	if buf := d.pes[pid]; buf != nil {
+		buf.damaged = true
+	}
+	delete(d.psi, pid)
+	return true
+}
+
+// psiPacket reassembles the sections of the PAT and PMTs, which may span
+// several packets.
+func (d *Demuxer) psiPacket(pid int, start bool, payload []byte) {
+	if !start {
+		if s, ok := d.psi[pid]; ok {
+			d.psi[pid] = append(s, payload...)
+			d.table(pid)
+		}
+		return
+	}
+
+	pointer := 1 + int(payload[0])
+	if pointer > len(payload) {
+		delete(d.psi, pid)
+		return
+	}
+	// the pointer field skips the end of the previous section
+	if s, ok := d.psi[pid]; ok {
+		d.psi[pid] = append(s, payload[1:pointer]...)
+		d.table(pid)
+	}
+	d.psi[pid] = append([]byte(nil), payload[pointer:]...)
+	d.table(pid)
+}
+
+// table parses the section of pid once it is complete.
+func (d *Demuxer) table(pid int) {
+	s := d.psi[pid]
+	if len(s) < 3 {
+		return
+	}
+	length := 3 + int(binary.BigEndian.Uint16(s[1:3])&0x0fff)
+	if len(s) < length {
+		return
+	}
+	delete(d.psi, pid)
+	if s[0] == 0xff || length < 12 {
+		// stuffing
+		return
+	}
+	s = s[:length]
+
+	if IsPAT(pid) {
+		pids, err := parsePAT(s)
+		if err != nil {
+			return
+		}
+		for _, p := range pids {
+			d.pmts[p] = true
+		}
+		return
+	}
+
+	_, streams, err := parsePMT(s)
+	if err != nil {
+		return
+	}
+	for _, stream := range streams {
+		t, ok := d.streams[stream.PID]
+		if ok && t == stream.Type {
+			continue
+		}
+		d.streams[stream.PID] = stream.Type
+		if !ok {
+			d.order = append(d.order, stream)
+			continue
+		}
+		for i := range d.order {
+			if d.order[i].PID == stream.PID {
+				d.order[i].Type = stream.Type
+			}
+		}
+	}
+}
+
+// Flush passes the PES packets being reassembled to fn, in the order of the
+// streams in the PMT.
+func (d *Demuxer) Flush() error {
+	for _, stream := range d.order {
+		err := d.emit(stream.PID)
+		if err != nil {
+			return err
+		}
+	}
+	d.stats.Skipped += int64(len(d.buf))
+	d.buf = d.buf[:0]
+	return nil
+}
+
+// Streams returns the elementary streams listed in the PMTs read so far.
+func (d *Demuxer) Streams() []Stream {
+	return append([]Stream(nil), d.order...)
+}
+
+func (d *Demuxer) Stats() Stats {
+	stats := d.stats
+	stats.ContinuityErrors = append([]ContinuityError(nil), d.stats.ContinuityErrors...)
+	return stats
+}
+
+func (d *Demuxer) emit(pid int) error {
+	buf := d.pes[pid]
+	if buf == nil {
+		return nil
+	}
+	delete(d.pes, pid)
+
+	pes, err := parsePES(buf.Bytes())
+	if err != nil {
+		return nil
+	}
+	pes.PID = pid
+	pes.StreamType = d.streams[pid]
+	pes.PCR = buf.pcr
+	pes.Damaged = buf.damaged
+	return d.fn(pes)
+}
+
+func parsePES(data []byte) (*PES, error) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, fmt.Errorf("invalid pes start code")
+	}
+	pes := &PES{PTS: NoTimestamp, DTS: NoTimestamp}
+
+	switch data[3] {
+	case 0xbc, 0xbe, 0xbf, 0xf0, 0xf1, 0xf2, 0xf8, 0xff:
+		// streams without the optional header
+		pes.Data = data[6:]
+		return pes, nil
+	}
+
+	end := 9 + int(data[8])
+	if end > len(data) {
+		return nil, fmt.Errorf("pes header too long")
+	}
+	flags := data[7] >> 6
+	if flags&0x2 != 0 && end >= 14 {
+		pes.PTS = parseTimestamp(data[9:])
+		pes.DTS = pes.PTS
+	}
+	if flags == 0x3 && end >= 19 {
+		pes.DTS = parseTimestamp(data[14:])
+	}
+
+	pes.Data = data[end:]
+	// the length is 0 for video streams, the stuffing of other streams is
+	// removed
+	if length := int(data[4])<<8 | int(data[5]); length > 0 && 6+length >= end && 6+length < len(data) {
+		pes.Data = data[end : 6+length]
+	}
+	return pes, nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// parsePCR returns the program clock reference of an adaptation field, in
+// 27MHz units.
+func parsePCR(b []byte) int64 {
+	base := int64(b[0])<<25 | int64(b[1])<<17 | int64(b[2])<<9 | int64(b[3])<<1 | int64(b[4]>>7)
+	return base*300 + (int64(b[4]&0x01)<<8 | int64(b[5]))
+}
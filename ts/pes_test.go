@@ -0,0 +1,274 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// muxer writes hand-made packets, counting the continuity counters of each
+// PID.
+type muxer struct {
+	bytes.Buffer
+	cc map[int]byte
+}
+
+func newMuxer() *muxer {
+	return &muxer{cc: map[int]byte{}}
+}
+
+// packet writes a packet, with an adaptation field holding pcr when it is
+// not NoTimestamp and stuffing the payload to 184 bytes.
+func (m *muxer) packet(pid int, start bool, pcr int64, payload []byte) {
+	pkt := []byte{syncByte, byte(pid >> 8), byte(pid), 0x10 | m.cc[pid]}
+	if start {
+		pkt[1] |= 0x40
+	}
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+
+	var af []byte
+	if pcr != NoTimestamp {
+		base, ext := pcr/300, pcr%300
+		af = []byte{0x10, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7e | byte(ext>>8), byte(ext)}
+	}
+	if n := 184 - len(payload); n > 0 || af != nil {
+		if af == nil && n > 1 {
+			af = []byte{0}
+		}
+		af = append(af, bytes.Repeat([]byte{0xff}, max(0, n-1-len(af)))...)
+		pkt[3] |= 0x20
+		pkt = append(append(pkt, byte(len(af))), af...)
+	}
+	m.Write(append(pkt, payload...))
+}
+
+// section writes a PSI section in as many packets as needed, adding its
+// length and crc.
+func (m *muxer) section(pid int, s []byte) {
+	binary.BigEndian.PutUint16(s[1:], 0xb000|uint16(len(s)+4-3))
+	s = binary.BigEndian.AppendUint32(s, CRC32(s))
+	m.payload(pid, append([]byte{0}, s...), NoTimestamp, 0xff)
+}
+
+// payload splits a payload in packets, the last one stuffed with fill for
+// PSI or with the adaptation field for PES.
+func (m *muxer) payload(pid int, p []byte, pcr int64, fill int) {
+	for start := true; start || len(p) > 0; start = false {
+		n := min(len(p), 184)
+		if pcr != NoTimestamp && start {
+			n = min(len(p), 184-8)
+		}
+		chunk := p[:n]
+		if fill >= 0 && n < 184 {
+			chunk = append(chunk, bytes.Repeat([]byte{byte(fill)}, 184-n)...)
+		}
+		if start {
+			m.packet(pid, true, pcr, chunk)
+		} else {
+			m.packet(pid, false, NoTimestamp, chunk)
+		}
+		p = p[n:]
+	}
+}
+
+func (m *muxer) pat(pmt int) {
+	m.section(0, []byte{tablePAT, 0, 0, 0, 1, 0xc1, 0, 0, 0, 1, 0xe0 | byte(pmt>>8), byte(pmt)})
+}
+
+// pmt lists the streams, each with a descriptor of descLength bytes.
+func (m *muxer) pmt(pid int, descLength int, streams ...Stream) {
+	s := []byte{tablePMT, 0, 0, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0}
+	for _, stream := range streams {
+		s = append(s, stream.Type, 0xe0|byte(stream.PID>>8), byte(stream.PID), 0xf0, byte(descLength))
+		s = append(s, bytes.Repeat([]byte{0x05}, descLength)...)
+	}
+	m.section(pid, s)
+}
+
+func timestamp(prefix byte, ts int64) []byte {
+	return []byte{prefix<<4 | byte(ts>>29)&0x0e | 1, byte(ts >> 22), byte(ts>>14) | 1, byte(ts >> 7), byte(ts<<1) | 1}
+}
+
+// pes writes a PES packet with a PTS, and a DTS when it differs, of length 0
+// when unbounded is set.
+func (m *muxer) pes(pid int, id byte, pts, dts, pcr int64, data []byte, unbounded bool) {
+	header := []byte{0x80, 0x80, 5}
+	header = append(header, timestamp(2, pts)...)
+	if dts != pts {
+		header = []byte{0x80, 0xc0, 10}
+		header = append(header, timestamp(3, pts)...)
+		header = append(header, timestamp(1, dts)...)
+	}
+	p := append([]byte{0, 0, 1, id, 0, 0}, header...)
+	p = append(p, data...)
+	if !unbounded {
+		binary.BigEndian.PutUint16(p[4:], uint16(len(p)-6))
+	}
+	m.payload(pid, p, pcr, -1)
+}
+
+var (
+	video = Stream{PID: 0x100, Type: StreamTypeH264}
+	audio = Stream{PID: 0x101, Type: StreamTypeAAC}
+)
+
+// demux writes data in chunks of n bytes and flushes the demuxer.
+func demux(data []byte, n int) ([]*PES, Stats, []Stream) {
+	var list []*PES
+	d := NewDemuxer(func(p *PES) error {
+		list = append(list, p)
+		return nil
+	})
+	for len(data) > 0 {
+		k := min(n, len(data))
+		d.Write(data[:k])
+		data = data[k:]
+	}
+	d.Flush()
+	return list, d.Stats(), d.Streams()
+}
+
+func TestDemuxer(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xaa}, 500)
+	m := newMuxer()
+	m.pat(0x1000)
+	m.pmt(0x1000, 0, video, audio)
+	m.pes(video.PID, 0xe0, 9000, 6000, 27000000, frame, true)
+	m.pes(audio.PID, 0xc0, 9500, 9500, NoTimestamp, []byte{1, 2, 3}, false)
+	m.pes(video.PID, 0xe0, 12000, 9000, NoTimestamp, frame[:10], true)
+
+	for _, n := range []int{188, 100, 1000} {
+		list, stats, streams := demux(m.Bytes(), n)
+		if !reflect.DeepEqual(streams, []Stream{video, audio}) {
+			t.Fatalf("streams %v", streams)
+		}
+		if len(list) != 3 {
+			t.Fatalf("%d pes packets, want 3", len(list))
+		}
+		// the audio packet has a length, so it is complete before the
+		// first video one
+		want := []struct {
+			pid      int
+			pts, dts int64
+			pcr      int64
+			size     int
+		}{
+			{audio.PID, 9500, 9500, 27000000, 3},
+			{video.PID, 9000, 6000, 27000000, 500},
+			{video.PID, 12000, 9000, 27000000, 10},
+		}
+		for i, w := range want {
+			p := list[i]
+			if p.PID != w.pid || p.PTS != w.pts || p.DTS != w.dts || p.PCR != w.pcr || len(p.Data) != w.size || p.Damaged {
+				t.Errorf("chunks of %d, pes %d: pid %d pts %d dts %d pcr %d %d bytes damaged %v, want %+v",
+					n, i, p.PID, p.PTS, p.DTS, p.PCR, len(p.Data), p.Damaged, w)
+			}
+		}
+		if stats.Packets != int64(m.Len()/packetLength) || stats.Skipped != 0 || len(stats.ContinuityErrors) != 0 {
+			t.Errorf("chunks of %d: stats %+v", n, stats)
+		}
+	}
+}
+
+// TestDemuxerSections reads a PMT spanning two packets.
+func TestDemuxerSections(t *testing.T) {
+	m := newMuxer()
+	m.pat(0x1000)
+	m.pmt(0x1000, 60, video, audio, Stream{PID: 0x102, Type: StreamTypeMetadata})
+	m.pes(0x102, 0xbd, 100, 100, NoTimestamp, []byte("ID3"), false)
+
+	if m.Len() != 4*packetLength {
+		t.Fatalf("%d packets, want the pmt in 2", m.Len()/packetLength)
+	}
+	list, _, streams := demux(m.Bytes(), packetLength)
+	if len(streams) != 3 || streams[2].PID != 0x102 {
+		t.Fatalf("streams %v", streams)
+	}
+	if len(list) != 1 || string(list[0].Data) != "ID3" {
+		t.Fatalf("pes packets %v", list)
+	}
+}
+
+// TestDemuxerFlushOrder flushes the PES packets of several streams in the
+// order of the PMT.
+func TestDemuxerFlushOrder(t *testing.T) {
+	streams := []Stream{video, audio, {PID: 0x102, Type: StreamTypeAAC}, {PID: 0x103, Type: StreamTypeAC3}}
+	m := newMuxer()
+	m.pat(0x1000)
+	m.pmt(0x1000, 0, streams...)
+	for _, s := range streams {
+		m.pes(s.PID, 0xc0, 0, 0, NoTimestamp, []byte{1}, true)
+	}
+
+	for i := 0; i < 20; i++ {
+		list, _, _ := demux(m.Bytes(), packetLength)
+		var pids []int
+		for _, p := range list {
+			pids = append(pids, p.PID)
+		}
+		if !reflect.DeepEqual(pids, []int{0x100, 0x101, 0x102, 0x103}) {
+			t.Fatalf("flushed pids %x", pids)
+		}
+	}
+}
+
+func TestDemuxerContinuity(t *testing.T) {
+	m := newMuxer()
+	m.pat(0x1000)
+	m.pmt(0x1000, 0, video)
+	m.pes(video.PID, 0xe0, 0, 0, NoTimestamp, bytes.Repeat([]byte{1}, 400), true)
+	m.pes(video.PID, 0xe0, 3000, 3000, NoTimestamp, bytes.Repeat([]byte{2}, 400), true)
+	data := m.Bytes()
+	pkt := func(i int) []byte { return data[i*packetLength : (i+1)*packetLength] }
+
+	// the second packet of the first frame duplicated, the second one of
+	// the next frame lost
+	var b []byte
+	for i := 0; i < 7; i++ {
+		switch i {
+		case 3:
+			b = append(b, pkt(i)...)
+			b = append(b, pkt(i)...)
+		case 6:
+		default:
+			b = append(b, pkt(i)...)
+		}
+	}
+	b = append(b, pkt(7)...)
+
+	list, stats, _ := demux(b, packetLength)
+	if len(list) != 2 {
+		t.Fatalf("%d pes packets, want 2", len(list))
+	}
+	if list[0].Damaged || !bytes.Equal(list[0].Data, bytes.Repeat([]byte{1}, 400)) {
+		t.Errorf("first frame damaged %v, %d bytes", list[0].Damaged, len(list[0].Data))
+	}
+	if !list[1].Damaged {
+		t.Error("second frame not damaged")
+	}
+	want := []ContinuityError{{PID: video.PID, Packet: 7, Expected: 4, Got: 5}}
+	if !reflect.DeepEqual(stats.ContinuityErrors, want) {
+		t.Errorf("continuity errors %v, want %v", stats.ContinuityErrors, want)
+	}
+}
+
+func TestDemuxerSkipped(t *testing.T) {
+	m := newMuxer()
+	m.pat(0x1000)
+	m.pmt(0x1000, 0, audio)
+	m.pes(audio.PID, 0xc0, 0, 0, NoTimestamp, []byte{1, 2}, false)
+
+	data := append([]byte("junk"), m.Bytes()[:packetLength]...)
+	data = append(data, 0x00, 0x01)
+	data = append(data, m.Bytes()[packetLength:]...)
+	data = append(data, syncByte, 0, 0)
+
+	list, stats, _ := demux(data, 50)
+	if len(list) != 1 {
+		t.Fatalf("%d pes packets, want 1", len(list))
+	}
+	if stats.Skipped != 4+2+3 || stats.Packets != 3 {
+		t.Errorf("skipped %d bytes and read %d packets, want 9 and 3", stats.Skipped, stats.Packets)
+	}
+}
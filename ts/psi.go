@@ -0,0 +1,208 @@
+package ts
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	StreamTypeMPEG1Video byte = 0x01
+	StreamTypeMPEG2Video byte = 0x02
+	StreamTypeMPEG1Audio byte = 0x03
+	StreamTypeMPEG2Audio byte = 0x04
+	StreamTypePrivate    byte = 0x06
+	StreamTypeAAC        byte = 0x0f
+	StreamTypeLATM       byte = 0x11
+	StreamTypeMetadata   byte = 0x15
+	StreamTypeH264       byte = 0x1b
+	StreamTypeH265       byte = 0x24
+	StreamTypeAC3        byte = 0x81
+	StreamTypeEAC3       byte = 0x87
+
+	// stream types of SAMPLE-AES encrypted elementary streams
+	StreamTypeSampleAESAAC  byte = 0xcf
+	StreamTypeSampleAESH264 byte = 0xdb
+	StreamTypeSampleAESAC3  byte = 0xc1
+	StreamTypeSampleAESEAC3 byte = 0xc2
+)
+
+const (
+	pidPAT = 0
+
+	tablePAT = 0x00
+	tablePMT = 0x02
+)
+
+type Stream struct {
+	PID  int
+	Type byte
+}
+
+var streamTypes = map[byte]struct {
+	name, kind string
+}{
+	StreamTypeMPEG1Video:    {"MPEG-1 video", "video"},
+	StreamTypeMPEG2Video:    {"MPEG-2 video", "video"},
+	StreamTypeMPEG1Audio:    {"MPEG-1 audio", "audio"},
+	StreamTypeMPEG2Audio:    {"MPEG-2 audio", "audio"},
+	StreamTypePrivate:       {"private data", ""},
+	StreamTypeAAC:           {"AAC", "audio"},
+	StreamTypeLATM:          {"AAC LATM", "audio"},
+	StreamTypeMetadata:      {"timed metadata", "metadata"},
+	StreamTypeH264:          {"H.264", "video"},
+	StreamTypeH265:          {"H.265", "video"},
+	StreamTypeAC3:           {"AC-3", "audio"},
+	StreamTypeEAC3:          {"E-AC-3", "audio"},
+	StreamTypeSampleAESAAC:  {"SAMPLE-AES AAC", "audio"},
+	StreamTypeSampleAESH264: {"SAMPLE-AES H.264", "video"},
+	StreamTypeSampleAESAC3:  {"SAMPLE-AES AC-3", "audio"},
+	StreamTypeSampleAESEAC3: {"SAMPLE-AES E-AC-3", "audio"},
+}
+
+// Name returns the codec of the stream type, or the type in hex when it is
+// not known.
+func (s Stream) Name() string {
+	if t, ok := streamTypes[s.Type]; ok {
+		return t.name
+	}
+	return fmt.Sprintf("stream type 0x%02x", s.Type)
+}
+
+// Kind returns video, audio or metadata, or an empty string for the other
+// streams.
+func (s Stream) Kind() string {
+	return streamTypes[s.Type].kind
+}
+
+func IsPAT(pid int) bool {
+	return pid == pidPAT
+}
+
+// section returns the PSI section that starts in the payload of a packet
+// with the payload unit start indicator set.
+func section(payload []byte) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty psi payload")
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil, fmt.Errorf("invalid pointer field")
+	}
+	s := payload[start:]
+	length := int(binary.BigEndian.Uint16(s[1:3]) & 0x0fff)
+	if 3+length > len(s) || length < 9 {
+		return nil, fmt.Errorf("psi section spans several packets")
+	}
+	return s[:3+length], nil
+}
+
+// ParsePAT returns the PIDs of the program map tables listed in a PAT.
+func ParsePAT(payload []byte) ([]int, error) {
+	s, err := section(payload)
+	if err != nil {
+		return nil, err
+	}
+	return parsePAT(s)
+}
+
+func parsePAT(s []byte) ([]int, error) {
+	if s[0] != tablePAT {
+		return nil, fmt.Errorf("table id %d is not a pat", s[0])
+	}
+
+	var pids []int
+	// 8 bytes of header, 4 bytes of CRC
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := binary.BigEndian.Uint16(s[i:])
+		if program == 0 {
+			// network information table
+			continue
+		}
+		pids = append(pids, int(binary.BigEndian.Uint16(s[i+2:])&0x1fff))
+	}
+	return pids, nil
+}
+
+// ParsePMT returns the elementary streams listed in a PMT.
+func ParsePMT(payload []byte) ([]Stream, error) {
+	s, err := section(payload)
+	if err != nil {
+		return nil, err
+	}
+	_, streams, err := parsePMT(s)
+	return streams, err
+}
+
+// RemapStreamTypes changes in place the stream types of a PMT found in
+// mapping and updates the CRC of the section.
+func RemapStreamTypes(payload []byte, mapping map[byte]byte) error {
+	err := walkPMT(payload, func(entry []byte) {
+		if t, ok := mapping[entry[0]]; ok {
+			entry[0] = t
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s, _ := section(payload)
+	binary.BigEndian.PutUint32(s[len(s)-4:], CRC32(s[:len(s)-4]))
+	return nil
+}
+
+func walkPMT(payload []byte, fn func(entry []byte)) error {
+	s, err := section(payload)
+	if err != nil {
+		return err
+	}
+	return walkPMTSection(s, fn)
+}
+
+// parsePMT returns the PCR PID and the elementary streams of a PMT section.
+func parsePMT(s []byte) (int, []Stream, error) {
+	var streams []Stream
+	err := walkPMTSection(s, func(entry []byte) {
+		streams = append(streams, Stream{
+			PID:  int(binary.BigEndian.Uint16(entry[1:]) & 0x1fff),
+			Type: entry[0],
+		})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(binary.BigEndian.Uint16(s[8:]) & 0x1fff), streams, nil
+}
+
+func walkPMTSection(s []byte, fn func(entry []byte)) error {
+	if s[0] != tablePMT {
+		return fmt.Errorf("table id %d is not a pmt", s[0])
+	}
+	if len(s) < 12 {
+		return fmt.Errorf("pmt too short")
+	}
+
+	infoLength := int(binary.BigEndian.Uint16(s[10:]) & 0x0fff)
+	end := len(s) - 4
+	for i := 12 + infoLength; i+5 <= end; {
+		esInfoLength := int(binary.BigEndian.Uint16(s[i+3:]) & 0x0fff)
+		fn(s[i : i+5])
+		i += 5 + esInfoLength
+	}
+	return nil
+}
+
+// CRC32 is the CRC used by MPEG-2 PSI sections.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
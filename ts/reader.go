@@ -0,0 +1,58 @@
+package ts
+
+import "io"
+
+// Reader reads the PES packets of the elementary streams of an MPEG-TS
+// stream, demuxed as they are read.
+type Reader struct {
+	r     io.Reader
+	d     *Demuxer
+	buf   []byte
+	queue []*PES
+	err   error
+}
+
+func NewReader(r io.Reader) *Reader {
+	tr := &Reader{r: r, buf: make([]byte, 64*packetLength)}
+	tr.d = NewDemuxer(func(pes *PES) error {
+		tr.queue = append(tr.queue, pes)
+		return nil
+	})
+	return tr
+}
+
+// ReadPES returns the next PES packet, or io.EOF once the stream is read and
+// every PES packet was returned.
+func (r *Reader) ReadPES() (*PES, error) {
+	for len(r.queue) == 0 {
+		if r.err != nil {
+			return nil, r.err
+		}
+		n, err := r.r.Read(r.buf)
+		if n > 0 {
+			r.d.Write(r.buf[:n])
+		}
+		switch {
+		case err == io.EOF:
+			r.d.Flush()
+			r.err = io.EOF
+		case err != nil:
+			r.err = err
+		}
+	}
+
+	pes := r.queue[0]
+	r.queue = r.queue[1:]
+	return pes, nil
+}
+
+// Streams returns the elementary streams listed in the PMTs read so far.
+func (r *Reader) Streams() []Stream {
+	return r.d.Streams()
+}
+
+// Stats counts the packets read so far, and the bytes skipped and continuity
+// errors among them.
+func (r *Reader) Stats() Stats {
+	return r.d.Stats()
+}
@@ -3,11 +3,14 @@ package ts
 import (
 	"bytes"
 	"fmt"
+	"io"
 )
 
 const (
 	syncByte     byte = 0x47
 	packetLength int  = 188
+
+	PacketLength = packetLength
 )
 
 var (
@@ -72,18 +75,157 @@ func (p Packet) PID() int {
 	return int(p[1]&0x1f)<<8 | int(p[2])
 }
 
+func (p Packet) PayloadUnitStart() bool {
+	return p[1]&0x40 != 0
+}
+
+func (p Packet) ContinuityCounter() byte {
+	return p[3] & 0x0f
+}
+
+func (p Packet) SetContinuityCounter(cc byte) {
+	p[3] = p[3]&0xf0 | cc&0x0f
+}
+
+func (p Packet) HasAdaptationField() bool {
+	return p.adaptationFieldControl()&0x2 != 0
+}
+
+func (p Packet) HasPayload() bool {
+	return p.adaptationFieldControl()&0x1 != 0
+}
+
+// AdaptationField returns the adaptation field without its length byte.
+func (p Packet) AdaptationField() []byte {
+	if !p.HasAdaptationField() {
+		return nil
+	}
+	end := 5 + int(p[4])
+	if end > packetLength {
+		end = packetLength
+	}
+	return p[5:end]
+}
+
+func (p Packet) Payload() []byte {
+	if !p.HasPayload() {
+		return nil
+	}
+	start := 4
+	if p.HasAdaptationField() {
+		start += 1 + int(p[4])
+	}
+	if start >= packetLength {
+		return nil
+	}
+	return p[start:packetLength]
+}
+
+// NewPacket builds a packet from the 4 header bytes of p, the adaptation
+// field af (without length byte, may be nil) and as much of payload as fits.
+// The remaining space is filled with stuffing bytes. It returns the packet
+// and the number of payload bytes used.
+func (p Packet) NewPacket(af []byte, payload []byte) (Packet, int) {
+	af = stripStuffing(af)
+	pkt := make(Packet, packetLength)
+	copy(pkt, p[:4])
+
+	space := packetLength - 4
+	if af != nil {
+		space -= 1 + len(af)
+	}
+	n := len(payload)
+	if n > space {
+		n = space
+	}
+	stuffing := space - n
+
+	afc := byte(0)
+	if n > 0 {
+		afc |= 0x1
+	}
+	if af != nil || stuffing > 0 {
+		afc |= 0x2
+	}
+	pkt[3] = pkt[3]&0xcf | afc<<4
+
+	i := 4
+	if afc&0x2 != 0 {
+		switch {
+		case af != nil:
+			pkt[4] = byte(len(af) + stuffing)
+			i = 5 + copy(pkt[5:], af)
+		case stuffing == 1:
+			pkt[4] = 0
+			i = 5
+			stuffing = 0
+		default:
+			pkt[4] = byte(stuffing - 1)
+			pkt[5] = 0
+			i = 6
+			stuffing -= 2
+		}
+		for ; stuffing > 0; stuffing-- {
+			pkt[i] = 0xff
+			i++
+		}
+	}
+	copy(pkt[i:], payload[:n])
+
+	return pkt, n
+}
+
+// stripStuffing returns the part of an adaptation field that is in use.
+func stripStuffing(af []byte) []byte {
+	if len(af) == 0 {
+		return nil
+	}
+
+	flags := af[0]
+	if flags == 0 {
+		// nothing but stuffing
+		return nil
+	}
+	n := 1
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(af) { // transport private data
+		n += 1 + int(af[n])
+	}
+	if flags&0x01 != 0 && n < len(af) { // adaptation field extension
+		n += 1 + int(af[n])
+	}
+	if n > len(af) {
+		n = len(af)
+	}
+	return af[:n]
+}
+
 func TryFix(data []byte) []byte {
 	if len(data) == 0 {
 		return data
 	}
 
-	if bytes.HasPrefix(data, jpgHeader) || bytes.HasPrefix(data, pngHeader) || bytes.HasPrefix(data, gifHeader) || bytes.HasPrefix(data, bmpHeader) {
+	if HasImageHeader(data) {
 		return Fix(data)
 	}
 
 	return data
 }
 
+// HasImageHeader reports whether data starts with the header of an image,
+// which some websites put in front of the ts packets.
+func HasImageHeader(data []byte) bool {
+	return bytes.HasPrefix(data, jpgHeader) || bytes.HasPrefix(data, pngHeader) || bytes.HasPrefix(data, gifHeader) || bytes.HasPrefix(data, bmpHeader)
+}
+
 func Fix(data []byte) []byte {
 	backup := data
 	for {
@@ -102,3 +244,74 @@ func Fix(data []byte) []byte {
 		data = data[index+1:]
 	}
 }
+
+// fixReader removes the image header of a segment like TryFix while it is
+// read. Only the image header and the first packet are buffered.
+type fixReader struct {
+	r    io.Reader
+	buf  []byte
+	pos  int
+	done bool
+	err  error
+}
+
+func NewFixReader(r io.Reader) io.Reader {
+	return &fixReader{r: r}
+}
+
+func (f *fixReader) Read(p []byte) (int, error) {
+	for !f.done && f.err == nil {
+		f.fill()
+	}
+
+	if len(f.buf) > 0 {
+		n := copy(p, f.buf)
+		f.buf = f.buf[n:]
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.r.Read(p)
+}
+
+func (f *fixReader) fill() {
+	chunk := make([]byte, 32*1024)
+	n, err := f.r.Read(chunk)
+	f.buf = append(f.buf, chunk[:n]...)
+	if err != nil {
+		// the whole segment is kept when no packet is found, like Fix
+		f.done = true
+		if err != io.EOF {
+			f.err = err
+		}
+	}
+
+	if len(f.buf) < len(jpgHeader) && !f.done {
+		return
+	}
+	if !HasImageHeader(f.buf) {
+		f.done = true
+		return
+	}
+
+	for {
+		index := bytes.IndexByte(f.buf[f.pos:], syncByte)
+		if index < 0 {
+			f.pos = len(f.buf)
+			return
+		}
+		index += f.pos
+		if index+packetLength >= len(f.buf) {
+			// more data is needed to check the packet
+			f.pos = index
+			return
+		}
+		if f.buf[index+packetLength] == syncByte && CheckHead(f.buf[index:]) == nil {
+			f.buf = f.buf[index:]
+			f.done = true
+			return
+		}
+		f.pos = index + 1
+	}
+}
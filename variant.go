@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+	"github.com/greyh4t/m3u8-Downloader-Go/downloader"
+)
+
+// parseSelector builds the variant selector from --select and the options
+// that are shorthands for its conditions.
+func parseSelector() error {
+	s, err := downloader.ParseSelector(conf.Select)
+	if err != nil {
+		return err
+	}
+
+	if conf.MaxHeight > 0 && (s.MaxHeight == 0 || conf.MaxHeight < s.MaxHeight) {
+		s.MaxHeight = conf.MaxHeight
+	}
+
+	if conf.MaxBandwidth != "" {
+		n, err := downloader.ParseBandwidth(conf.MaxBandwidth)
+		if err != nil {
+			return err
+		}
+		if s.MaxBandwidth == 0 || n < s.MaxBandwidth {
+			s.MaxBandwidth = n
+		}
+	}
+
+	s.Codecs = append(conf.Codecs, s.Codecs...)
+	if conf.DesiredResolution != "" {
+		s.Resolution = conf.DesiredResolution
+	}
+
+	conf.selector = s
+	return nil
+}
+
+// variantSelected reports whether the variant is selected by the options.
+func variantSelected() bool {
+	return conf.DesiredResolution != "" || conf.Select != "" || conf.MaxHeight > 0 || conf.MaxBandwidth != "" || len(conf.Codecs) > 0
+}
+
+// stdinIsTerminal reports whether the standard input is a terminal. The null
+// device is a character device too.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+func formatVariant(v *m3u8.Variant) string {
+	s := fmt.Sprintf("Resolution: %-9s Bandwidth: %-8d FrameRate: %.2f Codecs: %s", v.Resolution, v.Bandwidth, v.FrameRate, v.Codecs)
+	if v.VideoRange != "" {
+		s += " Range: " + v.VideoRange
+	}
+	return s
+}
+
+// pickVariant asks which of the variants to download, the first one by
+// default.
+func pickVariant(variants []*m3u8.Variant) (*m3u8.Variant, error) {
+	for i, v := range variants {
+		fmt.Fprintf(os.Stderr, "%2d) %s\n", i+1, formatVariant(v))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "Select a variant [1-%d, default 1]: ", len(variants))
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return variants[0], nil
+		}
+
+		n, perr := strconv.Atoi(line)
+		if perr == nil && n >= 1 && n <= len(variants) {
+			return variants[n-1], nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no variant selected")
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package webvtt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue is a subtitle shown from Start to End.
+type Cue struct {
+	Start    time.Duration
+	End      time.Duration
+	Settings string
+	Text     string
+}
+
+// File is a parsed WebVTT file. Comments and cue identifiers are dropped.
+type File struct {
+	Header []string
+	// Blocks are the STYLE and REGION blocks.
+	Blocks []string
+	Cues   []*Cue
+}
+
+// Parse reads a WebVTT file.
+func Parse(data []byte) (*File, error) {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	blocks := strings.Split(text, "\n\n")
+	header := strings.Split(blocks[0], "\n")
+	if header[0] != "WEBVTT" && !strings.HasPrefix(header[0], "WEBVTT ") && !strings.HasPrefix(header[0], "WEBVTT\t") {
+		return nil, fmt.Errorf("missing WEBVTT header")
+	}
+
+	f := &File{Header: header[1:]}
+	for _, block := range blocks[1:] {
+		block = strings.Trim(block, "\n")
+		if block == "" {
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		switch {
+		case strings.HasPrefix(lines[0], "NOTE"):
+			continue
+		case lines[0] == "STYLE" || lines[0] == "REGION":
+			if len(f.Cues) == 0 {
+				f.Blocks = append(f.Blocks, block)
+			}
+			continue
+		}
+
+		// the identifier of the cue is optional
+		if !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 || !strings.Contains(lines[0], "-->") {
+			continue
+		}
+
+		cue, err := parseTiming(lines[0])
+		if err != nil {
+			return nil, err
+		}
+		cue.Text = strings.Join(lines[1:], "\n")
+		f.Cues = append(f.Cues, cue)
+	}
+
+	return f, nil
+}
+
+func parseTiming(line string) (*Cue, error) {
+	start, rest, _ := strings.Cut(line, "-->")
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid cue timing %q", line)
+	}
+
+	var err error
+	cue := &Cue{Settings: strings.Join(fields[1:], " ")}
+	cue.Start, err = ParseTimestamp(strings.TrimSpace(start))
+	if err != nil {
+		return nil, err
+	}
+	cue.End, err = ParseTimestamp(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	return cue, nil
+}
+
+// ParseTimestamp parses a timestamp in the hh:mm:ss.ttt or mm:ss.ttt format.
+func ParseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	sec, frac, ok := strings.Cut(parts[len(parts)-1], ".")
+	if !ok || len(frac) != 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	var d time.Duration
+	for i, part := range append(parts[:len(parts)-1], sec, frac) {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		if i == len(parts) {
+			d += time.Duration(n) * time.Millisecond
+		} else {
+			d = d*60 + time.Duration(n)*time.Second
+		}
+	}
+	return d, nil
+}
+
+// TimestampMap returns the X-TIMESTAMP-MAP header of the file, which maps
+// the LOCAL time of the cues to the MPEGTS time of the media, in 90 kHz
+// units.
+func (f *File) TimestampMap() (mpegts int64, local time.Duration, ok bool) {
+	for _, line := range f.Header {
+		value, found := strings.CutPrefix(line, "X-TIMESTAMP-MAP=")
+		if !found {
+			continue
+		}
+
+		var err error
+		var hasMPEGTS, hasLocal bool
+		for _, param := range strings.Split(value, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), ":")
+			switch k {
+			case "MPEGTS":
+				mpegts, err = strconv.ParseInt(v, 10, 64)
+				hasMPEGTS = err == nil
+			case "LOCAL":
+				local, err = ParseTimestamp(v)
+				hasLocal = err == nil
+			}
+		}
+		return mpegts, local, hasMPEGTS && hasLocal
+	}
+	return 0, 0, false
+}
+
+// tolerance is how far apart the cues repeated at segment boundaries can be.
+const tolerance = 10 * time.Millisecond
+
+// Merger merges the cues of the segments of a subtitle playlist, on the
+// time line of the video set with SetBase and SetStart, or of the first
+// segment.
+type Merger struct {
+	blocks []string
+	cues   []*Cue
+	base   int64
+	based  bool
+	start  time.Duration
+}
+
+func NewMerger() *Merger {
+	return &Merger{}
+}
+
+// SetBase times the cues of the segments with a X-TIMESTAMP-MAP header from
+// the MPEGTS time the video starts at.
+func (m *Merger) SetBase(mpegts int64) {
+	m.base = mpegts
+	m.based = true
+}
+
+// SetStart sets where the video starts in the playlist, when it is clipped.
+// The cues of the segments without a X-TIMESTAMP-MAP header, or with one
+// when the base is not set, are timed from the start of the playlist.
+func (m *Merger) SetStart(start time.Duration) {
+	m.start = start
+}
+
+// Add merges the cues of a segment. The cues repeated from the previous
+// segments, or continuing one of them, are merged with it. The cues ending
+// before the video starts are dropped.
+func (m *Merger) Add(data []byte) error {
+	f, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	if m.blocks == nil {
+		m.blocks = f.Blocks
+	}
+
+	offset := m.offset(f)
+	for _, cue := range f.Cues {
+		cue.Start += offset
+		cue.End += offset
+		if cue.End <= 0 {
+			continue
+		}
+		if !m.merge(cue) {
+			m.cues = append(m.cues, cue)
+		}
+	}
+	return nil
+}
+
+// offset returns the duration to add to the cues of the file to move them
+// to the time line of the video.
+func (m *Merger) offset(f *File) time.Duration {
+	mpegts, local, ok := f.TimestampMap()
+	if !ok {
+		return -m.start
+	}
+
+	ticks := int64(local) * 90000 / int64(time.Second)
+	if !m.based {
+		// LOCAL time 0 of the first segment is taken as the start of the
+		// playlist
+		m.base = mpegts - ticks + int64(m.start)*90000/int64(time.Second)
+		m.based = true
+	}
+
+	// MPEGTS time is 33 bits and wraps around
+	for mpegts-ticks < m.base-1<<32 {
+		mpegts += 1 << 33
+	}
+
+	return time.Duration(mpegts-ticks-m.base) * time.Second / 90000
+}
+
+// merge extends a recent cue with the same text that cue overlaps or
+// continues. The cues repeated at segment boundaries are among the last ones
+// added.
+func (m *Merger) merge(cue *Cue) bool {
+	for i := len(m.cues) - 1; i >= 0 && i >= len(m.cues)-16; i-- {
+		prev := m.cues[i]
+		if prev.Text == cue.Text && prev.Settings == cue.Settings &&
+			cue.Start+tolerance >= prev.Start && cue.Start <= prev.End+tolerance {
+			if cue.End > prev.End {
+				prev.End = cue.End
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Merger) sorted() []*Cue {
+	cues := append([]*Cue(nil), m.cues...)
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].Start < cues[j].Start
+	})
+	return cues
+}
+
+func (m *Merger) WriteVTT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n\n")
+	for _, block := range m.blocks {
+		bw.WriteString(block + "\n\n")
+	}
+	for _, cue := range m.sorted() {
+		bw.WriteString(FormatTimestamp(cue.Start, '.') + " --> " + FormatTimestamp(cue.End, '.'))
+		if cue.Settings != "" {
+			bw.WriteString(" " + cue.Settings)
+		}
+		bw.WriteString("\n" + cue.Text + "\n\n")
+	}
+	return bw.Flush()
+}
+
+func (m *Merger) WriteSRT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for i, cue := range m.sorted() {
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", i+1, FormatTimestamp(cue.Start, ','), FormatTimestamp(cue.End, ','), srtText(cue.Text))
+	}
+	return bw.Flush()
+}
+
+// FormatTimestamp formats d as hh:mm:ss.ttt, with sep between the seconds
+// and the milliseconds.
+func FormatTimestamp(d time.Duration, sep byte) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+var (
+	tagRe    = regexp.MustCompile(`<[^>]*>`)
+	entities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "\u200e", "&rlm;", "\u200f")
+)
+
+// srtText keeps the b, i and u tags of the cue text, which SRT also has, and
+// removes the others.
+func srtText(text string) string {
+	text = tagRe.ReplaceAllStringFunc(text, func(tag string) string {
+		name := strings.TrimPrefix(tag[1:len(tag)-1], "/")
+		if i := strings.IndexAny(name, ". \t"); i >= 0 {
+			name = name[:i]
+		}
+		switch name {
+		case "b", "i", "u":
+			if tag[1] == '/' {
+				return "</" + name + ">"
+			}
+			return "<" + name + ">"
+		}
+		return ""
+	})
+	return entities.Replace(text)
+}
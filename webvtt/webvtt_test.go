@@ -0,0 +1,78 @@
+package webvtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// merge merges the segments and returns the cue timings and texts.
+func merge(t *testing.T, m *Merger, segments ...string) string {
+	for i, s := range segments {
+		err := m.Add([]byte(s))
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+	}
+	var buf bytes.Buffer
+	m.WriteVTT(&buf)
+	var cues []string
+	for _, block := range strings.Split(strings.TrimSpace(buf.String()), "\n\n")[1:] {
+		cues = append(cues, strings.ReplaceAll(block, "\n", " "))
+	}
+	return strings.Join(cues, "\n")
+}
+
+func TestMergerTimestampMap(t *testing.T) {
+	// the cues of each segment are timed from its start, given by the
+	// MPEGTS time of its header
+	segments := []string{
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:03.000\none\n",
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1260000,LOCAL:00:00:00.000\n\n00:00:00.500 --> 00:00:02.000\ntwo\n",
+		"WEBVTT\nX-TIMESTAMP-MAP=LOCAL:00:00:10.000,MPEGTS:1800000\n\n00:00:10.000 --> 00:00:11.000\nthree\n",
+	}
+	tests := []struct {
+		name string
+		base int64
+		want string
+	}{
+		{"first segment", -1, "00:00:01.000 --> 00:00:03.000 one\n00:00:04.500 --> 00:00:06.000 two\n00:00:10.000 --> 00:00:11.000 three"},
+		// the video starts 2 seconds after the subtitles
+		{"video", 900000 + 2*90000, "00:00:00.000 --> 00:00:01.000 one\n00:00:02.500 --> 00:00:04.000 two\n00:00:08.000 --> 00:00:09.000 three"},
+		// the MPEGTS time of the video wraps around before the subtitles
+		{"wrapped", 1<<33 - 90000 + 900000, "00:00:02.000 --> 00:00:04.000 one\n00:00:05.500 --> 00:00:07.000 two\n00:00:11.000 --> 00:00:12.000 three"},
+	}
+	for _, tt := range tests {
+		m := NewMerger()
+		if tt.base >= 0 {
+			m.SetBase(tt.base % (1 << 33))
+		}
+		if got := merge(t, m, segments...); got != tt.want {
+			t.Errorf("%s: cues\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergerStart(t *testing.T) {
+	// the cues are timed from the start of the playlist, the video is
+	// clipped 5 seconds later
+	segments := []string{
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:03.000\none\n\n00:00:04.000 --> 00:00:07.000\ntwo\n",
+		"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:06.500 --> 00:00:07.500\nthree\n",
+	}
+	m := NewMerger()
+	m.SetStart(5 * time.Second)
+	want := "00:00:00.000 --> 00:00:02.000 two\n00:00:01.500 --> 00:00:02.500 three"
+	if got := merge(t, m, segments...); got != want {
+		t.Errorf("cues\n%s\nwant\n%s", got, want)
+	}
+
+	// without X-TIMESTAMP-MAP
+	m = NewMerger()
+	m.SetStart(5 * time.Second)
+	want = "00:00:01.000 --> 00:00:03.000 four"
+	if got := merge(t, m, "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nzero\n\n00:00:06.000 --> 00:00:08.000\nfour\n"); got != want {
+		t.Errorf("cues\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,274 @@
+package zhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kind is the kind of resource requested, which selects the Rule checking
+// the responses.
+type Kind int
+
+const (
+	Any Kind = iota
+	Playlist
+	Key
+	Segment
+	Subtitle
+	// Encrypted is a segment encrypted whole, with AES-128, whose bytes are
+	// random until it is decrypted.
+	Encrypted
+)
+
+var kindNames = []string{"any", "playlist", "key", "segment", "subtitle", "encrypted"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("kind %d", int(k))
+}
+
+// ParseKind returns the kind of the name given by String.
+func ParseKind(s string) (Kind, error) {
+	for i, name := range kindNames {
+		if strings.EqualFold(s, name) {
+			return Kind(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown kind of resource %s", s)
+}
+
+// Rule describes the valid responses of a kind of resource, so that the
+// error pages some servers send with a 2xx status are not taken for the
+// resource. The zero Rule accepts any response.
+type Rule struct {
+	// ContentTypes are the media types accepted, "video/*" accepts every
+	// video type. A response without Content-Type is accepted.
+	ContentTypes []string
+	// Magic are the starts accepted for the body, which may follow a byte
+	// order mark and spaces.
+	Magic []Magic
+	// RejectText refuses the bodies that are HTML, XML or JSON text.
+	RejectText bool
+	// MinSize and MaxSize limit the size of the body, when they are not 0.
+	MinSize int64
+	MaxSize int64
+}
+
+// Magic is a sequence of bytes found at Offset in the body. Mask, when set,
+// is ANDed with the body before the comparison.
+type Magic struct {
+	Offset int
+	Bytes  []byte
+	Mask   []byte
+}
+
+func (m Magic) match(b []byte) bool {
+	if len(b) < m.Offset+len(m.Bytes) {
+		return false
+	}
+	b = b[m.Offset : m.Offset+len(m.Bytes)]
+	if m.Mask == nil {
+		return bytes.Equal(b, m.Bytes)
+	}
+	for i, c := range m.Bytes {
+		mask := byte(0xff)
+		if i < len(m.Mask) {
+			mask = m.Mask[i]
+		}
+		if b[i]&mask != c {
+			return false
+		}
+	}
+	return true
+}
+
+func prefixes(list ...string) []Magic {
+	var magic []Magic
+	for _, s := range list {
+		magic = append(magic, Magic{Bytes: []byte(s)})
+	}
+	return magic
+}
+
+// DefaultRules returns the rules used by a new Zhttp: playlists must start
+// with #EXTM3U, keys must be 16 bytes, segments must start like a media
+// format and encrypted segments must not be text. Playlists and segments must
+// also be served with one of their content types.
+func DefaultRules() map[Kind]Rule {
+	playlistTypes := []string{
+		"application/vnd.apple.mpegurl", "application/x-mpegurl", "application/mpegurl",
+		"audio/mpegurl", "audio/x-mpegurl", "text/plain",
+		"application/octet-stream", "binary/octet-stream",
+	}
+	// some websites disguise the segments as images
+	segmentTypes := []string{
+		"video/*", "audio/*", "image/*", "application/mp4",
+		"application/x-mpegts", "application/mp2t",
+		"application/octet-stream", "binary/octet-stream",
+	}
+	segmentMagic := prefixes(
+		// MPEG-TS, packed audio with ID3 tags and AC-3
+		"\x47", "ID3", "\x0b\x77",
+		// the images put in front of the packets
+		"\xff\xd8\xff", "\x89PNG", "GIF8", "BM",
+		"WEBVTT",
+	)
+	// the 11 bits syncing the MP3 and ADTS frames
+	segmentMagic = append(segmentMagic, Magic{Bytes: []byte{0xff, 0xe0}, Mask: []byte{0xff, 0xe0}})
+	// the fMP4 boxes starting a segment, after their size
+	for _, box := range []string{"ftyp", "styp", "moov", "moof", "sidx", "emsg", "prft", "free"} {
+		segmentMagic = append(segmentMagic, Magic{Offset: 4, Bytes: []byte(box)})
+	}
+
+	return map[Kind]Rule{
+		Playlist:  {ContentTypes: playlistTypes, Magic: prefixes("#EXTM3U")},
+		Key:       {MinSize: 16, MaxSize: 16},
+		Segment:   {ContentTypes: segmentTypes, Magic: segmentMagic},
+		Encrypted: {ContentTypes: append([]string(nil), segmentTypes...), RejectText: true},
+	}
+}
+
+// ResponseError is a response refused by the rule of its kind.
+type ResponseError struct {
+	Kind   Kind
+	Reason string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid %s response: %s", e.Kind, e.Reason)
+}
+
+// sniffLength is the number of bytes of the body read to check its start.
+const sniffLength = 512
+
+// checkHeader checks the content type and the length of a response before
+// its body is read.
+func (rule Rule) checkHeader(kind Kind, header http.Header, length int64) error {
+	if len(rule.ContentTypes) > 0 {
+		if t := header.Get("Content-Type"); t != "" && !rule.accepts(t) {
+			return &ResponseError{Kind: kind, Reason: fmt.Sprintf("content type %s", t)}
+		}
+	}
+	if length >= 0 {
+		return rule.checkSize(kind, length, true)
+	}
+	return nil
+}
+
+func (rule Rule) accepts(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t, _, _ = strings.Cut(strings.ToLower(contentType), ";")
+		t = strings.TrimSpace(t)
+	}
+	for _, accepted := range rule.ContentTypes {
+		accepted = strings.ToLower(accepted)
+		if t == accepted || strings.HasSuffix(accepted, "/*") && strings.HasPrefix(t, accepted[:len(accepted)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSize checks the size of the body, which is only known to be the final
+// one at the end of the body.
+func (rule Rule) checkSize(kind Kind, n int64, end bool) error {
+	switch {
+	case rule.MaxSize > 0 && n > rule.MaxSize:
+		return &ResponseError{Kind: kind, Reason: fmt.Sprintf("more than %d bytes", rule.MaxSize)}
+	case end && rule.MinSize > 0 && n < rule.MinSize:
+		return &ResponseError{Kind: kind, Reason: fmt.Sprintf("%d bytes, less than %d", n, rule.MinSize)}
+	}
+	return nil
+}
+
+// checkStart checks the first bytes of the body.
+func (rule Rule) checkStart(kind Kind, head []byte) error {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if len(rule.Magic) > 0 {
+		ok := false
+		for _, magic := range rule.Magic {
+			if magic.match(head) || magic.match(trimmed) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return &ResponseError{Kind: kind, Reason: "starts with " + quote(head)}
+		}
+	}
+	if rule.RejectText && len(trimmed) > 0 && bytes.IndexByte([]byte("<{["), trimmed[0]) >= 0 && isText(head) {
+		return &ResponseError{Kind: kind, Reason: "text " + quote(head)}
+	}
+	return nil
+}
+
+// isText reports whether b is UTF-8 text without control characters. The
+// encrypted and binary bodies are very unlikely to be.
+func isText(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			// a rune cut at the end of b
+			return !utf8.FullRune(b)
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' || r == 0x7f {
+			return false
+		}
+		b = b[size:]
+	}
+	return true
+}
+
+// quote returns the start of a body for an error message.
+func quote(b []byte) string {
+	if !isText(b) {
+		return fmt.Sprintf("% x", b[:min(len(b), 8)])
+	}
+	return fmt.Sprintf("%q", strings.Join(strings.Fields(string(b[:min(len(b), 64)])), " "))
+}
+
+// ruleReader checks the start and the size of a body while it is read. Its
+// errors are ReadError, so that the request is retried.
+type ruleReader struct {
+	r    io.Reader
+	rule Rule
+	kind Kind
+	n    int64
+}
+
+func newRuleReader(r io.Reader, rule Rule, kind Kind) (io.Reader, error) {
+	if len(rule.Magic) > 0 || rule.RejectText {
+		br := bufio.NewReaderSize(r, sniffLength)
+		head, err := br.Peek(sniffLength)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		err = rule.checkStart(kind, head)
+		if err != nil {
+			return nil, &ReadError{Err: err}
+		}
+		r = br
+	}
+	if rule.MinSize == 0 && rule.MaxSize == 0 {
+		return r, nil
+	}
+	return &ruleReader{r: r, rule: rule, kind: kind}, nil
+}
+
+func (v *ruleReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.n += int64(n)
+	if cerr := v.rule.checkSize(v.kind, v.n, err == io.EOF); cerr != nil {
+		return n, &ReadError{Err: cerr}
+	}
+	return n, err
+}
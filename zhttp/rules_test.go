@@ -0,0 +1,130 @@
+package zhttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const errorPage = `<!DOCTYPE html>
+<html><head><title>Error</title></head><body>Service unavailable</body></html>`
+
+func TestDefaultRules(t *testing.T) {
+	rules := DefaultRules()
+	fmp4 := append([]byte{0, 0, 0, 24}, "styp"...)
+	random := []byte{0x3c, 0x8f, 0x01, 0xd2, 0x9a, 0x00, 0x7e, 0xff}
+	tests := []struct {
+		kind Kind
+		body []byte
+		ok   bool
+	}{
+		{Playlist, []byte("\xef\xbb\xbf#EXTM3U\n#EXT-X-VERSION:3\n"), true},
+		{Playlist, []byte(errorPage), false},
+		{Segment, append([]byte{0x47, 0x40, 0x00, 0x10}, make([]byte, 184)...), true},
+		{Segment, fmp4, true},
+		{Segment, []byte("ID3\x04\x00"), true},
+		{Segment, []byte("\xff\xf1\x50\x80"), true},
+		{Segment, []byte("\xff\xfb\x90\x64"), true},
+		{Segment, []byte("\xff\xf3\x48\xc4"), true},
+		{Segment, []byte("\xff\xf2\x40\xc0"), true},
+		{Segment, []byte("\xff\xd8\xff\xe0"), true},
+		{Segment, []byte("\xff\x1f"), false},
+		{Segment, []byte("\x89PNG\r\n\x1a\n"), true},
+		{Segment, []byte("WEBVTT\n\n"), true},
+		{Segment, []byte(errorPage), false},
+		{Segment, []byte(`{"error":"not found"}`), false},
+		{Encrypted, random, true},
+		{Encrypted, []byte(errorPage), false},
+	}
+	for i, tt := range tests {
+		err := rules[tt.kind].checkStart(tt.kind, tt.body)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: %s checkStart = %v, want ok %v", i, tt.kind, err, tt.ok)
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	rules := DefaultRules()
+	tests := []struct {
+		kind        Kind
+		contentType string
+		ok          bool
+	}{
+		{Playlist, "application/vnd.apple.mpegurl", true},
+		{Playlist, "audio/mpegurl; charset=utf-8", true},
+		{Playlist, "text/html", false},
+		{Segment, "video/MP2T", true},
+		{Segment, "audio/aac", true},
+		{Segment, "image/png", true},
+		{Segment, "", true},
+		{Segment, "text/html; charset=utf-8", false},
+		{Encrypted, "application/octet-stream", true},
+		{Encrypted, "application/json", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.contentType != "" {
+			header.Set("Content-Type", tt.contentType)
+		}
+		err := rules[tt.kind].checkHeader(tt.kind, header, -1)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %q: checkHeader = %v, want ok %v", tt.kind, tt.contentType, err, tt.ok)
+		}
+	}
+}
+
+// TestErrorPageRetried gets an HTML error page with a 200 status before the
+// segment, which is downloaded again.
+func TestErrorPageRetried(t *testing.T) {
+	segment := append([]byte{0x47, 0x40, 0x00, 0x10}, make([]byte, 184)...)
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Write([]byte(errorPage))
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Write(segment)
+	}))
+	defer srv.Close()
+
+	z := NewWithClient(srv.Client())
+	code, body, err := z.Get(context.Background(), Segment, srv.URL+"/seg0.ts", nil, 3)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("Get = %d, %v", code, err)
+	}
+	if !bytes.Equal(body, segment) {
+		t.Errorf("body = %q, want the segment", body)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+// TestErrorPageRejected always gets an HTML page with a 200 status, which is
+// refused for its content type once the retries are used up.
+func TestErrorPageRejected(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(errorPage))
+	}))
+	defer srv.Close()
+
+	z := NewWithClient(srv.Client())
+	_, _, err := z.Get(context.Background(), Segment, srv.URL+"/seg0.ts", nil, 2)
+	var rerr *ResponseError
+	if !errors.As(err, &rerr) || rerr.Kind != Segment {
+		t.Fatalf("err = %v, want a ResponseError", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
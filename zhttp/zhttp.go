@@ -2,7 +2,10 @@ package zhttp
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -12,17 +15,25 @@ import (
 
 type Zhttp struct {
 	client *http.Client
+	rules  map[Kind]Rule
 }
 
 func New(timeout time.Duration, proxy string, skipVerify bool) (*Zhttp, error) {
-	z := &Zhttp{
-		client: &http.Client{
-			Timeout:   timeout,
-			Transport: http.DefaultTransport.(*http.Transport).Clone(),
-		},
+	client, err := NewClient(timeout, proxy, skipVerify)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithClient(client), nil
+}
+
+// NewClient returns the http client used by New.
+func NewClient(timeout time.Duration, proxy string, skipVerify bool) (*http.Client, error) {
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
 	}
 	if skipVerify {
-		z.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
 	if proxy != "" {
@@ -30,65 +41,223 @@ func New(timeout time.Duration, proxy string, skipVerify bool) (*Zhttp, error) {
 		if err != nil {
 			return nil, err
 		}
-		z.client.Transport.(*http.Transport).Proxy = http.ProxyURL(p)
+		client.Transport.(*http.Transport).Proxy = http.ProxyURL(p)
+	}
+
+	return client, nil
+}
+
+func NewWithClient(client *http.Client) *Zhttp {
+	return &Zhttp{
+		client: client,
+		rules:  DefaultRules(),
 	}
+}
+
+// SetRule replaces the rule checking the responses of a kind of resource.
+// It must be called before the first request.
+func (z *Zhttp) SetRule(kind Kind, rule Rule) {
+	z.rules[kind] = rule
+}
+
+func (z *Zhttp) Get(ctx context.Context, kind Kind, url string, headers map[string]string, retry int) (code int, body []byte, err error) {
+	return z.GetRange(ctx, kind, url, headers, retry, 0, 0)
+}
+
+// GetRange downloads limit bytes of the resource starting at offset. If limit
+// is 0 the whole resource is downloaded.
+func (z *Zhttp) GetRange(ctx context.Context, kind Kind, url string, headers map[string]string, retry int, offset, limit int64) (code int, body []byte, err error) {
+	code, err = z.GetRangeFunc(ctx, kind, url, headers, retry, offset, limit, func(r io.Reader) error {
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return code, body, err
+}
 
-	return z, nil
+// ReadError is an error of the connection while reading a response body, or
+// a ResponseError.
+type ReadError struct {
+	Err error
 }
 
-func (z *Zhttp) Get(url string, headers map[string]string, retry int) (code int, body []byte, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (e *ReadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// GetRangeFunc is like GetRange, but streams the body of a successful
+// response to fn instead of reading it in memory. When reading the body
+// fails, or the response is refused by the rule of kind, the request is
+// retried and fn is called again. Other errors returned by fn are returned
+// right away, as well as the error of ctx once it is done.
+func (z *Zhttp) GetRangeFunc(ctx context.Context, kind Kind, url string, headers map[string]string, retry int, offset, limit int64, fn func(io.Reader) error) (code int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
 
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36")
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	if limit > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+	}
 
 	for retry > 0 {
 		retry--
-		code, body, err = z.get(req)
+		code, err = z.get(req, kind, offset, limit, fn)
 		if err == nil {
 			if code/100 == 2 {
-				return code, body, err
+				return code, err
 			}
+		} else if !errors.As(err, new(*ReadError)) {
+			return code, err
+		} else if ctx.Err() != nil {
+			return code, ctx.Err()
 		} else if strings.Contains(err.Error(), "INTERNAL_ERROR") {
 			z.resetConnection()
 		}
-		time.Sleep(time.Second * 2)
+
+		if retry > 0 {
+			select {
+			case <-ctx.Done():
+				return code, ctx.Err()
+			case <-time.After(time.Second * 2):
+			}
+		}
 	}
 
 	return
 }
 
+// rangeReader checks that a response to a range request holds exactly the
+// requested bytes. Servers that ignore the Range header answer with the full
+// resource, in which case the range is cut out of it.
+func rangeReader(code int, header http.Header, body io.Reader, offset, limit int64) (io.Reader, error) {
+	if code != http.StatusPartialContent {
+		n, err := io.CopyN(io.Discard, body, offset)
+		if err == io.EOF {
+			return nil, fmt.Errorf("range %d-%d out of resource of %d bytes", offset, offset+limit-1, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &exactReader{r: body, n: limit, offset: offset, limit: limit}, nil
+	}
+
+	var start, end int64
+	var total string
+	contentRange := header.Get("Content-Range")
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content-range %q", contentRange)
+	}
+	if start != offset || end != offset+limit-1 {
+		return nil, fmt.Errorf("content-range %q does not match requested range %d-%d", contentRange, offset, offset+limit-1)
+	}
+
+	return &exactReader{r: body, n: limit, offset: offset, limit: limit}, nil
+}
+
+// exactReader reads the n bytes of a range, and fails if the body is shorter.
+type exactReader struct {
+	r             io.Reader
+	n             int64
+	offset, limit int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		return n, fmt.Errorf("got %d bytes of range %d-%d", e.limit-e.n, e.offset, e.offset+e.limit-1)
+	}
+	return n, err
+}
+
+// bodyReader turns the errors of the connection into ReadError.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		if _, ok := err.(*ReadError); !ok {
+			err = &ReadError{Err: err}
+		}
+	}
+	return n, err
+}
+
 func (z *Zhttp) resetConnection() {
-	t := z.client.Transport.(*http.Transport)
+	t, ok := z.client.Transport.(*http.Transport)
+	if !ok {
+		z.client.CloseIdleConnections()
+		return
+	}
 	t.CloseIdleConnections()
 	z.client.Transport = t.Clone()
 }
 
-func (z *Zhttp) get(req *http.Request) (int, []byte, error) {
+func (z *Zhttp) get(req *http.Request, kind Kind, offset, limit int64, fn func(io.Reader) error) (int, error) {
 	resp, err := z.client.Do(req)
 	if err != nil {
-		return 0, nil, err
+		return 0, &ReadError{Err: err}
 	}
 	defer resp.Body.Close()
 
-	r := resp.Body
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, nil
+	}
+
+	// the length of the body is only known before a range is cut out of it
+	// or it is decompressed
+	rule := z.rules[kind]
+	length := resp.ContentLength
+	if limit > 0 || resp.Header.Get("Content-Encoding") != "" {
+		length = -1
+	}
+	err = rule.checkHeader(kind, resp.Header, length)
+	if err != nil {
+		return 0, &ReadError{Err: err}
+	}
+
+	var r io.Reader = resp.Body
 	if equalFold(resp.Header.Get("Content-Encoding"), "gzip") && !resp.Uncompressed {
-		r, err = gzip.NewReader(resp.Body)
+		gr, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			return 0, nil, err
+			return 0, &ReadError{Err: err}
 		}
-		defer r.Close()
+		defer gr.Close()
+		r = gr
 	}
-	data, err := io.ReadAll(r)
+	r = bodyReader{r: r}
+
+	if limit > 0 {
+		r, err = rangeReader(resp.StatusCode, resp.Header, r, offset, limit)
+		if err != nil {
+			return 0, &ReadError{Err: err}
+		}
+		r = bodyReader{r: r}
+	}
+
+	r, err = newRuleReader(r, rule, kind)
 	if err != nil {
-		return 0, nil, err
+		return 0, err
 	}
-	return resp.StatusCode, data, nil
+
+	return resp.StatusCode, fn(r)
 }
 
 // equalFold is strings.equalFold, ASCII only. It reports whether s and t
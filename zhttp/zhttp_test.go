@@ -0,0 +1,57 @@
+package zhttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestRangeReader(t *testing.T) {
+	resource := make([]byte, 1000)
+	for i := range resource {
+		resource[i] = byte(i)
+	}
+	tests := []struct {
+		name         string
+		code         int
+		contentRange string
+		body         []byte
+		// err is where the error is, "" when the range is read
+		err string
+	}{
+		{"partial", 206, "bytes 100-199/1000", resource[100:200], ""},
+		{"unknown length", 206, "bytes 100-199/*", resource[100:200], ""},
+		{"longer body", 206, "bytes 100-199/1000", resource[100:300], ""},
+		{"other range", 206, "bytes 0-99/1000", resource[:100], "open"},
+		{"longer range", 206, "bytes 100-299/1000", resource[100:300], "open"},
+		{"no content-range", 206, "", resource[100:200], "open"},
+		{"invalid content-range", 206, "100-199/1000", resource[100:200], "open"},
+		{"short body", 206, "bytes 100-199/1000", resource[100:150], "read"},
+		{"whole resource", 200, "", resource, ""},
+		{"resource too short", 200, "", resource[:50], "open"},
+		{"resource cut in the range", 200, "", resource[:150], "read"},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.contentRange != "" {
+			header.Set("Content-Range", tt.contentRange)
+		}
+		r, err := rangeReader(tt.code, header, bytes.NewReader(tt.body), 100, 100)
+		if (err != nil) != (tt.err == "open") {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if (err != nil) != (tt.err == "read") {
+			t.Errorf("%s: read error %v", tt.name, err)
+			continue
+		}
+		if err == nil && !bytes.Equal(data, resource[100:200]) {
+			t.Errorf("%s: read %d bytes, not the range", tt.name, len(data))
+		}
+	}
+}